@@ -1,17 +1,211 @@
 package handler
 
 import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
 	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/sb-nour/providers-endpoints/lib"
+	"github.com/sb-nour/providers-endpoints/service"
 	gee "github.com/tbxark/g4vercel"
 )
 
+// fetchDeadline keeps the handler well inside the Vercel function limit so
+// that partial results are returned instead of the function being killed.
+const fetchDeadline = 25 * time.Second
+
+// Cache-Control of the region responses: complete ones are cached by the CDN
+// for a day, while ones with stale, fallback or missing providers are not, so
+// that the next request gets the refreshed regions.
+const (
+	cacheControlComplete = "public, max-age=86400"
+	cacheControlDegraded = "no-store"
+)
+
 func Handler(w http.ResponseWriter, r *http.Request) {
 	server := gee.New()
 	server.GET("/", func(context *gee.Context) {
-		regions := lib.GetRegions()
-		context.JSON(200, regions)
+		regions := lib.Regions(fetchResults(context, r))
+
+		output, err := lib.FormatRegions(regions, r.URL.Query().Get("format"))
+		if err != nil {
+			context.JSON(400, map[string]string{"error": err.Error()})
+			return
+		}
+		context.JSON(200, output)
+	})
+	server.GET("/zones", func(context *gee.Context) {
+		regions := lib.Regions(fetchResults(context, r))
+		context.JSON(200, lib.Zones(regions))
+	})
+	server.GET("/provenance", func(context *gee.Context) {
+		provenance := lib.Provenance(fetchResults(context, r))
+		context.SetHeader("Cache-Control", "no-store")
+		context.JSON(200, provenance)
+	})
+	server.GET("/refresh", func(context *gee.Context) {
+		if status, err := authorizeRefresh(r); err != nil {
+			context.JSON(status, map[string]string{"error": err.Error()})
+			return
+		}
+		if !lib.CacheConfigured() {
+			context.JSON(503, map[string]string{"error": "refresh needs a cache backend"})
+			return
+		}
+		if err := lib.InitCache(); err != nil {
+			log.Printf("Failed to initialize cache: %v", err)
+			context.JSON(503, map[string]string{"error": "cache unavailable"})
+			return
+		}
+
+		ctx, cancel := contextWithDeadline(r)
+		defer cancel()
+
+		refreshed, err := lib.RefreshStale(ctx)
+		response := map[string]interface{}{"refreshed": refreshed}
+		if err != nil {
+			log.Printf("Some providers could not be refreshed: %v", err)
+			response["error"] = err.Error()
+		}
+		context.JSON(200, response)
+	})
+	server.GET("/history", func(context *gee.Context) {
+		query := r.URL.Query()
+		at := time.Now()
+		if value := query.Get("at"); value != "" {
+			var err error
+			if at, err = lib.ParseTime(value); err != nil {
+				context.JSON(400, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+		serveHistory(context, func() (interface{}, error) {
+			return lib.RegionsAt(r.Context(), query.Get("provider"), at)
+		})
+	})
+	server.GET("/changes", func(context *gee.Context) {
+		query := r.URL.Query()
+		var from, to time.Time
+		for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+			if value := query.Get(name); value != "" {
+				var err error
+				if *t, err = lib.ParseTime(value); err != nil {
+					context.JSON(400, map[string]string{"error": err.Error()})
+					return
+				}
+			}
+		}
+		serveHistory(context, func() (interface{}, error) {
+			return lib.RegionChanges(r.Context(), query.Get("provider"), from, to)
+		})
+	})
+	server.GET("/sightings", func(context *gee.Context) {
+		serveHistory(context, func() (interface{}, error) {
+			return lib.RegionSightings(r.Context(), r.URL.Query().Get("provider"))
+		})
+	})
+	server.GET("/quarantine", func(context *gee.Context) {
+		serveHistory(context, func() (interface{}, error) {
+			return lib.QuarantinedResults(r.Context())
+		})
 	})
 	server.Handle(w, r)
 }
+
+// serveHistory answers a history query from the configured cache backend,
+// which stays open between invocations of a warm function.
+func serveHistory(context *gee.Context, query func() (interface{}, error)) {
+	if !lib.CacheConfigured() {
+		context.JSON(503, map[string]string{"error": "history needs a cache backend"})
+		return
+	}
+	if err := lib.InitCache(); err != nil {
+		log.Printf("Failed to initialize cache: %v", err)
+		context.JSON(503, map[string]string{"error": "cache unavailable"})
+		return
+	}
+
+	output, err := query()
+	if err != nil {
+		log.Printf("History query failed: %v", err)
+		context.JSON(500, map[string]string{"error": err.Error()})
+		return
+	}
+	context.JSON(200, output)
+}
+
+// authorizeRefresh checks that a refresh request carries CRON_SECRET as a
+// bearer token, as Vercel cron jobs send it, so that nobody else can make the
+// function scrape every provider.
+func authorizeRefresh(r *http.Request) (int, error) {
+	secret := os.Getenv("CRON_SECRET")
+	if secret == "" {
+		return 503, errors.New("refresh needs CRON_SECRET to be set")
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return 401, errors.New("unauthorized")
+	}
+	return 200, nil
+}
+
+// fetchResults fetches the regions of every provider within the handler
+// deadline, through the cache when one is configured, reporting timed out,
+// stale and fallback providers in response headers and keeping the response
+// out of the CDN cache if there are any.
+func fetchResults(context *gee.Context, r *http.Request) map[string]service.FetchResult {
+	ctx, cancel := contextWithDeadline(r)
+	defer cancel()
+
+	var results map[string]service.FetchResult
+	var err error
+	if lib.CacheConfigured() {
+		if initErr := lib.InitCache(); initErr != nil {
+			log.Printf("Failed to initialize cache: %v", initErr)
+		}
+		results, err = lib.GetResultsWithCache(ctx)
+	} else {
+		results, err = lib.GetResults(ctx)
+	}
+
+	var fallback []string
+	for provider, result := range results {
+		if result.Provenance.Source == service.SourceFallback {
+			fallback = append(fallback, provider)
+		}
+	}
+	if len(fallback) > 0 {
+		sort.Strings(fallback)
+		context.SetHeader("X-Providers-Fallback", strings.Join(fallback, ", "))
+	}
+
+	cacheControl := cacheControlComplete
+	if len(fallback) > 0 || err != nil {
+		cacheControl = cacheControlDegraded
+	}
+	context.SetHeader("Cache-Control", cacheControl)
+
+	if err != nil {
+		log.Printf("Some providers could not be fetched: %v", err)
+
+		var timeoutErr *lib.TimeoutError
+		if errors.As(err, &timeoutErr) {
+			context.SetHeader("X-Providers-Timed-Out", strings.Join(timeoutErr.Providers, ", "))
+		}
+		var staleErr *lib.StaleError
+		if errors.As(err, &staleErr) {
+			context.SetHeader("X-Providers-Stale", strings.Join(staleErr.Providers, ", "))
+		}
+	}
+	return results
+}
+
+func contextWithDeadline(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), lib.FetchDeadline(fetchDeadline))
+}
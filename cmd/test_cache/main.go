@@ -1,8 +1,8 @@
 package main
 
 import (
+	"context"
 	"log"
-	"os"
 
 	"github.com/joho/godotenv"
 	"github.com/sb-nour/providers-endpoints/lib"
@@ -18,36 +18,38 @@ func main() {
 	// This is a test script to demonstrate caching functionality
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
-	// Check if Turso DB is configured
-	if os.Getenv("TURSO_DATABASE_URL") == "" {
-		log.Printf("TURSO_DATABASE_URL not set. Please configure Turso DB to test caching.")
-		log.Printf("Example: TURSO_DATABASE_URL=file:test.db go run cmd/test_cache.go")
+	// Check if a cache backend is configured
+	if !lib.CacheConfigured() {
+		log.Printf("No cache backend configured. Please set CACHE_BACKEND or TURSO_DATABASE_URL to test caching.")
+		log.Printf("Example: CACHE_BACKEND=sqlite CACHE_PATH=test.db go run ./cmd/test_cache")
 		return
 	}
 
-	// Initialize Turso DB
-	if err := lib.InitTursoDB(); err != nil {
-		log.Fatalf("Failed to initialize Turso DB: %v", err)
+	// Initialize the cache
+	if err := lib.InitCache(); err != nil {
+		log.Fatalf("Failed to initialize %s cache: %v", lib.CacheBackend(), err)
 	}
-	defer lib.CloseTursoDB()
+	defer lib.CloseCache()
 
 	// Test caching with a single provider (AWS)
 	log.Printf("Testing cache functionality with AWS provider...")
 
+	ctx := context.Background()
+
 	// Create a cached version of AWS provider
 	cachedAWSFunc := lib.CachedProviderFunction("Amazon AWS Test", service.GetAmazonRegions)
 
 	// First call - should fetch fresh data
 	log.Printf("First call (should fetch fresh data):")
-	regions1 := cachedAWSFunc()
+	regions1 := cachedAWSFunc(ctx).Regions
 	log.Printf("Storage regions count: %d, Compute regions count: %d",
-		len(regions1.Storage), len(regions1.Compute))
+		len(regions1[service.CategoryStorage]), len(regions1[service.CategoryCompute]))
 
 	// Second call - should use cached data
 	log.Printf("Second call (should use cached data):")
-	regions2 := cachedAWSFunc()
+	regions2 := cachedAWSFunc(ctx).Regions
 	log.Printf("Storage regions count: %d, Compute regions count: %d",
-		len(regions2.Storage), len(regions2.Compute))
+		len(regions2[service.CategoryStorage]), len(regions2[service.CategoryCompute]))
 
 	// Show cache statistics
 	lib.LogCacheStats()
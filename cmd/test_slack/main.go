@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/sb-nour/providers-endpoints/lib"
@@ -51,7 +53,10 @@ func main() {
 
 	// Test 3: Error notification (simulated)
 	fmt.Println("\n📤 Sending simulated error notification...")
-	lib.SendRegionsFetchErrorNotification("Test Provider", fmt.Errorf("simulated error for testing"))
+	lib.Notify(context.Background(), lib.FetchFailed{
+		EventInfo: lib.EventInfo{Provider: "Test Provider", At: time.Now().UTC()},
+		Error:     "simulated error for testing",
+	})
 	fmt.Println("✅ Error notification sent!")
 
 	// Test 4: Show environment variables
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sb-nour/providers-endpoints/service"
+)
+
+// update_fallbacks regenerates the fallback snapshots embedded in the service
+// package from a live run. Only providers whose every category was fetched
+// successfully are written, so a broken source never overwrites a good
+// snapshot.
+//
+//	go run ./cmd/update_fallbacks
+//	go run ./cmd/update_fallbacks -providers aws,linode
+//
+// It also runs from go generate in the service package.
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	dir := flag.String("dir", "service/fallback", "directory the snapshots are written to")
+	only := flag.String("providers", "", "comma separated provider IDs to update (default all, including disabled providers)")
+	flag.Parse()
+
+	providers := service.AllProviders()
+	if *only != "" {
+		providers = providers[:0]
+		for _, id := range strings.Split(*only, ",") {
+			provider, ok := service.LookupProvider(strings.TrimSpace(id))
+			if !ok {
+				log.Fatalf("Unknown provider: %s", id)
+			}
+			providers = append(providers, provider)
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := 0
+	for _, provider := range providers {
+		wg.Add(1)
+		go func(provider service.Provider) {
+			defer wg.Done()
+			if err := updateFallback(*dir, provider); err != nil {
+				log.Printf("Skipping %s: %v", provider.ID(), err)
+				mu.Lock()
+				failed++
+				mu.Unlock()
+				return
+			}
+			log.Printf("Updated fallback snapshot for %s", provider.ID())
+		}(provider)
+	}
+	wg.Wait()
+
+	if failed > 0 {
+		log.Printf("%d of %d snapshots were not updated", failed, len(providers))
+		os.Exit(1)
+	}
+}
+
+func updateFallback(dir string, provider service.Provider) error {
+	ctx, cancel := context.WithTimeout(context.Background(), service.ProviderTimeout(provider.ID()))
+	defer cancel()
+
+	result := provider.Fetch(ctx)
+	if err := result.Err(); err != nil {
+		return err
+	}
+	if result.Regions.Empty() {
+		return errors.New("no regions returned")
+	}
+
+	snapshot := service.Snapshot{
+		Provider:    provider.ID(),
+		GeneratedAt: time.Now().UTC().Truncate(time.Second),
+		Regions:     result.Regions,
+	}
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, service.FallbackFile(provider.ID())), append(data, '\n'), 0o644)
+}
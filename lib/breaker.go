@@ -0,0 +1,226 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/sb-nour/providers-endpoints/service"
+)
+
+// States of a provider's circuit breaker.
+const (
+	// BreakerClosed fetches the provider live as usual.
+	BreakerClosed = "closed"
+	// BreakerOpen skips live fetches of the provider until its backoff ends.
+	BreakerOpen = "open"
+	// BreakerHalfOpen lets a single live fetch through once the backoff has
+	// ended: it closes the breaker if it succeeds and opens it again for
+	// longer if it fails.
+	BreakerHalfOpen = "half-open"
+)
+
+// Defaults of the circuit breaker, unless BREAKER_THRESHOLD,
+// BREAKER_BASE_BACKOFF and BREAKER_MAX_BACKOFF are set.
+const (
+	DefaultBreakerThreshold   = 3
+	DefaultBreakerBaseBackoff = 5 * time.Minute
+	DefaultBreakerMaxBackoff  = 24 * time.Hour
+)
+
+// BreakerThreshold returns how many live fetches of a provider in a row must
+// fail before its breaker opens, read from BREAKER_THRESHOLD.
+func BreakerThreshold() int {
+	if n, ok := envInt("BREAKER_THRESHOLD"); ok {
+		return n
+	}
+	return DefaultBreakerThreshold
+}
+
+// BreakerBackoff returns how long the breaker of a provider stays open after
+// the given number of failures in a row: BREAKER_BASE_BACKOFF once the
+// threshold is reached, doubling with every further failure up to
+// BREAKER_MAX_BACKOFF. It is zero below the threshold.
+func BreakerBackoff(failures int) time.Duration {
+	threshold := BreakerThreshold()
+	if failures < threshold {
+		return 0
+	}
+
+	backoff, ok := envDuration("BREAKER_BASE_BACKOFF")
+	if !ok {
+		backoff = DefaultBreakerBaseBackoff
+	}
+	maxBackoff, ok := envDuration("BREAKER_MAX_BACKOFF")
+	if !ok {
+		maxBackoff = DefaultBreakerMaxBackoff
+	}
+	for i := threshold; i < failures && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+// ProviderHealth is the failure record of a provider whose last live fetch
+// failed. Providers without one are healthy.
+type ProviderHealth struct {
+	Provider string `json:"provider"`
+	// Failures is the number of live fetches in a row that failed.
+	Failures       int       `json:"failures"`
+	LastError      string    `json:"last_error"`
+	FirstFailureAt time.Time `json:"first_failure_at"`
+	LastFailureAt  time.Time `json:"last_failure_at"`
+	// RetryAt is when the next live fetch may be attempted, zero while the
+	// breaker is closed.
+	RetryAt time.Time `json:"retry_at,omitempty"`
+}
+
+// State returns the state of the provider's breaker at the given time.
+func (h ProviderHealth) State(at time.Time) string {
+	switch {
+	case h.RetryAt.IsZero():
+		return BreakerClosed
+	case at.Before(h.RetryAt):
+		return BreakerOpen
+	default:
+		return BreakerHalfOpen
+	}
+}
+
+// HealthTracker is implemented by caches that keep the failure record of each
+// provider, so that repeatedly failing providers are backed off across runs.
+type HealthTracker interface {
+	// ProviderHealth returns the failure record of a provider, if it has one.
+	ProviderHealth(ctx context.Context, provider string) (*ProviderHealth, bool, error)
+	// PutProviderHealth stores the failure record of a provider.
+	PutProviderHealth(ctx context.Context, health ProviderHealth) error
+	// DeleteProviderHealth removes the failure record of a provider.
+	DeleteProviderHealth(ctx context.Context, provider string) error
+	// ProviderHealths lists every failure record, by provider name.
+	ProviderHealths(ctx context.Context) ([]ProviderHealth, error)
+}
+
+// CircuitOpenError is the error of the categories of a provider that was not
+// fetched because its breaker is open.
+type CircuitOpenError struct {
+	Provider string
+	RetryAt  time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit open for %s until %s", e.Provider, e.RetryAt.Format(time.RFC3339))
+}
+
+// openCircuit returns the failure record of a provider if its breaker is open,
+// so that the live fetch is skipped.
+func openCircuit(ctx context.Context, providerName string) (*ProviderHealth, bool) {
+	tracker, ok := cache.(HealthTracker)
+	if !ok {
+		return nil, false
+	}
+
+	health, found, err := tracker.ProviderHealth(ctx, providerName)
+	if err != nil {
+		log.Printf("Failed to check health of provider %s: %v", providerName, err)
+		return nil, false
+	}
+	if !found || health.State(time.Now()) != BreakerOpen {
+		return nil, false
+	}
+	return health, true
+}
+
+// openCircuitResult is the result of a provider whose breaker is open: its
+// cached regions, expired or not, or an error for every category if it has
+// none. Either way a warning says why the provider was not fetched.
+func openCircuitResult(providerName string, health *ProviderHealth, entry *CacheEntry) service.FetchResult {
+	err := &CircuitOpenError{Provider: providerName, RetryAt: health.RetryAt}
+	if entry != nil {
+		result := cachedResult(entry, entry.Expired())
+		result.Warn("%v", err)
+		return result
+	}
+
+	var result service.FetchResult
+	result.Warn("%v", err)
+	if p, ok := registeredProvider(providerName); ok {
+		for _, category := range p.Categories() {
+			result.SetError(category, err)
+		}
+	}
+	return result
+}
+
+// recordFailure counts a failed live fetch of a provider and returns its
+// updated failure record, opening its breaker once the failures reach the
+// threshold. It reports false if the cache keeps no failure records.
+func recordFailure(ctx context.Context, providerName string, fetchErr error) (ProviderHealth, bool) {
+	tracker, ok := cache.(HealthTracker)
+	if !ok {
+		return ProviderHealth{}, false
+	}
+	// Record the failure even if the fetch failed because ctx is done
+	ctx = context.WithoutCancel(ctx)
+
+	now := time.Now().UTC()
+	health := ProviderHealth{Provider: providerName, FirstFailureAt: now}
+	if previous, found, err := tracker.ProviderHealth(ctx, providerName); err != nil {
+		log.Printf("Failed to check health of provider %s: %v", providerName, err)
+	} else if found {
+		health = *previous
+	}
+
+	health.Failures++
+	health.LastError = fetchErr.Error()
+	health.LastFailureAt = now
+	health.RetryAt = time.Time{}
+	if backoff := BreakerBackoff(health.Failures); backoff > 0 {
+		health.RetryAt = now.Add(backoff)
+		log.Printf("Circuit open for provider %s after %d failures, next attempt at %s",
+			providerName, health.Failures, health.RetryAt.Format(time.RFC3339))
+	}
+
+	if err := tracker.PutProviderHealth(ctx, health); err != nil {
+		log.Printf("Failed to record failure of provider %s: %v", providerName, err)
+	}
+	return health, true
+}
+
+// recordSuccess closes the breaker of a provider after a successful live fetch,
+// sending a recovered notification if it had been failing.
+func recordSuccess(ctx context.Context, providerName string) {
+	tracker, ok := cache.(HealthTracker)
+	if !ok {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+
+	health, found, err := tracker.ProviderHealth(ctx, providerName)
+	if err != nil {
+		log.Printf("Failed to check health of provider %s: %v", providerName, err)
+		return
+	}
+	if !found {
+		return
+	}
+
+	if err := tracker.DeleteProviderHealth(ctx, providerName); err != nil {
+		log.Printf("Failed to clear failures of provider %s: %v", providerName, err)
+	}
+	log.Printf("Provider %s recovered after %d failures", providerName, health.Failures)
+	Notify(ctx, Recovered{EventInfo: newEventInfo(providerName), Health: *health})
+}
+
+// ProviderHealths lists the failure record of every failing provider, if the
+// cache keeps them.
+func ProviderHealths(ctx context.Context) ([]ProviderHealth, error) {
+	tracker, ok := cache.(HealthTracker)
+	if !ok {
+		return nil, nil
+	}
+	return tracker.ProviderHealths(ctx)
+}
@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sb-nour/providers-endpoints/service"
+)
+
+func TestBreakerBackoff(t *testing.T) {
+	t.Setenv("BREAKER_THRESHOLD", "2")
+	t.Setenv("BREAKER_BASE_BACKOFF", "1m")
+	t.Setenv("BREAKER_MAX_BACKOFF", "5m")
+
+	for failures, want := range map[int]time.Duration{
+		1: 0,
+		2: time.Minute,
+		3: 2 * time.Minute,
+		4: 4 * time.Minute,
+		5: 5 * time.Minute,
+		9: 5 * time.Minute,
+	} {
+		if got := BreakerBackoff(failures); got != want {
+			t.Errorf("BreakerBackoff(%d) = %s, want %s", failures, got, want)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("BREAKER_THRESHOLD", "2")
+	t.Setenv("SLACK_WEBHOOK_URL", "")
+
+	for backend, open := range openTestCaches(t) {
+		t.Run(backend, func(t *testing.T) {
+			useTestCache(t, open())
+			tracker := cache.(HealthTracker)
+
+			fetches, failing := 0, true
+			fetch := CachedProviderFunction("Example Cloud", func(context.Context) service.FetchResult {
+				fetches++
+				if failing {
+					var result service.FetchResult
+					result.SetError(service.CategoryStorage, errors.New("unavailable"))
+					return result
+				}
+				return service.FetchResult{Regions: testRegions("eu-1")}
+			})
+
+			// The breaker opens once the threshold is reached, and live fetches
+			// are skipped while it is open
+			fetch(ctx)
+			fetch(ctx)
+			result := fetch(ctx)
+			if fetches != 2 {
+				t.Errorf("fetched %d times, want the breaker to open after 2 failures", fetches)
+			}
+			if len(result.Warnings) != 1 || !result.Regions.Empty() {
+				t.Errorf("result with the breaker open = %+v, want no regions and a warning", result)
+			}
+			health, found, err := tracker.ProviderHealth(ctx, "Example Cloud")
+			if err != nil || !found || health.Failures != 2 || health.State(time.Now()) != BreakerOpen {
+				t.Fatalf("ProviderHealth = %+v, %v, %v, want an open breaker after 2 failures", health, found, err)
+			}
+
+			// Once the backoff ends a single attempt closes it again
+			health.RetryAt = time.Now().Add(-time.Second)
+			if err := tracker.PutProviderHealth(ctx, *health); err != nil {
+				t.Fatal(err)
+			}
+			if health.State(time.Now()) != BreakerHalfOpen {
+				t.Errorf("state after the backoff = %s, want %s", health.State(time.Now()), BreakerHalfOpen)
+			}
+			failing = false
+			if result := fetch(ctx); result.Err() != nil || fetches != 3 {
+				t.Errorf("half-open fetch = %v after %d fetches, want a successful live fetch", result.Err(), fetches)
+			}
+			if _, found, err := tracker.ProviderHealth(ctx, "Example Cloud"); err != nil || found {
+				t.Errorf("ProviderHealth after recovering = %v, %v, want none", found, err)
+			}
+		})
+	}
+}
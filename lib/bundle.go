@@ -0,0 +1,227 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// BundleVersion is the version of the bundles written by ExportBundle. Bump
+// it when the format changes in a way older versions cannot import.
+const BundleVersion = 1
+
+// Bundle is a copy of the cached regions, and of their history if the cache
+// keeps one, used to seed a cache from another environment.
+type Bundle struct {
+	Version    int               `json:"version"`
+	ExportedAt time.Time         `json:"exported_at"`
+	Entries    []CacheEntry      `json:"entries"`
+	History    []ProviderHistory `json:"history,omitempty"`
+}
+
+// ImportOptions control how ImportBundle combines a bundle with the cache.
+type ImportOptions struct {
+	// Overwrite replaces the entries and history of the cache with those of
+	// the bundle. Otherwise an entry is only imported if it is newer than
+	// the cached one, and histories are merged.
+	Overwrite bool
+	// Providers restricts the import to these provider names, if set.
+	Providers []string
+}
+
+// ImportSummary counts what ImportBundle imported.
+type ImportSummary struct {
+	Entries int `json:"entries"`
+	// Skipped is the number of entries older than the cached ones.
+	Skipped int `json:"skipped"`
+	History int `json:"history"`
+}
+
+// ExportBundle copies the entries of a cache, and their history if it keeps
+// one, into a bundle. providers restricts the bundle to these provider names,
+// if set.
+func ExportBundle(ctx context.Context, c Cache, providers []string) (*Bundle, error) {
+	include := providerFilter(providers)
+
+	entries, err := c.Entries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	bundle := &Bundle{Version: BundleVersion, ExportedAt: time.Now().UTC(), Entries: []CacheEntry{}}
+	for _, entry := range entries {
+		if include(entry.Provider) {
+			bundle.Entries = append(bundle.Entries, entry)
+		}
+	}
+	sort.Slice(bundle.Entries, func(i, j int) bool {
+		return bundle.Entries[i].Provider < bundle.Entries[j].Provider
+	})
+
+	history, ok := c.(History)
+	if !ok {
+		return bundle, nil
+	}
+	snapshots, err := history.Snapshots(ctx, "", time.Time{}, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	sightings, err := history.Sightings(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	byProvider := make(map[string]*ProviderHistory)
+	historyOf := func(provider string) *ProviderHistory {
+		if byProvider[provider] == nil {
+			byProvider[provider] = &ProviderHistory{Provider: provider}
+		}
+		return byProvider[provider]
+	}
+	for _, snapshot := range snapshots {
+		if include(snapshot.Provider) {
+			h := historyOf(snapshot.Provider)
+			h.Snapshots = append(h.Snapshots, snapshot)
+		}
+	}
+	for _, sighting := range sightings {
+		if include(sighting.Provider) {
+			h := historyOf(sighting.Provider)
+			h.Sightings = append(h.Sightings, sighting)
+		}
+	}
+	for _, h := range byProvider {
+		bundle.History = append(bundle.History, *h)
+	}
+	sort.Slice(bundle.History, func(i, j int) bool {
+		return bundle.History[i].Provider < bundle.History[j].Provider
+	})
+	return bundle, nil
+}
+
+// ImportBundle imports the entries and history of a bundle into a cache. The
+// history is skipped if the cache does not keep one.
+func ImportBundle(ctx context.Context, c Cache, bundle *Bundle, opts ImportOptions) (ImportSummary, error) {
+	var summary ImportSummary
+	if bundle.Version < 1 || bundle.Version > BundleVersion {
+		return summary, fmt.Errorf("unsupported bundle version %d, this build reads up to version %d", bundle.Version, BundleVersion)
+	}
+	include := providerFilter(opts.Providers)
+
+	for _, entry := range bundle.Entries {
+		if !include(entry.Provider) {
+			continue
+		}
+		if !opts.Overwrite {
+			current, found, err := c.Get(ctx, entry.Provider)
+			if err != nil {
+				return summary, err
+			}
+			if found && !entry.CreatedAt.After(current.CreatedAt) {
+				log.Printf("Keeping cached regions of provider %s, newer than the bundle's", entry.Provider)
+				summary.Skipped++
+				continue
+			}
+		}
+		if err := c.Put(ctx, entry); err != nil {
+			return summary, err
+		}
+		summary.Entries++
+	}
+
+	if len(bundle.History) == 0 {
+		return summary, nil
+	}
+	history, ok := c.(History)
+	importer, canImport := c.(HistoryImporter)
+	if !ok || !canImport {
+		log.Printf("The %s cache backend does not keep history, skipping the history of the bundle", CacheBackend())
+		return summary, nil
+	}
+	for _, h := range bundle.History {
+		if !include(h.Provider) {
+			continue
+		}
+		snapshots, sightings := h.Snapshots, h.Sightings
+		if !opts.Overwrite {
+			current, err := history.Snapshots(ctx, h.Provider, time.Time{}, time.Now())
+			if err != nil {
+				return summary, err
+			}
+			currentSightings, err := history.Sightings(ctx, h.Provider)
+			if err != nil {
+				return summary, err
+			}
+			snapshots = mergeSnapshots(current, snapshots)
+			sightings = mergeSightings(currentSightings, sightings)
+		}
+		if err := importer.ReplaceHistory(ctx, h.Provider, snapshots, sightings); err != nil {
+			return summary, err
+		}
+		summary.History++
+	}
+	return summary, nil
+}
+
+// providerFilter reports whether a provider name is one of providers, or
+// accepts every name if providers is empty.
+func providerFilter(providers []string) func(string) bool {
+	if len(providers) == 0 {
+		return func(string) bool { return true }
+	}
+	names := make(map[string]bool, len(providers))
+	for _, provider := range providers {
+		names[provider] = true
+	}
+	return func(provider string) bool { return names[provider] }
+}
+
+// mergeSnapshots combines two histories of a provider, oldest first, joining
+// consecutive snapshots of the same regions into one.
+func mergeSnapshots(a, b []HistorySnapshot) []HistorySnapshot {
+	all := append(append([]HistorySnapshot(nil), a...), b...)
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].FirstSeenAt.Before(all[j].FirstSeenAt)
+	})
+
+	var merged []HistorySnapshot
+	for _, snapshot := range all {
+		if n := len(merged); n > 0 && merged[n-1].RegionsHash == snapshot.RegionsHash {
+			if snapshot.LastSeenAt.After(merged[n-1].LastSeenAt) {
+				merged[n-1].LastSeenAt = snapshot.LastSeenAt
+			}
+			continue
+		}
+		merged = append(merged, snapshot)
+	}
+	return merged
+}
+
+// mergeSightings combines two sets of sightings of a provider, keeping the
+// earliest first and latest last seen time of each region code.
+func mergeSightings(a, b []RegionSighting) []RegionSighting {
+	byCode := make(map[sightingKey]RegionSighting)
+	for _, sighting := range append(append([]RegionSighting(nil), a...), b...) {
+		key := sightingKey{sighting.Category, sighting.Code}
+		current, ok := byCode[key]
+		if !ok {
+			byCode[key] = sighting
+			continue
+		}
+		if sighting.FirstSeenAt.Before(current.FirstSeenAt) {
+			current.FirstSeenAt = sighting.FirstSeenAt
+		}
+		if sighting.LastSeenAt.After(current.LastSeenAt) {
+			current.LastSeenAt = sighting.LastSeenAt
+		}
+		byCode[key] = current
+	}
+
+	merged := make([]RegionSighting, 0, len(byCode))
+	for _, sighting := range byCode {
+		merged = append(merged, sighting)
+	}
+	sortSightings(merged)
+	return merged
+}
@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestBundleRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	for backend, open := range openTestCaches(t) {
+		t.Run(backend, func(t *testing.T) {
+			source := newMemoryCache()
+			for _, provider := range []string{"Example Cloud", "Other Cloud"} {
+				if err := source.Put(ctx, newCacheEntry(provider, testRegions("eu-1"), CachePolicyFor(provider))); err != nil {
+					t.Fatal(err)
+				}
+				for i, regions := range []string{"eu-1", "eu-1", "eu-2"} {
+					if err := source.RecordSnapshot(ctx, provider, testRegions(regions), start.Add(time.Duration(i)*24*time.Hour)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			bundle, err := ExportBundle(ctx, source, []string{"Example Cloud"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(bundle.Entries) != 1 || len(bundle.History) != 1 || len(bundle.History[0].Snapshots) != 2 {
+				t.Fatalf("bundle = %+v, want one entry and two snapshots of Example Cloud", bundle)
+			}
+
+			// The bundle survives being written out
+			data, err := json.Marshal(bundle)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var read Bundle
+			if err := json.Unmarshal(data, &read); err != nil {
+				t.Fatal(err)
+			}
+
+			target := open()
+			newer := newCacheEntry("Example Cloud", testRegions("us-1"), CachePolicyFor("Example Cloud"))
+			newer.CreatedAt = newer.CreatedAt.Add(time.Hour)
+			if err := target.Put(ctx, newer); err != nil {
+				t.Fatal(err)
+			}
+			if err := target.(History).RecordSnapshot(ctx, "Example Cloud", testRegions("us-1"), start.Add(-24*time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+
+			// Merging keeps the newer cached entry and combines the histories
+			summary, err := ImportBundle(ctx, target, &read, ImportOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if summary.Entries != 0 || summary.Skipped != 1 || summary.History != 1 {
+				t.Errorf("merge summary = %+v, want the entry skipped and the history merged", summary)
+			}
+			snapshots, err := target.(History).Snapshots(ctx, "Example Cloud", time.Time{}, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(snapshots) != 3 || !snapshots[1].LastSeenAt.Equal(start.Add(24*time.Hour)) {
+				t.Errorf("merged snapshots = %+v, want the cached one followed by the bundle's", snapshots)
+			}
+
+			// Overwriting replaces both
+			if _, err := ImportBundle(ctx, target, &read, ImportOptions{Overwrite: true}); err != nil {
+				t.Fatal(err)
+			}
+			entry, _, err := target.Get(ctx, "Example Cloud")
+			if err != nil || entry.RegionsHash != bundle.Entries[0].RegionsHash {
+				t.Errorf("entry after overwriting = %+v, %v, want the bundle's", entry, err)
+			}
+			snapshots, err = target.(History).Snapshots(ctx, "Example Cloud", time.Time{}, time.Now())
+			if err != nil || len(snapshots) != 2 {
+				t.Errorf("snapshots after overwriting = %+v, %v, want the bundle's 2", snapshots, err)
+			}
+
+			read.Version = BundleVersion + 1
+			if _, err := ImportBundle(ctx, target, &read, ImportOptions{}); err == nil {
+				t.Error("imported a bundle of a newer version")
+			}
+		})
+	}
+}
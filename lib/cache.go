@@ -0,0 +1,332 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sb-nour/providers-endpoints/service"
+)
+
+const (
+	CacheDuration = 24 * time.Hour // Default TTL, unless CACHE_TTL is set
+)
+
+// CacheEntry is the last successfully fetched regions of a provider.
+type CacheEntry struct {
+	Provider    string          `json:"provider"`
+	RegionsHash string          `json:"regions_hash"`
+	Regions     service.Regions `json:"regions"`
+	CreatedAt   time.Time       `json:"created_at"`
+	ExpiresAt   time.Time       `json:"expires_at"`
+	// Policy is the cache policy the entry was stored with.
+	Policy service.CachePolicy `json:"policy"`
+	// Provenance describes the fetch the regions came from.
+	Provenance service.Provenance `json:"provenance"`
+}
+
+// Expired reports whether the entry is past its expiry time.
+func (e CacheEntry) Expired() bool {
+	return !time.Now().Before(e.ExpiresAt)
+}
+
+// newCacheEntry builds the entry stored for freshly fetched regions, expiring
+// after the TTL of policy.
+func newCacheEntry(provider string, regions service.Regions, policy service.CachePolicy) CacheEntry {
+	now := time.Now().UTC()
+	return CacheEntry{
+		Provider:    provider,
+		RegionsHash: hashRegions(regions),
+		Regions:     regions,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(policy.TTL),
+		Policy:      policy,
+	}
+}
+
+// Cache stores the last fetched regions of each provider, keyed by provider
+// name.
+type Cache interface {
+	// Get returns the entry of a provider whether or not it has expired, so
+	// that stale data can still stand in for a failed fetch.
+	Get(ctx context.Context, provider string) (*CacheEntry, bool, error)
+	// Put replaces the entry of a provider.
+	Put(ctx context.Context, entry CacheEntry) error
+	// Entries returns every entry, most recently created first.
+	Entries(ctx context.Context) ([]CacheEntry, error)
+	Close() error
+}
+
+// Cache backends selected with CACHE_BACKEND.
+const (
+	CacheBackendNone   = "none"
+	CacheBackendTurso  = "turso"
+	CacheBackendSQLite = "sqlite"
+	CacheBackendMemory = "memory"
+	CacheBackendFile   = "file"
+)
+
+// Default locations of the local backends, overridden with CACHE_PATH.
+const (
+	DefaultSQLitePath = "providers-cache.db"
+	DefaultFileDir    = ".cache/providers"
+)
+
+// Cache modes selected with CACHE_MODE. In blocking mode an expired entry is
+// refreshed before returning; in stale-while-revalidate mode it is returned
+// right away, marked stale, and refreshed separately as long as it is not
+// older than MaxStaleness.
+const (
+	CacheModeBlocking = "blocking"
+	CacheModeSWR      = "swr"
+)
+
+// Refresh modes selected with CACHE_REFRESH. Background refreshes run in the
+// process that served the stale data; deferred refreshes wait for
+// RefreshStale, e.g. from the /refresh endpoint on Vercel, where nothing runs
+// once the response is sent.
+const (
+	RefreshBackground = "background"
+	RefreshDeferred   = "deferred"
+)
+
+// DefaultMaxStaleness is how old cached data may be before stale-while-
+// revalidate mode stops serving it, unless CACHE_MAX_STALENESS is set.
+const DefaultMaxStaleness = 7 * 24 * time.Hour
+
+// cache is the cache opened by InitCache.
+var cache Cache
+
+// CacheBackend returns the configured cache backend. CACHE_BACKEND selects it
+// explicitly; otherwise Turso is used when TURSO_DATABASE_URL is set and
+// caching is disabled when it is not.
+func CacheBackend() string {
+	if backend := os.Getenv("CACHE_BACKEND"); backend != "" {
+		return strings.ToLower(backend)
+	}
+	if os.Getenv("TURSO_DATABASE_URL") != "" {
+		return CacheBackendTurso
+	}
+	return CacheBackendNone
+}
+
+// CacheConfigured reports whether a cache backend is configured.
+func CacheConfigured() bool {
+	return CacheBackend() != CacheBackendNone
+}
+
+// CacheMode returns the cache mode read from CACHE_MODE, blocking by default.
+func CacheMode() string {
+	if strings.ToLower(os.Getenv("CACHE_MODE")) == CacheModeSWR {
+		return CacheModeSWR
+	}
+	return CacheModeBlocking
+}
+
+// RefreshMode returns the refresh mode read from CACHE_REFRESH. It defaults
+// to deferred on Vercel and to background everywhere else.
+func RefreshMode() string {
+	switch mode := strings.ToLower(os.Getenv("CACHE_REFRESH")); mode {
+	case RefreshBackground, RefreshDeferred:
+		return mode
+	}
+	if os.Getenv("VERCEL") != "" {
+		return RefreshDeferred
+	}
+	return RefreshBackground
+}
+
+// MaxStaleness returns how old cached data may be and still be served in
+// stale-while-revalidate mode, read from CACHE_MAX_STALENESS (e.g. "72h").
+func MaxStaleness() time.Duration {
+	if d, ok := envDuration("CACHE_MAX_STALENESS"); ok {
+		return d
+	}
+	return DefaultMaxStaleness
+}
+
+// CachePolicyFor returns the cache policy of the provider with the given name.
+// The policy it was registered with is overridden by CACHE_TTL_<ID>,
+// CACHE_MAX_STALE_<ID> and CACHE_REFRESH_POLICY_<ID>, where <ID> is the
+// upper-cased provider ID (e.g. CACHE_TTL_AWS=168h). Fields still unset come
+// from CACHE_TTL, CACHE_MAX_STALENESS and CACHE_MODE.
+func CachePolicyFor(providerName string) service.CachePolicy {
+	var policy service.CachePolicy
+	if p, ok := registeredProvider(providerName); ok {
+		policy = service.ProviderCachePolicy(p.ID())
+
+		key := strings.ToUpper(strings.ReplaceAll(p.ID(), "-", "_"))
+		if d, ok := envDuration("CACHE_TTL_" + key); ok {
+			policy.TTL = d
+		}
+		if d, ok := envDuration("CACHE_MAX_STALE_" + key); ok {
+			policy.MaxStale = d
+		}
+		if refresh, ok := refreshPolicy(os.Getenv("CACHE_REFRESH_POLICY_" + key)); ok {
+			policy.Refresh = refresh
+		}
+	}
+
+	if policy.TTL == 0 {
+		policy.TTL = CacheDuration
+		if d, ok := envDuration("CACHE_TTL"); ok {
+			policy.TTL = d
+		}
+	}
+	if policy.MaxStale == 0 {
+		policy.MaxStale = MaxStaleness()
+	}
+	if policy.Refresh == "" {
+		policy.Refresh = service.RefreshOnExpiry
+		if CacheMode() == CacheModeSWR {
+			policy.Refresh = service.RefreshSWR
+		}
+	}
+	return policy
+}
+
+// refreshPolicy validates a refresh policy read from the environment.
+func refreshPolicy(value string) (string, bool) {
+	switch value = strings.ToLower(value); value {
+	case service.RefreshOnExpiry, service.RefreshSWR, service.RefreshScheduled:
+		return value, true
+	}
+	return "", false
+}
+
+// envDuration reads a positive duration such as "6h" from the environment.
+func envDuration(name string) (time.Duration, bool) {
+	if value := os.Getenv(name); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+// envInt reads a positive integer from the environment.
+func envInt(name string) (int, bool) {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+		return n, true
+	}
+	return 0, false
+}
+
+// registeredProvider returns the registered provider with the given name.
+func registeredProvider(providerName string) (service.Provider, bool) {
+	for _, p := range service.AllProviders() {
+		if p.Name() == providerName {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// cachePath returns CACHE_PATH, or fallback if it is not set.
+func cachePath(fallback string) string {
+	if path := os.Getenv("CACHE_PATH"); path != "" {
+		return path
+	}
+	return fallback
+}
+
+// OpenCache opens the configured cache backend, applying the pending schema
+// migrations of the SQL backends.
+func OpenCache() (Cache, error) {
+	return openCache(true)
+}
+
+// OpenCacheUnmigrated opens the configured cache backend without applying
+// pending schema migrations, to inspect or apply them explicitly.
+func OpenCacheUnmigrated() (Cache, error) {
+	return openCache(false)
+}
+
+func openCache(migrate bool) (Cache, error) {
+	// Each backend returns its own pointer type, which must not end up as a
+	// non-nil Cache holding a nil pointer on error
+	var c Cache
+	var err error
+	switch backend := CacheBackend(); backend {
+	case CacheBackendTurso:
+		c, err = openTursoCache(migrate)
+	case CacheBackendSQLite:
+		path := cachePath(DefaultSQLitePath)
+		log.Printf("Using SQLite cache: %s", path)
+		c, err = openSQLCache("sqlite", path, migrate)
+	case CacheBackendMemory:
+		c = sharedMemoryCache
+	case CacheBackendFile:
+		dir := cachePath(DefaultFileDir)
+		log.Printf("Using file cache: %s", dir)
+		c, err = openFileCache(dir)
+	case CacheBackendNone:
+		return nil, fmt.Errorf("no cache backend configured")
+	default:
+		return nil, fmt.Errorf("unknown cache backend: %s", backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// InitCache opens the configured cache backend unless a cache is already
+// open.
+func InitCache() error {
+	if cache != nil {
+		return nil
+	}
+	c, err := OpenCache()
+	if err != nil {
+		return err
+	}
+	cache = c
+	return nil
+}
+
+// CloseCache closes the cache opened by InitCache.
+func CloseCache() error {
+	if cache == nil {
+		return nil
+	}
+	waitForDeliveries()
+	err := cache.Close()
+	cache = nil
+	return err
+}
+
+func hashRegions(regions service.Regions) string {
+	regionsJSON, _ := json.Marshal(regions)
+	hash := sha256.Sum256(regionsJSON)
+	return hex.EncodeToString(hash[:])
+}
+
+// hashLegacyRegions hashes the legacy form of regions, as entries were hashed
+// before regions were structured.
+func hashLegacyRegions(providerName string, regions service.Regions) string {
+	regionsJSON, _ := json.Marshal(legacyRegions(providerName, regions))
+	hash := sha256.Sum256(regionsJSON)
+	return hex.EncodeToString(hash[:])
+}
+
+// regionsChanged reports whether regions differ from those of a cache entry.
+// Entries cached before regions were structured hold the hash of their legacy
+// form, and are compared in that form so that upgrading does not report every
+// provider as changed.
+func regionsChanged(entry *CacheEntry, regions service.Regions) bool {
+	if entry.RegionsHash == hashRegions(regions) {
+		return false
+	}
+	if entry.RegionsHash == hashLegacyRegions(entry.Provider, entry.Regions) {
+		return entry.RegionsHash != hashLegacyRegions(entry.Provider, regions)
+	}
+	return true
+}
@@ -0,0 +1,374 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sb-nour/providers-endpoints/service"
+)
+
+// openTestCaches opens every local backend in a temporary directory.
+func openTestCaches(t *testing.T) map[string]func() Cache {
+	dir := t.TempDir()
+	return map[string]func() Cache{
+		CacheBackendMemory: func() Cache {
+			return newMemoryCache()
+		},
+		CacheBackendSQLite: func() Cache {
+			c, err := openSQLCache("sqlite", filepath.Join(dir, "cache.db"), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				waitForDeliveries()
+				c.Close()
+			})
+			return c
+		},
+		CacheBackendFile: func() Cache {
+			c, err := openFileCache(filepath.Join(dir, "files"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return c
+		},
+	}
+}
+
+// useTestCache makes c the cache for the rest of the test, waiting for the
+// notifications it is delivering before the previous cache is restored.
+func useTestCache(t *testing.T, c Cache) {
+	t.Helper()
+	previous := cache
+	cache = c
+	t.Cleanup(func() {
+		waitForDeliveries()
+		cache = previous
+	})
+}
+
+func testRegions(codes ...string) service.Regions {
+	regions := make(service.Regions)
+	storage := make(map[string]service.Region)
+	for _, code := range codes {
+		storage[code] = service.Region{Code: code, Name: "Region " + code}
+	}
+	regions.SetCategory(service.CategoryStorage, storage)
+	return regions
+}
+
+func TestCacheBackends(t *testing.T) {
+	ctx := context.Background()
+
+	for backend, open := range openTestCaches(t) {
+		t.Run(backend, func(t *testing.T) {
+			c := open()
+
+			if _, found, err := c.Get(ctx, "Example Cloud"); err != nil || found {
+				t.Fatalf("Get on empty cache = %v, %v", found, err)
+			}
+
+			regions := testRegions("eu-1", "us-1")
+			if err := c.Put(ctx, newCacheEntry("Example Cloud", regions, CachePolicyFor("Example Cloud"))); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Put(ctx, newCacheEntry("Other Cloud", testRegions("ap-1"), CachePolicyFor("Other Cloud"))); err != nil {
+				t.Fatal(err)
+			}
+
+			entry, found, err := c.Get(ctx, "Example Cloud")
+			if err != nil || !found {
+				t.Fatalf("Get = %v, %v", found, err)
+			}
+			if entry.RegionsHash != hashRegions(regions) || hashRegions(entry.Regions) != entry.RegionsHash {
+				t.Errorf("cached regions do not match the stored ones: %v", entry.Regions)
+			}
+			if entry.Expired() {
+				t.Errorf("new entry expired at %v", entry.ExpiresAt)
+			}
+
+			entries, err := c.Entries(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 2 || entries[0].Provider != "Other Cloud" {
+				t.Errorf("Entries = %v, want Other Cloud first of 2", entries)
+			}
+
+			// The file and SQLite backends keep their entries once reopened
+			if backend == CacheBackendMemory {
+				return
+			}
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, found, err := open().Get(ctx, "Example Cloud"); err != nil || !found {
+				t.Errorf("Get after reopening = %v, %v", found, err)
+			}
+		})
+	}
+}
+
+func TestCachedProviderFunctionFillsFailedCategories(t *testing.T) {
+	ctx := context.Background()
+
+	useTestCache(t, newMemoryCache())
+
+	cached := testRegions("eu-1")
+	if err := cache.Put(ctx, newCacheEntry("Example Cloud", cached, CachePolicyFor("Example Cloud"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// An expired entry still stands in for a failed category
+	entry, _, _ := cache.Get(ctx, "Example Cloud")
+	entry.ExpiresAt = entry.CreatedAt
+	if err := cache.Put(ctx, *entry); err != nil {
+		t.Fatal(err)
+	}
+
+	fetch := CachedProviderFunction("Example Cloud", func(context.Context) service.FetchResult {
+		var result service.FetchResult
+		result.SetError(service.CategoryStorage, context.DeadlineExceeded)
+		return result
+	})
+	result := fetch(ctx)
+
+	if got := result.Regions.Category(service.CategoryStorage); len(got) != 1 {
+		t.Errorf("storage regions = %v, want the cached ones", got)
+	}
+	if result.Err() == nil {
+		t.Error("the fetch error was dropped")
+	}
+}
+
+func TestCachedProviderFunctionStaleWhileRevalidate(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("CACHE_MODE", CacheModeSWR)
+	t.Setenv("CACHE_REFRESH", RefreshBackground)
+	t.Setenv("CACHE_MAX_STALENESS", "48h")
+
+	useTestCache(t, newMemoryCache())
+
+	// Store an entry fetched the given time ago, expired since
+	expireAfter := func(age time.Duration) {
+		entry := newCacheEntry("Example Cloud", testRegions("eu-1"), CachePolicyFor("Example Cloud"))
+		entry.CreatedAt = time.Now().Add(-age)
+		entry.ExpiresAt = entry.CreatedAt
+		if err := cache.Put(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fetches := make(chan struct{}, 2)
+	fetch := CachedProviderFunction("Example Cloud", func(context.Context) service.FetchResult {
+		fetches <- struct{}{}
+		return service.FetchResult{Regions: testRegions("eu-1", "us-1")}
+	})
+
+	expireAfter(25 * time.Hour)
+	result := fetch(ctx)
+	if !result.Stale || len(result.Regions.Category(service.CategoryStorage)) != 1 {
+		t.Fatalf("result = %+v, want the stale cached regions", result)
+	}
+	WaitForRefreshes()
+	if len(fetches) != 1 {
+		t.Fatalf("fetched %d times, want a background refresh", len(fetches))
+	}
+	if entry, _, _ := cache.Get(ctx, "Example Cloud"); entry.Expired() || len(entry.Regions.Category(service.CategoryStorage)) != 2 {
+		t.Errorf("cache entry = %+v, want the refreshed regions", entry)
+	}
+
+	// Past the maximum staleness the caller waits for fresh data
+	<-fetches
+	expireAfter(72 * time.Hour)
+	result = fetch(ctx)
+	if result.Stale || len(result.Regions.Category(service.CategoryStorage)) != 2 {
+		t.Errorf("result = %+v, want fresh regions", result)
+	}
+}
+
+func TestCachePolicyFor(t *testing.T) {
+	if got := CachePolicyFor("Amazon AWS"); got.TTL != 72*time.Hour || got.Refresh != service.RefreshOnExpiry {
+		t.Errorf("registry policy of AWS = %+v, want a 72h TTL refreshed on expiry", got)
+	}
+
+	t.Setenv("CACHE_TTL_AWS", "168h")
+	t.Setenv("CACHE_REFRESH_POLICY_AWS", "scheduled")
+	t.Setenv("CACHE_MAX_STALENESS", "96h")
+	t.Setenv("CACHE_MODE", CacheModeSWR)
+	got := CachePolicyFor("Amazon AWS")
+	want := service.CachePolicy{TTL: 168 * time.Hour, MaxStale: 96 * time.Hour, Refresh: service.RefreshScheduled}
+	if got != want {
+		t.Errorf("overridden policy of AWS = %+v, want %+v", got, want)
+	}
+
+	t.Setenv("CACHE_TTL", "12h")
+	want = service.CachePolicy{TTL: 12 * time.Hour, MaxStale: 96 * time.Hour, Refresh: service.RefreshSWR}
+	if got := CachePolicyFor("Example Cloud"); got != want {
+		t.Errorf("default policy = %+v, want %+v", got, want)
+	}
+}
+
+func TestLegacyEntryIsNotAChange(t *testing.T) {
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	var kinds []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Kind string `json:"kind"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		kinds = append(kinds, payload.Kind)
+		mu.Unlock()
+	}))
+	defer server.Close()
+	t.Setenv("NOTIFIERS", NotifierWebhook)
+	t.Setenv("NOTIFY_WEBHOOK_URL", server.URL)
+
+	// A row cached before regions were structured, hashed in that form
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyJSON := `{"storage":{"eu-1":"Frankfurt - eu-1"},"compute":{"c-1":"c-1"}}`
+	legacyHash := sha256.Sum256([]byte(legacyJSON))
+	if err := execStatements(`
+		CREATE TABLE provider_regions_cache (
+			provider TEXT PRIMARY KEY,
+			regions_hash TEXT NOT NULL,
+			regions TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL
+		)
+	`, `
+		INSERT INTO provider_regions_cache VALUES
+		('Example Cloud', '`+hex.EncodeToString(legacyHash[:])+`', '`+legacyJSON+`', '2025-03-01 12:00:00', '2025-03-02 12:00:00')
+	`)(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	c, err := openSQLCache("sqlite", path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	useTestCache(t, c)
+
+	regions := service.Regions{
+		service.CategoryStorage: {"eu-1": {Code: "eu-1", Name: "Frankfurt", City: "Frankfurt", Country: "DE"}},
+		service.CategoryCompute: {"c-1": {Code: "c-1", Name: "c-1"}},
+	}
+	fetch := func(context.Context) service.FetchResult { return service.FetchResult{Regions: regions} }
+
+	entry, found, err := cache.Get(ctx, "Example Cloud")
+	if err != nil || !found {
+		t.Fatalf("Get of the legacy entry = %v, %v", found, err)
+	}
+	refreshProvider(ctx, "Example Cloud", fetch, entry)
+	waitForDeliveries()
+	if len(kinds) != 0 {
+		t.Fatalf("sent %v for the same regions in the structured form, want nothing", kinds)
+	}
+
+	// Once cached in the structured form, changes are reported as usual
+	entry, _, _ = cache.Get(ctx, "Example Cloud")
+	regions[service.CategoryStorage]["eu-2"] = service.Region{Code: "eu-2", Name: "Paris"}
+	refreshProvider(ctx, "Example Cloud", fetch, entry)
+	waitForDeliveries()
+	if len(kinds) != 1 || kinds[0] != EventRegionsChanged {
+		t.Errorf("sent %v, want the added region reported", kinds)
+	}
+}
+
+func TestOutscaleLegacyEntryIsNotAChange(t *testing.T) {
+	// Outscale kept labels of its own in the legacy form
+	legacyJSON := `{"storage":{"eu-west-2":"Region: eu-west-2 - Subregions: eu-west-2b - Physical Zones: IN1"},"compute":{}}`
+	legacyHash := sha256.Sum256([]byte(legacyJSON))
+	var legacy service.Regions
+	if err := json.Unmarshal([]byte(legacyJSON), &legacy); err != nil {
+		t.Fatal(err)
+	}
+	entry := &CacheEntry{Provider: "Outscale", RegionsHash: hex.EncodeToString(legacyHash[:]), Regions: legacy}
+
+	regions := service.Regions{
+		service.CategoryStorage: {"eu-west-2": {Code: "eu-west-2", Name: "Europe West (France)", Zones: []service.Zone{
+			{ID: "eu-west-2a", Name: "IN2"},
+			{ID: "eu-west-2b", Name: "IN1"},
+		}}},
+		service.CategoryCompute: {},
+	}
+	if regionsChanged(entry, regions) {
+		t.Error("regionsChanged() = true for the same regions in the structured form, want false")
+	}
+}
+
+func TestOpenSQLCacheKeepsDSNParameters(t *testing.T) {
+	// The busy timeout is added to the parameters already in the DSN
+	path := filepath.Join(t.TempDir(), "cache.db")
+	c, err := openSQLCache("sqlite", path+"?_pragma=cache_size(-4000)", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var busyTimeout, cacheSize int
+	if err := c.db.QueryRow(`PRAGMA busy_timeout`).Scan(&busyTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.db.QueryRow(`PRAGMA cache_size`).Scan(&cacheSize); err != nil {
+		t.Fatal(err)
+	}
+	if busyTimeout != 5000 || cacheSize != -4000 {
+		t.Errorf("busy_timeout = %d, cache_size = %d, want 5000 and -4000", busyTimeout, cacheSize)
+	}
+
+	if dsn, err := dsnWithParam("libsql://db.turso.io?tls=1", "authToken", "secret"); err != nil || dsn != "libsql://db.turso.io?authToken=secret&tls=1" {
+		t.Errorf("dsnWithParam = %q, %v, want both parameters", dsn, err)
+	}
+}
+
+func TestWriteFileAtomicConcurrently(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "entry.json")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := writeFileAtomic(path, []byte(fmt.Sprintf(`{"writer": %d}`, i))); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var written struct{ Writer int }
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Errorf("file holds %q, want a whole write: %v", data, err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(files) != 0 {
+		t.Errorf("temporary files left behind: %v", files)
+	}
+}
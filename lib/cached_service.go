@@ -1,184 +1,304 @@
 package lib
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/sb-nour/providers-endpoints/service"
 )
 
-// CachedProviderFunction wraps a provider function with caching and notification logic
-func CachedProviderFunction(providerName string, originalFunc func() service.Regions) func() service.Regions {
-	return func() service.Regions {
+// CachedProviderFunction wraps a provider function with caching and notification logic.
+// Only complete results that pass the sanity rules are cached. When some categories fail,
+// the cached data for those categories is served in their place and the failure is
+// reported. In stale-while-revalidate mode an expired entry is served, marked stale,
+// while it is refreshed.
+func CachedProviderFunction(providerName string, originalFunc func(context.Context) service.FetchResult) func(context.Context) service.FetchResult {
+	return func(ctx context.Context) service.FetchResult {
+		if cache == nil {
+			log.Printf("Cache not initialized, fetching provider %s without caching", providerName)
+			return originalFunc(ctx)
+		}
+
 		// Try to get cached regions first
-		cachedRegions, found, err := GetCachedRegions(providerName)
+		entry, found, err := cache.Get(ctx, providerName)
 		if err != nil {
 			log.Printf("Error checking cache for provider %s: %v", providerName, err)
 		}
 
 		// If cache hit and not expired, return cached data
-		if found && cachedRegions != nil {
+		if found && !entry.Expired() {
 			log.Printf("Using cached regions for provider: %s", providerName)
-			return *cachedRegions
+			return cachedResult(entry, false)
+		}
+
+		// Serve expired data right away unless it is past the maximum staleness.
+		// Scheduled providers are only refreshed by RefreshStale.
+		policy := CachePolicyFor(providerName)
+		if found && policy.Refresh != service.RefreshOnExpiry && time.Since(entry.CreatedAt) <= policy.MaxStale {
+			log.Printf("Serving stale regions for provider %s fetched at %s", providerName, entry.CreatedAt.Format(time.RFC3339))
+			if policy.Refresh == service.RefreshSWR && RefreshMode() == RefreshBackground {
+				refreshInBackground(providerName, originalFunc, entry)
+			}
+			return cachedResult(entry, true)
 		}
 
 		// Cache miss or expired, fetch fresh data
 		log.Printf("Cache miss for provider %s, fetching fresh data", providerName)
+		if !found {
+			entry = nil
+		}
+		return refreshOnce(ctx, providerName, originalFunc, entry)
+	}
+}
 
-		var newRegions service.Regions
-		var fetchErr error
+// refreshProvider fetches fresh regions for a provider and caches them. entry is
+// the provider's current cache entry, or nil if it has none. Go through refreshOnce
+// so that concurrent refreshes of a provider are deduplicated.
+func refreshProvider(ctx context.Context, providerName string, originalFunc func(context.Context) service.FetchResult, entry *CacheEntry) service.FetchResult {
+	// Leave providers that keep failing alone until their backoff ends
+	if health, open := openCircuit(ctx, providerName); open {
+		log.Printf("Circuit open for provider %s until %s, skipping live fetch", providerName, health.RetryAt.Format(time.RFC3339))
+		return openCircuitResult(providerName, health, entry)
+	}
 
-		// Use a panic recovery mechanism since many providers use panic for errors
-		func() {
-			defer func() {
-				if r := recover(); r != nil {
-					fetchErr = fmt.Errorf("provider function panicked: %v", r)
-				}
-			}()
-			newRegions = originalFunc()
-		}()
+	result := originalFunc(ctx)
+	result.FetchedAt = time.Now().UTC()
+	for _, warning := range result.Warnings {
+		log.Printf("Warning from provider %s: %s", providerName, warning)
+	}
 
-		// Handle fetch errors
-		if fetchErr != nil {
-			log.Printf("Failed to fetch regions for provider %s: %v", providerName, fetchErr)
-			SendRegionsFetchErrorNotification(providerName, fetchErr)
+	// Handle fetch errors
+	if fetchErr := result.Err(); fetchErr != nil {
+		log.Printf("Failed to fetch regions for provider %s: %v", providerName, fetchErr)
 
-			// Return cached data if available, even if expired
-			if cachedRegions != nil {
-				log.Printf("Returning expired cached data for provider %s due to fetch error", providerName)
-				return *cachedRegions
-			}
+		// Repeats of the same error are throttled by Notify
+		recordFailure(ctx, providerName, fetchErr)
+		Notify(ctx, FetchFailed{EventInfo: newEventInfo(providerName), Error: fetchErr.Error()})
 
-			// Return empty regions if no cache available
-			return service.Regions{
-				Storage: make(map[string]string),
-				Compute: make(map[string]string),
+		// Fill the failed categories from cached data if available, even if expired
+		if entry != nil {
+			log.Printf("Using cached data for failed categories of provider %s", providerName)
+			for category := range result.Errors {
+				cached := entry.Regions.Category(category)
+				if len(cached) == 0 {
+					continue
+				}
+				result.Regions.SetCategory(category, cached)
+				result.Provenance.CachedCategories = append(result.Provenance.CachedCategories, category)
 			}
+			sort.Slice(result.Provenance.CachedCategories, func(i, j int) bool {
+				return result.Provenance.CachedCategories[i] < result.Provenance.CachedCategories[j]
+			})
 		}
 
-		// Check if regions have changed (if we have cached data)
-		if cachedRegions != nil {
-			changed, err := CheckRegionsChanged(providerName, newRegions)
-			if err != nil {
-				log.Printf("Error checking if regions changed for provider %s: %v", providerName, err)
-			} else if changed {
-				log.Printf("Regions changed for provider: %s", providerName)
-				SendRegionsChangedNotification(providerName, *cachedRegions, newRegions)
-			}
-		}
+		return result
+	}
 
-		// Cache the new regions
-		if err := CacheRegions(providerName, newRegions); err != nil {
-			log.Printf("Failed to cache regions for provider %s: %v", providerName, err)
-		}
+	// Keep results that look like a broken scraper out of the cache
+	if violations := checkSanity(providerName, result, entry); len(violations) > 0 {
+		return quarantine(ctx, providerName, result, entry, violations)
+	}
+	releaseQuarantine(ctx, providerName)
+	recordSuccess(ctx, providerName)
 
-		return newRegions
+	// Record the regions in the history, if the cache keeps one
+	if err := recordHistory(ctx, providerName, result.Regions); err != nil {
+		log.Printf("Failed to record history for provider %s: %v", providerName, err)
 	}
+
+	// Cache the new regions along with where they came from, and queue the
+	// notification of a change together with them so that it is not lost
+	newEntry := newCacheEntry(providerName, result.Regions, CachePolicyFor(providerName))
+	newEntry.Provenance = result.Provenance
+	var err error
+	if entry != nil && regionsChanged(entry, result.Regions) {
+		log.Printf("Regions changed for provider: %s", providerName)
+		err = putWithNotification(ctx, newEntry, RegionsChanged{
+			EventInfo:  newEventInfo(providerName),
+			OldRegions: entry.Regions,
+			NewRegions: result.Regions,
+			DocsURLs:   providerDocsURLs(providerName),
+		})
+	} else {
+		err = cache.Put(ctx, newEntry)
+	}
+	if err != nil {
+		log.Printf("Failed to cache regions for provider %s: %v", providerName, err)
+	}
+
+	return result
 }
 
-// GetRegionsWithCache is a cached version of GetRegions that uses Turso DB and Slack notifications
-func GetRegionsWithCache() map[string]service.Regions {
-	// Initialize Turso DB
-	if err := InitTursoDB(); err != nil {
-		log.Printf("Failed to initialize Turso DB: %v", err)
-		log.Printf("Falling back to non-cached mode")
-		return GetRegions() // Fall back to original function
-	}
-	defer func() {
-		if err := CloseTursoDB(); err != nil {
-			log.Printf("Error closing Turso DB: %v", err)
-		}
-	}()
+var (
+	// refreshing holds the names of the providers being refreshed in the background.
+	refreshing sync.Map
+	refreshes  sync.WaitGroup
+)
 
-	// Create cached versions of provider functions
-	cachedProviders := []struct {
-		name string
-		fn   func() service.Regions
-	}{
-		{"Amazon AWS", CachedProviderFunction("Amazon AWS", service.GetAmazonRegions)},
-		{"Amazon Lightsail", CachedProviderFunction("Amazon Lightsail", service.GetLightsailRegions)},
-		{"DigitalOcean", CachedProviderFunction("DigitalOcean", service.GetDigitalOceanRegions)},
-		{"UpCloud", CachedProviderFunction("UpCloud", service.GetUpcloudRegions)},
-		{"Exoscale", CachedProviderFunction("Exoscale", service.GetExoscaleRegions)},
-		{"Google Cloud", CachedProviderFunction("Google Cloud", service.GetGoogleCloudRegions)},
-		{"Backblaze", CachedProviderFunction("Backblaze", service.GetBackblazeRegions)},
-		{"Linode", CachedProviderFunction("Linode", service.GetLinodeRegions)},
-		{"Outscale", CachedProviderFunction("Outscale", service.GetOutscaleRegions)},
-		{"Storj", CachedProviderFunction("Storj", service.GetStorjRegions)},
-		{"Vultr", CachedProviderFunction("Vultr", service.GetVultrRegions)},
-		{"Hetzner", CachedProviderFunction("Hetzner", service.GetHetznerRegions)},
-		{"Synology", CachedProviderFunction("Synology", service.GetSynologyRegions)},
-	}
-
-	// Use the same concurrent execution pattern as the original GetRegions
-	workerCount := 10
-	regions := make(map[string]service.Regions)
-
-	// Create channels for communication
-	providerRegions := make(chan service.ProviderRegions, len(cachedProviders))
-	workerPool := make(chan struct{}, workerCount)
-
-	// Start goroutines for each provider
-	for _, provider := range cachedProviders {
-		workerPool <- struct{}{}
-		go func(provider struct {
-			name string
-			fn   func() service.Regions
-		}) {
-			defer func() {
-				<-workerPool
-			}()
-			providerRegions <- service.ProviderRegions{
-				Provider: provider.name,
-				Regions:  provider.fn(),
+// refreshInBackground refreshes a provider without blocking the caller. A provider is
+// refreshed at most once at a time.
+func refreshInBackground(providerName string, originalFunc func(context.Context) service.FetchResult, entry *CacheEntry) {
+	if _, running := refreshing.LoadOrStore(providerName, true); running {
+		return
+	}
+
+	refreshes.Add(1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Background refresh of provider %s panicked: %v", providerName, r)
 			}
-		}(provider)
+			refreshing.Delete(providerName)
+			refreshes.Done()
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), providerTimeout(providerName))
+		defer cancel()
+
+		log.Printf("Refreshing stale regions for provider %s in the background", providerName)
+		refreshOnce(ctx, providerName, originalFunc, entry)
+	}()
+}
+
+// WaitForRefreshes waits for the background refreshes started so far. Call it before
+// closing the cache or exiting.
+func WaitForRefreshes() {
+	refreshes.Wait()
+}
+
+// providerTimeout returns the timeout of the registered provider with the given name.
+func providerTimeout(providerName string) time.Duration {
+	if p, ok := registeredProvider(providerName); ok {
+		return service.ProviderTimeout(p.ID())
 	}
+	return service.DefaultProviderTimeout
+}
 
-	// Collect results
-	for i := 0; i < len(cachedProviders); i++ {
-		pr := <-providerRegions
-		regions[pr.Provider] = pr.Regions
+// RefreshStale refreshes every enabled provider whose cache entry is missing or
+// expired and returns their names. It is the refresh step of stale-while-revalidate
+// mode when refreshes are deferred.
+func RefreshStale(ctx context.Context) ([]string, error) {
+	if cache == nil {
+		return nil, fmt.Errorf("cache not initialized")
+	}
+
+	entries := make(map[string]*CacheEntry)
+	var stale []service.Provider
+	var names []string
+	for _, p := range service.Providers() {
+		entry, found, err := cache.Get(ctx, p.Name())
+		if err != nil {
+			log.Printf("Error checking cache for provider %s: %v", p.Name(), err)
+		}
+		if found && !entry.Expired() {
+			continue
+		}
+		if found {
+			entries[p.Name()] = entry
+		}
+		stale = append(stale, p)
+		names = append(names, p.Name())
 	}
 
-	close(providerRegions)
+	_, err := fetchProviders(ctx, stale, func(ctx context.Context, p service.Provider) service.FetchResult {
+		return refreshOnce(ctx, p.Name(), p.Fetch, entries[p.Name()])
+	})
+	return names, err
+}
 
-	return regions
+// GetRegionsWithCache is a cached version of GetRegions that uses the configured cache
+// backend and notifiers. A cache opened beforehand with InitCache is reused
+// and left open.
+func GetRegionsWithCache(ctx context.Context) (map[string]service.Regions, error) {
+	results, err := GetResultsWithCache(ctx)
+	return Regions(results), err
+}
+
+// GetResultsWithCache is GetRegionsWithCache returning the full result of each
+// provider, with the provenance of its regions.
+func GetResultsWithCache(ctx context.Context) (map[string]service.FetchResult, error) {
+	if cache == nil {
+		if err := InitCache(); err != nil {
+			log.Printf("Failed to initialize cache: %v", err)
+			log.Printf("Falling back to non-cached mode")
+			return GetResults(ctx) // Fall back to original function
+		}
+		defer func() {
+			WaitForRefreshes()
+			if err := CloseCache(); err != nil {
+				log.Printf("Error closing cache: %v", err)
+			}
+		}()
+	}
+
+	// Every enabled provider goes through the cache, using the same worker pool as GetRegions
+	return fetchProviders(ctx, service.Providers(), func(ctx context.Context, p service.Provider) service.FetchResult {
+		return CachedProviderFunction(p.Name(), p.Fetch)(ctx)
+	})
 }
 
 // LogCacheStats logs cache statistics for debugging
 func LogCacheStats() {
-	if db == nil {
-		log.Printf("Database not initialized, cannot show cache stats")
+	if cache == nil {
+		log.Printf("Cache not initialized, cannot show cache stats")
 		return
 	}
 
-	query := `
-		SELECT 
-			provider,
-			created_at,
-			expires_at,
-			CASE WHEN expires_at > datetime('now') THEN 'Valid' ELSE 'Expired' END as status
-		FROM provider_regions_cache 
-		ORDER BY created_at DESC
-	`
-
-	rows, err := db.Query(query)
+	entries, err := cache.Entries(context.Background())
 	if err != nil {
 		log.Printf("Error querying cache stats: %v", err)
 		return
 	}
-	defer rows.Close()
 
 	log.Printf("=== Cache Statistics ===")
-	for rows.Next() {
-		var provider, createdAt, expiresAt, status string
-		if err := rows.Scan(&provider, &createdAt, &expiresAt, &status); err != nil {
-			log.Printf("Error scanning cache stats row: %v", err)
-			continue
+	for _, entry := range entries {
+		status := "Valid"
+		if entry.Expired() {
+			status = "Expired"
+		}
+		log.Printf("Provider: %s | Created: %s | Expires: %s | Status: %s | TTL: %s | Max stale: %s | Refresh: %s | Parser: %s | Fetch: %dms",
+			entry.Provider, entry.CreatedAt.Format(time.RFC3339), entry.ExpiresAt.Format(time.RFC3339), status,
+			entry.Policy.TTL, entry.Policy.MaxStale, entry.Policy.Refresh,
+			entry.Provenance.ParserVersion, entry.Provenance.FetchDurationMS)
+	}
+
+	healths, err := ProviderHealths(context.Background())
+	if err != nil {
+		log.Printf("Error querying provider health: %v", err)
+	}
+	now := time.Now()
+	for _, health := range healths {
+		retry := "now"
+		if !health.RetryAt.IsZero() {
+			retry = health.RetryAt.Format(time.RFC3339)
+		}
+		log.Printf("Provider: %s | Breaker: %s | Failures: %d | Retry: %s | Last error: %s",
+			health.Provider, health.State(now), health.Failures, retry, health.LastError)
+	}
+
+	if store, ok := cache.(NotificationStore); ok {
+		states, err := store.NotificationStates(context.Background())
+		if err != nil {
+			log.Printf("Error querying notification state: %v", err)
+		}
+		for _, state := range states {
+			log.Printf("Provider: %s | Notification: %s | Count: %d | Since: %s | Last sent: %s",
+				state.Provider, state.Kind, state.Count, state.FirstAt.Format(time.RFC3339), state.LastSentAt.Format(time.RFC3339))
+		}
+	}
+	if outbox, ok := cache.(Outbox); ok {
+		for _, status := range []string{OutboxPending, OutboxFailed} {
+			messages, err := outbox.OutboxNotifications(context.Background(), status)
+			if err != nil {
+				log.Printf("Error querying outbox: %v", err)
+				continue
+			}
+			log.Printf("Outbox: %d %s notifications", len(messages), status)
 		}
-		log.Printf("Provider: %s | Created: %s | Expires: %s | Status: %s",
-			provider, createdAt, expiresAt, status)
 	}
 	log.Printf("========================")
 }
@@ -0,0 +1,258 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sb-nour/providers-endpoints/service"
+)
+
+// EventDigest is the kind of the periodic summary of every provider, sent
+// whenever it is built rather than deduplicated like the events of a single
+// provider.
+const EventDigest = "digest"
+
+// Periods of a digest.
+const (
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+// DigestRange returns the range a daily or weekly digest ending at to covers.
+func DigestRange(period string, to time.Time) (time.Time, error) {
+	switch period {
+	case DigestDaily:
+		return to.Add(-24 * time.Hour), nil
+	case DigestWeekly:
+		return to.Add(-7 * 24 * time.Hour), nil
+	}
+	return time.Time{}, fmt.Errorf("unknown digest period %q, want %s or %s", period, DigestDaily, DigestWeekly)
+}
+
+// Digest summarizes what happened to every enabled provider between From and
+// To.
+type Digest struct {
+	EventInfo
+	// Period is DigestDaily, DigestWeekly or empty for a custom range.
+	Period    string           `json:"period,omitempty"`
+	From      time.Time        `json:"from"`
+	To        time.Time        `json:"to"`
+	Providers []ProviderDigest `json:"providers"`
+}
+
+func (Digest) Kind() string { return EventDigest }
+
+func (e Digest) withInfo(info EventInfo) Event {
+	e.EventInfo = info
+	return e
+}
+
+// ProviderDigest is what happened to a provider over the range of a digest,
+// and how fresh its cached regions are at the end of it.
+type ProviderDigest struct {
+	Provider string `json:"provider"`
+	// Added, Removed and Modified count the region changes over the range.
+	Added    int `json:"added"`
+	Removed  int `json:"removed"`
+	Modified int `json:"modified"`
+	// Failures counts the failed fetches over the range, notified or not,
+	// and LastError is the error of the last of them.
+	Failures          int    `json:"failures"`
+	LastError         string `json:"last_error,omitempty"`
+	SuspiciousResults int    `json:"suspicious_results"`
+	// FallbackUses counts the results served from the fallback snapshot over
+	// the range, and FallbackSince is when the provider's current fallback
+	// period started, if it is still in one.
+	FallbackUses  int        `json:"fallback_uses"`
+	FallbackSince *time.Time `json:"fallback_since,omitempty"`
+	// Breaker is the state of the provider's breaker if it is still failing.
+	Breaker string `json:"breaker,omitempty"`
+	// FetchedAt is when the cached regions were fetched, and Stale whether
+	// they are past their TTL.
+	FetchedAt *time.Time `json:"fetched_at,omitempty"`
+	Stale     bool       `json:"stale"`
+}
+
+// Changes returns the number of region changes over the range.
+func (d ProviderDigest) Changes() int {
+	return d.Added + d.Removed + d.Modified
+}
+
+// BuildDigest summarizes the region changes, failures, fallback usage and
+// freshness of every enabled provider between from and to, from the history, event
+// log and cache entries of the open cache.
+func BuildDigest(ctx context.Context, from, to time.Time) (Digest, error) {
+	if cache == nil {
+		return Digest{}, fmt.Errorf("cache not initialized")
+	}
+	digest := Digest{EventInfo: EventInfo{At: to}, From: from, To: to}
+
+	enabled := service.Providers()
+	providers := make(map[string]*ProviderDigest, len(enabled))
+	digest.Providers = make([]ProviderDigest, len(enabled))
+	for i, p := range enabled {
+		digest.Providers[i].Provider = p.Name()
+		providers[p.Name()] = &digest.Providers[i]
+	}
+
+	changes, err := RegionChanges(ctx, "", from, to)
+	if err != nil {
+		return Digest{}, fmt.Errorf("failed to list region changes: %w", err)
+	}
+	for _, change := range changes {
+		p, ok := providers[change.Provider]
+		if !ok {
+			continue
+		}
+		switch change.Kind {
+		case ChangeAdded:
+			p.Added++
+		case ChangeRemoved:
+			p.Removed++
+		case ChangeModified:
+			p.Modified++
+		}
+	}
+
+	records, err := Events(ctx, "", from, to)
+	if err != nil {
+		return Digest{}, fmt.Errorf("failed to list events: %w", err)
+	}
+	for _, record := range records {
+		p, ok := providers[record.Provider]
+		if !ok {
+			continue
+		}
+		switch record.Kind {
+		case EventFetchFailed:
+			p.Failures++
+			p.LastError = record.Summary
+		case EventSuspiciousResult:
+			p.SuspiciousResults++
+		case EventFallbackUsed:
+			p.FallbackUses++
+		}
+	}
+
+	healths, err := ProviderHealths(ctx)
+	if err != nil {
+		return Digest{}, fmt.Errorf("failed to list provider health: %w", err)
+	}
+	for _, health := range healths {
+		if p, ok := providers[health.Provider]; ok {
+			p.Breaker = health.State(to)
+		}
+	}
+
+	if tracker, ok := cache.(FallbackTracker); ok {
+		periods, err := tracker.FallbackPeriods(ctx)
+		if err != nil {
+			return Digest{}, fmt.Errorf("failed to list fallbacks: %w", err)
+		}
+		for _, period := range periods {
+			if p, ok := providers[period.Provider]; ok {
+				p.FallbackSince = &period.Since
+			}
+		}
+	}
+
+	entries, err := cache.Entries(ctx)
+	if err != nil {
+		return Digest{}, fmt.Errorf("failed to list cache entries: %w", err)
+	}
+	for _, entry := range entries {
+		if p, ok := providers[entry.Provider]; ok {
+			p.FetchedAt = &entry.CreatedAt
+			p.Stale = !to.Before(entry.ExpiresAt)
+		}
+	}
+
+	return digest, nil
+}
+
+// digestMessage lays out a digest with the totals of the range and a field
+// for every provider.
+func digestMessage(e Digest, m markup) eventMessage {
+	title := "📊 Provider Digest"
+	switch e.Period {
+	case DigestDaily:
+		title = "📊 Daily Provider Digest"
+	case DigestWeekly:
+		title = "📊 Weekly Provider Digest"
+	}
+
+	level := levelGood
+	var changed, failing, fallback, stale int
+	var fields []messageField
+	for _, p := range e.Providers {
+		if p.Changes() > 0 {
+			changed++
+		}
+		if p.Breaker != "" {
+			failing++
+		}
+		if p.FallbackSince != nil {
+			fallback++
+		}
+		if p.Stale || p.FetchedAt == nil {
+			stale++
+		}
+		switch {
+		case p.Breaker != "" || p.SuspiciousResults > 0:
+			level = levelDanger
+		case level == levelGood && (p.Changes() > 0 || p.Failures > 0 || p.FallbackUses > 0 || p.Stale):
+			level = levelWarning
+		}
+		fields = append(fields, messageField{Title: p.Provider, Value: providerDigestLines(p, e.To, m)})
+	}
+
+	text := fmt.Sprintf("%s to %s: %s changed regions, %s failing, %s served from fallback, %s stale",
+		e.From.Format("2006-01-02 15:04"), e.To.Format("2006-01-02 15:04"),
+		m.bold(fmt.Sprintf("%d", changed)), m.bold(fmt.Sprintf("%d", failing)),
+		m.bold(fmt.Sprintf("%d", fallback)), m.bold(fmt.Sprintf("%d", stale)))
+	return eventMessage{Title: title, Text: text, Level: level, Fields: fields}
+}
+
+// providerDigestLines describes a provider's part of a digest, e.g.
+// "Changes: +2 −1 ~3" and "Fetched 3 hours ago".
+func providerDigestLines(p ProviderDigest, at time.Time, m markup) string {
+	var lines []string
+	if p.Changes() > 0 {
+		lines = append(lines, fmt.Sprintf("Changes: +%d −%d ~%d", p.Added, p.Removed, p.Modified))
+	} else {
+		lines = append(lines, "No region changes")
+	}
+	if p.Failures > 0 {
+		line := fmt.Sprintf("Failed fetches: %d", p.Failures)
+		if p.Breaker != "" {
+			line += fmt.Sprintf(", still failing (breaker %s)", p.Breaker)
+		}
+		if p.LastError != "" {
+			line += ", last error: " + m.code(p.LastError)
+		}
+		lines = append(lines, line)
+	} else if p.Breaker != "" {
+		lines = append(lines, fmt.Sprintf("Still failing (breaker %s)", p.Breaker))
+	}
+	if p.SuspiciousResults > 0 {
+		lines = append(lines, fmt.Sprintf("Quarantined results: %d", p.SuspiciousResults))
+	}
+	if p.FallbackUses > 0 || p.FallbackSince != nil {
+		line := fmt.Sprintf("Served from fallback: %d times", p.FallbackUses)
+		if p.FallbackSince != nil {
+			line += fmt.Sprintf(", since %s", p.FallbackSince.Format("2006-01-02 15:04"))
+		}
+		lines = append(lines, line)
+	}
+	switch {
+	case p.FetchedAt == nil:
+		lines = append(lines, "Never fetched")
+	case p.Stale:
+		lines = append(lines, fmt.Sprintf("Stale, fetched %s ago", humanDuration(at.Sub(*p.FetchedAt))))
+	default:
+		lines = append(lines, fmt.Sprintf("Fetched %s ago", humanDuration(at.Sub(*p.FetchedAt))))
+	}
+	return strings.Join(lines, "\n")
+}
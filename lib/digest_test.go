@@ -0,0 +1,121 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDigest(t *testing.T) {
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	var kinds []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Kind string `json:"kind"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		kinds = append(kinds, payload.Kind)
+		mu.Unlock()
+	}))
+	defer server.Close()
+	t.Setenv("NOTIFIERS", NotifierWebhook)
+	t.Setenv("NOTIFY_WEBHOOK_URL", server.URL)
+
+	const provider = "Amazon AWS"
+	for backend, open := range openTestCaches(t) {
+		t.Run(backend, func(t *testing.T) {
+			useTestCache(t, open())
+			kinds = nil
+
+			to := time.Now().UTC()
+			from, err := DigestRange(DigestDaily, to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			history := cache.(History)
+			if err := history.RecordSnapshot(ctx, provider, testRegions("a", "b"), from.Add(-time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if err := history.RecordSnapshot(ctx, provider, testRegions("a", "c", "d"), from.Add(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if err := cache.Put(ctx, newCacheEntry(provider, testRegions("a", "c", "d"), CachePolicyFor(provider))); err != nil {
+				t.Fatal(err)
+			}
+
+			// Failures are counted whether or not they were notified
+			failure := func(at time.Time, err string) FetchFailed {
+				return FetchFailed{EventInfo: EventInfo{Provider: provider, At: at}, Error: err}
+			}
+			Notify(ctx, failure(from.Add(-time.Hour), "timeout after 30s"))
+			Notify(ctx, failure(from.Add(2*time.Hour), "timeout after 30s"))
+			Notify(ctx, failure(from.Add(3*time.Hour), "connection refused"))
+			recordEvent(ctx, EventRecord{Provider: provider, Kind: EventFallbackUsed, At: from.Add(4 * time.Hour)})
+			if _, err := cache.(FallbackTracker).MarkFallback(ctx, provider, from.Add(4*time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+
+			digest, err := BuildDigest(ctx, from, to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got *ProviderDigest
+			for i := range digest.Providers {
+				if digest.Providers[i].Provider == provider {
+					got = &digest.Providers[i]
+				}
+			}
+			if got == nil {
+				t.Fatalf("digest has no entry for %s: %+v", provider, digest.Providers)
+			}
+			if got.Added != 2 || got.Removed != 1 || got.Modified != 0 {
+				t.Errorf("changes = +%d -%d ~%d, want +2 -1 ~0", got.Added, got.Removed, got.Modified)
+			}
+			if got.Failures != 2 || got.LastError != "connection refused" {
+				t.Errorf("failures = %d, last error %q, want the 2 in range", got.Failures, got.LastError)
+			}
+			if got.FallbackUses != 1 || got.FallbackSince == nil {
+				t.Errorf("fallback = %d uses since %v, want 1 use and an open period", got.FallbackUses, got.FallbackSince)
+			}
+			if got.FetchedAt == nil || got.Stale {
+				t.Errorf("freshness = %v, stale %v, want a fresh entry", got.FetchedAt, got.Stale)
+			}
+
+			if lines := providerDigestLines(*got, to, markdownMarkup); !strings.Contains(lines, "Changes: +2 −1 ~0") || !strings.Contains(lines, "Failed fetches: 2") {
+				t.Errorf("digest lines = %q, want the changes and failures", lines)
+			}
+			if message := messageFor(digest, markdownMarkup); len(message.Fields) != len(digest.Providers) {
+				t.Errorf("message has %d fields, want one per provider", len(message.Fields))
+			}
+
+			// Digests are never suppressed nor logged as events
+			waitForDeliveries()
+			kinds = nil
+			Notify(ctx, digest)
+			Notify(ctx, digest)
+			waitForDeliveries()
+			if len(kinds) != 2 || kinds[0] != EventDigest {
+				t.Errorf("sent %v, want both digests", kinds)
+			}
+			records, err := Events(ctx, "", from, to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, record := range records {
+				if record.Kind == EventDigest {
+					t.Errorf("digest was logged as an event: %+v", record)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package lib
+
+import (
+	"context"
+	"time"
+)
+
+// Discord limits the length of embed field values and the number of fields
+// of an embed.
+const (
+	discordFieldLimit = 1024
+	discordMaxFields  = 25
+)
+
+type discordMessage struct {
+	Embeds []discordEmbed `json:"embeds"`
+}
+
+type discordEmbed struct {
+	Title       string         `json:"title"`
+	Description string         `json:"description"`
+	Color       int            `json:"color"`
+	Fields      []discordField `json:"fields,omitempty"`
+	Timestamp   string         `json:"timestamp"`
+}
+
+type discordField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+// discordColors are the embed colors of the message levels.
+var discordColors = map[string]int{
+	levelDanger:  0xE01E5A,
+	levelWarning: 0xECB22E,
+	levelGood:    0x2EB67D,
+}
+
+// discordNotifier posts events to a Discord channel webhook as embeds.
+type discordNotifier struct {
+	url string
+}
+
+func (n *discordNotifier) Name() string { return NotifierDiscord }
+
+func (n *discordNotifier) Notify(ctx context.Context, event Event) error {
+	message := messageFor(event, markdownMarkup)
+
+	fields := make([]discordField, 0, len(message.Fields))
+	for _, field := range message.Fields {
+		if len(fields) == discordMaxFields {
+			break
+		}
+		value := field.Value
+		if runes := []rune(value); len(runes) > discordFieldLimit {
+			value = string(runes[:discordFieldLimit-1]) + "…"
+		}
+		fields = append(fields, discordField{Name: field.Title, Value: value, Inline: field.Short})
+	}
+
+	return postJSON(ctx, n.url, discordMessage{
+		Embeds: []discordEmbed{
+			{
+				Title:       message.Title,
+				Description: message.Text,
+				Color:       discordColors[message.Level],
+				Fields:      fields,
+				Timestamp:   event.Info().At.Format(time.RFC3339),
+			},
+		},
+	})
+}
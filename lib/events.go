@@ -0,0 +1,69 @@
+package lib
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+)
+
+// EventFallbackUsed is the kind of the records of a provider served from its
+// fallback snapshot, kept in the event log without being notified.
+const EventFallbackUsed = "fallback_used"
+
+// EventRecord is an event of a provider kept in the event log, whether it was
+// notified or suppressed.
+type EventRecord struct {
+	Provider string    `json:"provider"`
+	Kind     string    `json:"kind"`
+	At       time.Time `json:"at"`
+	// Summary describes the event in a line, e.g. the error of a failed
+	// fetch.
+	Summary string `json:"summary,omitempty"`
+}
+
+// EventLog is implemented by caches that keep a log of the events of every
+// provider, which digests summarize.
+type EventLog interface {
+	// RecordEvent appends an event to the log.
+	RecordEvent(ctx context.Context, record EventRecord) error
+	// Events lists the events between from and to, oldest first. provider
+	// restricts them to a single provider.
+	Events(ctx context.Context, provider string, from, to time.Time) ([]EventRecord, error)
+}
+
+// recordEvent appends an event to the event log, if the cache keeps one.
+func recordEvent(ctx context.Context, record EventRecord) {
+	events, ok := cache.(EventLog)
+	if !ok {
+		return
+	}
+	if err := events.RecordEvent(context.WithoutCancel(ctx), record); err != nil {
+		log.Printf("Failed to record %s event of provider %s: %v", record.Kind, record.Provider, err)
+	}
+}
+
+// eventRecord returns the record of an event kept in the event log.
+func eventRecord(event Event) EventRecord {
+	info := event.Info()
+	record := EventRecord{Provider: info.Provider, Kind: event.Kind(), At: info.At}
+	switch e := event.(type) {
+	case FetchFailed:
+		record.Summary = e.Error
+	case SuspiciousResult:
+		record.Summary = strings.Join(e.Reasons, "; ")
+	case FallbackServed:
+		record.Summary = "since " + e.Since.Format(time.RFC3339)
+	}
+	return record
+}
+
+// Events lists the events kept in the event log between from and to, oldest
+// first. provider restricts them to a single provider.
+func Events(ctx context.Context, provider string, from, to time.Time) ([]EventRecord, error) {
+	events, ok := cache.(EventLog)
+	if !ok {
+		return nil, nil
+	}
+	return events.Events(ctx, provider, from, to)
+}
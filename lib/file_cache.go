@@ -0,0 +1,480 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sb-nour/providers-endpoints/service"
+)
+
+// fileCache keeps the cache as one JSON file per provider in a directory, and
+// the history, fallback period, failure record and quarantined result of each
+// provider in files of the same name under history/, fallbacks/, health/ and
+// quarantine/, its notification state under notifications/<kind>/ and its
+// event log under events/, with the notification outbox as one file per
+// message under outbox/, on top of an in-memory copy loaded when the cache is
+// opened.
+type fileCache struct {
+	*memoryCache
+	dir string
+}
+
+func openFileCache(dir string) (*fileCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	c := &fileCache{memoryCache: newMemoryCache(), dir: dir}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cache file: %w", err)
+		}
+		var entry CacheEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, fmt.Errorf("failed to parse cache file %s: %w", path, err)
+		}
+		if err := c.memoryCache.Put(context.Background(), entry); err != nil {
+			return nil, err
+		}
+	}
+
+	paths, err = filepath.Glob(filepath.Join(dir, "history", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read history file: %w", err)
+		}
+		var history ProviderHistory
+		if err := json.Unmarshal(data, &history); err != nil {
+			return nil, fmt.Errorf("failed to parse history file %s: %w", path, err)
+		}
+		c.memoryCache.loadHistory(history.Provider, history.Snapshots, history.Sightings)
+	}
+
+	paths, err = filepath.Glob(filepath.Join(dir, "fallbacks", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read fallback file: %w", err)
+		}
+		var period FallbackPeriod
+		if err := json.Unmarshal(data, &period); err != nil {
+			return nil, fmt.Errorf("failed to parse fallback file %s: %w", path, err)
+		}
+		c.memoryCache.fallbacks[period.Provider] = period
+	}
+
+	paths, err = filepath.Glob(filepath.Join(dir, "health", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read health file: %w", err)
+		}
+		var health ProviderHealth
+		if err := json.Unmarshal(data, &health); err != nil {
+			return nil, fmt.Errorf("failed to parse health file %s: %w", path, err)
+		}
+		c.memoryCache.health[health.Provider] = health
+	}
+
+	paths, err = filepath.Glob(filepath.Join(dir, "quarantine", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read quarantine file: %w", err)
+		}
+		var result QuarantinedResult
+		if err := json.Unmarshal(data, &result); err != nil {
+			return nil, fmt.Errorf("failed to parse quarantine file %s: %w", path, err)
+		}
+		c.memoryCache.quarantine[result.Provider] = result
+	}
+
+	paths, err = filepath.Glob(filepath.Join(dir, "notifications", "*", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read notification state file: %w", err)
+		}
+		var state NotificationState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, fmt.Errorf("failed to parse notification state file %s: %w", path, err)
+		}
+		c.memoryCache.notified[notificationKey{state.Provider, state.Kind}] = state
+	}
+
+	paths, err = filepath.Glob(filepath.Join(dir, "events", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read event log file: %w", err)
+		}
+		var records []EventRecord
+		if err := json.Unmarshal(data, &records); err != nil {
+			return nil, fmt.Errorf("failed to parse event log file %s: %w", path, err)
+		}
+		for _, record := range records {
+			c.memoryCache.events[record.Provider] = append(c.memoryCache.events[record.Provider], record)
+		}
+	}
+
+	paths, err = filepath.Glob(filepath.Join(dir, "outbox", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read outbox file: %w", err)
+		}
+		var message OutboxMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			return nil, fmt.Errorf("failed to parse outbox file %s: %w", path, err)
+		}
+		c.memoryCache.outbox[message.ID] = message
+		c.memoryCache.outboxID = max(c.memoryCache.outboxID, message.ID)
+	}
+
+	return c, nil
+}
+
+func (c *fileCache) Put(ctx context.Context, entry CacheEntry) error {
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal regions: %w", err)
+	}
+
+	if err := writeFileAtomic(filepath.Join(c.dir, cacheFileName(entry.Provider)), data); err != nil {
+		return fmt.Errorf("failed to cache regions: %w", err)
+	}
+
+	return c.memoryCache.Put(ctx, entry)
+}
+
+func (c *fileCache) RecordSnapshot(ctx context.Context, provider string, regions service.Regions, seenAt time.Time) error {
+	if err := c.memoryCache.RecordSnapshot(ctx, provider, regions, seenAt); err != nil {
+		return err
+	}
+	return c.writeHistory(provider)
+}
+
+func (c *fileCache) ReplaceHistory(ctx context.Context, provider string, snapshots []HistorySnapshot, sightings []RegionSighting) error {
+	if err := c.memoryCache.ReplaceHistory(ctx, provider, snapshots, sightings); err != nil {
+		return err
+	}
+	return c.writeHistory(provider)
+}
+
+// writeHistory writes the history of a provider to its file.
+func (c *fileCache) writeHistory(provider string) error {
+	history := ProviderHistory{Provider: provider}
+	history.Snapshots, history.Sightings = c.memoryCache.providerHistory(provider)
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal history: %w", err)
+	}
+
+	dir := filepath.Join(c.dir, "history")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create history directory: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, cacheFileName(provider)), data); err != nil {
+		return fmt.Errorf("failed to record history: %w", err)
+	}
+	return nil
+}
+
+func (c *fileCache) MarkFallback(ctx context.Context, provider string, at time.Time) (FallbackPeriod, error) {
+	period, err := c.memoryCache.MarkFallback(ctx, provider, at)
+	if err != nil {
+		return period, err
+	}
+	return period, c.writeFallback(period)
+}
+
+func (c *fileCache) MarkFallbackAlerted(ctx context.Context, provider string, at time.Time) error {
+	if err := c.memoryCache.MarkFallbackAlerted(ctx, provider, at); err != nil {
+		return err
+	}
+
+	c.mu.RLock()
+	period, ok := c.fallbacks[provider]
+	c.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	return c.writeFallback(period)
+}
+
+func (c *fileCache) ClearFallback(ctx context.Context, provider string) error {
+	if err := c.memoryCache.ClearFallback(ctx, provider); err != nil {
+		return err
+	}
+	err := os.Remove(filepath.Join(c.dir, "fallbacks", cacheFileName(provider)))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to clear fallback: %w", err)
+	}
+	return nil
+}
+
+// writeFallback writes the fallback period of a provider to its file.
+func (c *fileCache) writeFallback(period FallbackPeriod) error {
+	data, err := json.MarshalIndent(period, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal fallback: %w", err)
+	}
+
+	dir := filepath.Join(c.dir, "fallbacks")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create fallbacks directory: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, cacheFileName(period.Provider)), data); err != nil {
+		return fmt.Errorf("failed to record fallback: %w", err)
+	}
+	return nil
+}
+
+func (c *fileCache) PutProviderHealth(ctx context.Context, health ProviderHealth) error {
+	data, err := json.MarshalIndent(health, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal provider health: %w", err)
+	}
+
+	dir := filepath.Join(c.dir, "health")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create health directory: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, cacheFileName(health.Provider)), data); err != nil {
+		return fmt.Errorf("failed to record provider health: %w", err)
+	}
+
+	return c.memoryCache.PutProviderHealth(ctx, health)
+}
+
+func (c *fileCache) DeleteProviderHealth(ctx context.Context, provider string) error {
+	err := os.Remove(filepath.Join(c.dir, "health", cacheFileName(provider)))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to clear provider health: %w", err)
+	}
+	return c.memoryCache.DeleteProviderHealth(ctx, provider)
+}
+
+func (c *fileCache) PutQuarantinedResult(ctx context.Context, result QuarantinedResult) error {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal quarantined regions: %w", err)
+	}
+
+	dir := filepath.Join(c.dir, "quarantine")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, cacheFileName(result.Provider)), data); err != nil {
+		return fmt.Errorf("failed to quarantine regions: %w", err)
+	}
+
+	return c.memoryCache.PutQuarantinedResult(ctx, result)
+}
+
+func (c *fileCache) DeleteQuarantinedResult(ctx context.Context, provider string) error {
+	err := os.Remove(filepath.Join(c.dir, "quarantine", cacheFileName(provider)))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to release quarantine: %w", err)
+	}
+	return c.memoryCache.DeleteQuarantinedResult(ctx, provider)
+}
+
+func (c *fileCache) PutNotificationState(ctx context.Context, state NotificationState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification state: %w", err)
+	}
+
+	dir := filepath.Join(c.dir, "notifications", state.Kind)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create notifications directory: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, cacheFileName(state.Provider)), data); err != nil {
+		return fmt.Errorf("failed to record notification state: %w", err)
+	}
+
+	return c.memoryCache.PutNotificationState(ctx, state)
+}
+
+func (c *fileCache) DeleteNotificationState(ctx context.Context, provider, kind string) error {
+	err := os.Remove(filepath.Join(c.dir, "notifications", kind, cacheFileName(provider)))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to clear notification state: %w", err)
+	}
+	return c.memoryCache.DeleteNotificationState(ctx, provider, kind)
+}
+
+func (c *fileCache) RecordEvent(ctx context.Context, record EventRecord) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	records := append(c.events[record.Provider], record)
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal event log: %w", err)
+	}
+
+	dir := filepath.Join(c.dir, "events")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create events directory: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, cacheFileName(record.Provider)), data); err != nil {
+		return fmt.Errorf("failed to record event: %w", err)
+	}
+
+	c.events[record.Provider] = records
+	return nil
+}
+
+// EnqueueNotifications writes every message and then adds it to the
+// in-memory copy. Like the other outbox methods it holds c.mu throughout, so
+// that a message is never written by two of them at once and the copy in
+// memory is always the one last written.
+func (c *fileCache) EnqueueNotifications(ctx context.Context, messages []OutboxMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, message := range messages {
+		message.ID = c.outboxID + 1
+		if err := c.writeOutboxMessage(message); err != nil {
+			return err
+		}
+		c.outboxID = message.ID
+		c.outbox[message.ID] = message
+	}
+	return nil
+}
+
+func (c *fileCache) PutWithNotifications(ctx context.Context, entry CacheEntry, messages []OutboxMessage) error {
+	if err := c.Put(ctx, entry); err != nil {
+		return err
+	}
+	return c.EnqueueNotifications(ctx, messages)
+}
+
+func (c *fileCache) ClaimNotifications(ctx context.Context, at time.Time, lease time.Duration, limit int) ([]OutboxMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	claimed := c.dueNotifications(at, limit)
+	for i := range claimed {
+		claimed[i].NextAttemptAt = at.Add(lease)
+		if err := c.writeOutboxMessage(claimed[i]); err != nil {
+			return nil, err
+		}
+		c.outbox[claimed[i].ID] = claimed[i]
+	}
+	return claimed, nil
+}
+
+func (c *fileCache) UpdateNotification(ctx context.Context, message OutboxMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.outbox[message.ID]; !ok {
+		return nil
+	}
+	if err := c.writeOutboxMessage(message); err != nil {
+		return err
+	}
+	c.outbox[message.ID] = message
+	return nil
+}
+
+func (c *fileCache) writeOutboxMessage(message OutboxMessage) error {
+	data, err := json.MarshalIndent(message, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+
+	dir := filepath.Join(c.dir, "outbox")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create outbox directory: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, fmt.Sprintf("%d.json", message.ID)), data); err != nil {
+		return fmt.Errorf("failed to queue notification: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes to a temporary file first so a crash never leaves
+// half a file behind.
+func writeFileAtomic(path string, data []byte) error {
+	// Every write gets its own temporary file, so that concurrent writes of
+	// the same file never rename each other's
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if err := writeTemp(tmp, data); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// writeTemp writes data to a temporary file, syncs and closes it.
+func writeTemp(tmp *os.File, data []byte) error {
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	return tmp.Close()
+}
+
+// cacheFileUnsafe matches the characters of a provider name that are replaced
+// in its file name.
+var cacheFileUnsafe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// cacheFileName returns the file name of a provider's entry, e.g.
+// "amazon-aws.json" for "Amazon AWS".
+func cacheFileName(provider string) string {
+	return strings.Trim(cacheFileUnsafe.ReplaceAllString(strings.ToLower(provider), "-"), "-") + ".json"
+}
@@ -0,0 +1,272 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sb-nour/providers-endpoints/service"
+)
+
+// HistorySnapshot is a distinct set of regions of a provider, with the period
+// during which fetches kept returning it.
+type HistorySnapshot struct {
+	Provider    string          `json:"provider"`
+	RegionsHash string          `json:"regions_hash"`
+	Regions     service.Regions `json:"regions"`
+	FirstSeenAt time.Time       `json:"first_seen_at"`
+	LastSeenAt  time.Time       `json:"last_seen_at"`
+}
+
+// RegionSighting is the first and last time a region code of a provider was
+// fetched.
+type RegionSighting struct {
+	Provider    string           `json:"provider"`
+	Category    service.Category `json:"category"`
+	Code        string           `json:"code"`
+	FirstSeenAt time.Time        `json:"first_seen_at"`
+	LastSeenAt  time.Time        `json:"last_seen_at"`
+}
+
+// History is implemented by caches that keep every distinct snapshot of the
+// regions of a provider next to the latest one.
+type History interface {
+	// RecordSnapshot records the regions fetched at seenAt. A snapshot equal
+	// to the provider's latest one only moves its last seen time.
+	RecordSnapshot(ctx context.Context, provider string, regions service.Regions, seenAt time.Time) error
+	// SnapshotAt returns the snapshot of a provider that was current at the
+	// given time.
+	SnapshotAt(ctx context.Context, provider string, at time.Time) (*HistorySnapshot, bool, error)
+	// Snapshots returns the snapshots first seen between from and to
+	// inclusive, oldest first, for every provider when provider is empty.
+	Snapshots(ctx context.Context, provider string, from, to time.Time) ([]HistorySnapshot, error)
+	// Sightings returns the region sightings of a provider, or of every
+	// provider when provider is empty, sorted by provider, category and code.
+	Sightings(ctx context.Context, provider string) ([]RegionSighting, error)
+}
+
+// ProviderHistory is the whole history of a provider, as kept in the history
+// files of the file backend and in bundles.
+type ProviderHistory struct {
+	Provider  string            `json:"provider"`
+	Snapshots []HistorySnapshot `json:"snapshots"`
+	Sightings []RegionSighting  `json:"sightings"`
+}
+
+// HistoryImporter is implemented by histories that can be replaced as a
+// whole, as when importing a bundle.
+type HistoryImporter interface {
+	// ReplaceHistory replaces the snapshots and sightings of a provider.
+	ReplaceHistory(ctx context.Context, provider string, snapshots []HistorySnapshot, sightings []RegionSighting) error
+}
+
+// Kinds of RegionChange.
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified"
+)
+
+// RegionChange is a region that was added, removed or modified between two
+// consecutive snapshots of a provider.
+type RegionChange struct {
+	Provider string           `json:"provider"`
+	Category service.Category `json:"category"`
+	Code     string           `json:"code"`
+	Kind     string           `json:"kind"`
+	At       time.Time        `json:"at"`
+	Old      *service.Region  `json:"old,omitempty"`
+	New      *service.Region  `json:"new,omitempty"`
+}
+
+// openHistory returns the history of the open cache.
+func openHistory() (History, error) {
+	if cache == nil {
+		return nil, fmt.Errorf("cache not initialized")
+	}
+	history, ok := cache.(History)
+	if !ok {
+		return nil, fmt.Errorf("the %s cache backend does not keep history", CacheBackend())
+	}
+	return history, nil
+}
+
+// recordHistory adds freshly fetched regions to the history of the open cache,
+// if it keeps one.
+func recordHistory(ctx context.Context, provider string, regions service.Regions) error {
+	history, ok := cache.(History)
+	if !ok {
+		return nil
+	}
+	return history.RecordSnapshot(ctx, provider, regions, time.Now().UTC())
+}
+
+// historyProviders returns provider as a list, or the name of every
+// registered provider when it is empty.
+func historyProviders(provider string) []string {
+	if provider != "" {
+		return []string{provider}
+	}
+	var names []string
+	for _, p := range service.AllProviders() {
+		names = append(names, p.Name())
+	}
+	return names
+}
+
+// RegionsAt returns the snapshot of each provider that was current at the
+// given time, keyed by provider name. Providers without history at that time
+// are left out. provider restricts the result to a single provider.
+func RegionsAt(ctx context.Context, provider string, at time.Time) (map[string]HistorySnapshot, error) {
+	history, err := openHistory()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make(map[string]HistorySnapshot)
+	for _, name := range historyProviders(provider) {
+		snapshot, found, err := history.SnapshotAt(ctx, name, at)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if found {
+			snapshots[name] = *snapshot
+		}
+	}
+	return snapshots, nil
+}
+
+// RegionChanges lists the region changes between from and to, oldest first.
+// The regions of the first snapshot of a provider are reported as added.
+// provider restricts the result to a single provider and a zero to means now.
+func RegionChanges(ctx context.Context, provider string, from, to time.Time) ([]RegionChange, error) {
+	history, err := openHistory()
+	if err != nil {
+		return nil, err
+	}
+	if to.IsZero() {
+		to = time.Now().UTC()
+	}
+
+	snapshots, err := history.Snapshots(ctx, provider, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each provider is compared with the snapshot current just before from
+	previous := make(map[string]service.Regions)
+	changes := []RegionChange{}
+	for _, snapshot := range snapshots {
+		before, seen := previous[snapshot.Provider]
+		if !seen {
+			baseline, found, err := history.SnapshotAt(ctx, snapshot.Provider, from.Add(-time.Nanosecond))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", snapshot.Provider, err)
+			}
+			if found {
+				before = baseline.Regions
+			}
+		}
+		changes = append(changes, diffRegions(snapshot.Provider, before, snapshot.Regions, snapshot.FirstSeenAt)...)
+		previous[snapshot.Provider] = snapshot.Regions
+	}
+	return changes, nil
+}
+
+// RegionSightings returns the first and last time each region code was seen.
+// provider restricts the result to a single provider.
+func RegionSightings(ctx context.Context, provider string) ([]RegionSighting, error) {
+	history, err := openHistory()
+	if err != nil {
+		return nil, err
+	}
+	return history.Sightings(ctx, provider)
+}
+
+// diffRegions lists the regions added, removed or modified from oldRegions to
+// newRegions, sorted by category and code.
+func diffRegions(provider string, oldRegions, newRegions service.Regions, at time.Time) []RegionChange {
+	var changes []RegionChange
+	for _, category := range changedCategories(oldRegions, newRegions) {
+		oldCategory, newCategory := oldRegions.Category(category), newRegions.Category(category)
+
+		codes := make(map[string]bool)
+		for code := range oldCategory {
+			codes[code] = true
+		}
+		for code := range newCategory {
+			codes[code] = true
+		}
+		sorted := make([]string, 0, len(codes))
+		for code := range codes {
+			sorted = append(sorted, code)
+		}
+		sort.Strings(sorted)
+
+		for _, code := range sorted {
+			change := RegionChange{Provider: provider, Category: category, Code: code, At: at}
+			oldRegion, hadOld := oldCategory[code]
+			newRegion, hasNew := newCategory[code]
+			switch {
+			case !hadOld:
+				change.Kind, change.New = ChangeAdded, &newRegion
+			case !hasNew:
+				change.Kind, change.Old = ChangeRemoved, &oldRegion
+			case !sameRegion(oldRegion, newRegion):
+				change.Kind, change.Old, change.New = ChangeModified, &oldRegion, &newRegion
+			default:
+				continue
+			}
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+func sameRegion(a, b service.Region) bool {
+	aJSON, _ := json.Marshal(a)
+	bJSON, _ := json.Marshal(b)
+	return bytes.Equal(aJSON, bJSON)
+}
+
+// updateSightings merges the regions seen at seenAt into sightings, keyed by
+// category and code.
+func updateSightings(sightings map[sightingKey]RegionSighting, provider string, regions service.Regions, seenAt time.Time) {
+	for _, category := range regions.Categories() {
+		for code := range regions.Category(category) {
+			key := sightingKey{category, code}
+			sighting, ok := sightings[key]
+			if !ok {
+				sighting = RegionSighting{Provider: provider, Category: category, Code: code, FirstSeenAt: seenAt}
+			}
+			if seenAt.Before(sighting.FirstSeenAt) {
+				sighting.FirstSeenAt = seenAt
+			}
+			if seenAt.After(sighting.LastSeenAt) {
+				sighting.LastSeenAt = seenAt
+			}
+			sightings[key] = sighting
+		}
+	}
+}
+
+type sightingKey struct {
+	category service.Category
+	code     string
+}
+
+// ParseTime parses a time given on the command line or in a query string,
+// either in RFC 3339 or as a date, which means midnight UTC.
+func ParseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, use RFC 3339 or YYYY-MM-DD", value)
+	}
+	return t, nil
+}
@@ -0,0 +1,145 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sb-nour/providers-endpoints/service"
+)
+
+func TestHistoryBackends(t *testing.T) {
+	ctx := context.Background()
+	day := func(d int) time.Time {
+		return time.Date(2025, time.March, d, 12, 0, 0, 0, time.UTC)
+	}
+
+	for backend, open := range openTestCaches(t) {
+		t.Run(backend, func(t *testing.T) {
+			useTestCache(t, open())
+			history := cache.(History)
+
+			for _, record := range []struct {
+				day   int
+				codes []string
+			}{
+				{1, []string{"eu-1"}},
+				{2, []string{"eu-1"}},
+				{5, []string{"eu-1", "us-1"}},
+				{9, []string{"us-1"}},
+			} {
+				if err := history.RecordSnapshot(ctx, "Example Cloud", testRegions(record.codes...), day(record.day)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			snapshots, err := RegionsAt(ctx, "Example Cloud", day(3))
+			if err != nil {
+				t.Fatal(err)
+			}
+			snapshot, ok := snapshots["Example Cloud"]
+			if !ok || !snapshot.FirstSeenAt.Equal(day(1)) || !snapshot.LastSeenAt.Equal(day(2)) {
+				t.Errorf("RegionsAt(3 March) = %+v, want the snapshot seen from 1 to 2 March", snapshot)
+			}
+			if snapshots, _ := RegionsAt(ctx, "Example Cloud", day(1).Add(-time.Hour)); len(snapshots) != 0 {
+				t.Errorf("RegionsAt before the first snapshot = %v, want none", snapshots)
+			}
+
+			changes, err := RegionChanges(ctx, "Example Cloud", day(3), day(10))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, change := range changes {
+				got = append(got, change.Kind+" "+change.Code)
+			}
+			want := []string{"added us-1", "removed eu-1"}
+			if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+				t.Errorf("RegionChanges(3-10 March) = %v, want %v", got, want)
+			}
+
+			sightings, err := RegionSightings(ctx, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sightings) != 2 || sightings[0].Code != "eu-1" ||
+				!sightings[0].FirstSeenAt.Equal(day(1)) || !sightings[0].LastSeenAt.Equal(day(5)) {
+				t.Errorf("RegionSightings = %+v, want eu-1 seen from 1 to 5 March first", sightings)
+			}
+		})
+	}
+}
+
+func TestConcurrentSnapshotsAreRecordedOnce(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "cache.db")
+	var instances []*sqlCache
+	for i := 0; i < 8; i++ {
+		c, err := openSQLCache("sqlite", path, i == 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		instances = append(instances, c)
+	}
+
+	// Instances recording the same new regions at once add a single snapshot
+	// of them
+	at := time.Now().UTC()
+	const rounds = 20
+	for round := 0; round < rounds; round++ {
+		regions := testRegions("a", fmt.Sprintf("b-%d", round))
+		var wg sync.WaitGroup
+		for i, c := range instances {
+			wg.Add(1)
+			go func(i int, c *sqlCache) {
+				defer wg.Done()
+				seenAt := at.Add(time.Duration(round)*time.Minute + time.Duration(i)*time.Millisecond)
+				if err := c.RecordSnapshot(ctx, "Example Cloud", regions, seenAt); err != nil {
+					t.Error(err)
+				}
+			}(i, c)
+		}
+		wg.Wait()
+	}
+
+	snapshots, err := instances[0].Snapshots(ctx, "Example Cloud", at.Add(-time.Hour), at.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != rounds {
+		t.Errorf("recorded %d snapshots, want %d", len(snapshots), rounds)
+	}
+}
+
+func TestFailedHistoryImportKeepsHistory(t *testing.T) {
+	ctx := context.Background()
+	c, err := openSQLCache("sqlite", filepath.Join(t.TempDir(), "cache.db"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	at := time.Date(2025, time.March, 1, 12, 0, 0, 0, time.UTC)
+	if err := c.RecordSnapshot(ctx, "Example Cloud", testRegions("a"), at); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same region sighted twice fails the import halfway
+	sighting := RegionSighting{Provider: "Example Cloud", Category: service.CategoryStorage, Code: "b", FirstSeenAt: at, LastSeenAt: at}
+	snapshots := []HistorySnapshot{{Provider: "Example Cloud", Regions: testRegions("b"), FirstSeenAt: at, LastSeenAt: at}}
+	if err := c.ReplaceHistory(ctx, "Example Cloud", snapshots, []RegionSighting{sighting, sighting}); err == nil {
+		t.Fatal("ReplaceHistory with a duplicate sighting succeeded")
+	}
+
+	kept, err := c.Snapshots(ctx, "Example Cloud", at.Add(-time.Hour), at.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 1 || kept[0].Regions.Category(service.CategoryStorage)["a"].Code != "a" {
+		t.Errorf("history after a failed import = %+v, want the previous snapshot", kept)
+	}
+}
@@ -1,61 +1,274 @@
 package lib
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/sb-nour/providers-endpoints/service"
 )
 
-var Providers = []struct {
-	name string
-	fn   func() service.Regions
-}{
-	{"Amazon AWS", service.GetAmazonRegions},
-	{"Amazon Lightsail", service.GetLightsailRegions},
-	{"DigitalOcean", service.GetDigitalOceanRegions},
-	{"UpCloud", service.GetUpcloudRegions},
-	{"Exoscale", service.GetExoscaleRegions},
-	// {"Wasabi", service.GetWasabiRegions},
-	{"Google Cloud", service.GetGoogleCloudRegions},
-	{"Backblaze", service.GetBackblazeRegions},
-	{"Linode", service.GetLinodeRegions},
-	{"Outscale", service.GetOutscaleRegions},
-	{"Storj", service.GetStorjRegions},
-	{"Vultr", service.GetVultrRegions},
-	{"Hetzner", service.GetHetznerRegions},
-	{"Synology", service.GetSynologyRegions},
-}
-
-func GetRegions() map[string]service.Regions {
+// TimeoutError is returned alongside partial results when some providers did
+// not finish before their deadline.
+type TimeoutError struct {
+	Providers []string
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timed out fetching regions for: %s", strings.Join(e.Providers, ", "))
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// StaleError is returned alongside the results when some providers were served
+// from expired cached data in stale-while-revalidate mode.
+type StaleError struct {
+	Providers []string
+}
+
+func (e *StaleError) Error() string {
+	return fmt.Sprintf("serving stale regions for: %s", strings.Join(e.Providers, ", "))
+}
+
+// FetchDeadline returns the overall deadline for fetching every provider,
+// read from FETCH_DEADLINE (e.g. "30s") with fallback as the default.
+func FetchDeadline(fallback time.Duration) time.Duration {
+	if value := os.Getenv("FETCH_DEADLINE"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			return d
+		}
+	}
+	return fallback
+}
+
+// Output formats accepted by FormatRegions.
+const (
+	FormatLegacy   = "legacy"
+	FormatDetailed = "detailed"
+)
+
+// FormatRegions shapes the regions for output. The legacy format maps region
+// codes, or zone codes for the providers whose original output listed zones,
+// to display strings, as consumers of the original output expect; the
+// detailed format keeps the structured Region fields.
+func FormatRegions(regions map[string]service.Regions, format string) (interface{}, error) {
+	switch format {
+	case "", FormatLegacy:
+		legacy := make(map[string]service.LegacyRegions, len(regions))
+		for provider, providerRegions := range regions {
+			legacy[provider] = legacyRegions(provider, providerRegions)
+		}
+		return legacy, nil
+	case FormatDetailed:
+		return regions, nil
+	}
+	return nil, fmt.Errorf("unknown output format: %s", format)
+}
+
+// legacyRegions converts the regions of the provider with the given name into
+// the legacy format.
+func legacyRegions(providerName string, regions service.Regions) service.LegacyRegions {
+	if p, ok := registeredProvider(providerName); ok {
+		return service.ProviderLegacy(p.ID(), regions)
+	}
+	return regions.Legacy()
+}
+
+// Zones collects the availability zones of every region, keyed by provider
+// name and region code. A region listed under several categories contributes
+// its zones once; providers and regions without zones are left out.
+func Zones(regions map[string]service.Regions) map[string]map[string][]service.Zone {
+	zones := make(map[string]map[string][]service.Zone)
+	for provider, providerRegions := range regions {
+		for _, category := range providerRegions.Categories() {
+			for code, region := range providerRegions.Category(category) {
+				if len(region.Zones) == 0 {
+					continue
+				}
+				if zones[provider] == nil {
+					zones[provider] = make(map[string][]service.Zone)
+				}
+				zones[provider][code] = mergeZones(zones[provider][code], region.Zones)
+			}
+		}
+	}
+	return zones
+}
+
+// mergeZones appends the zones of extra that are not already in zones.
+func mergeZones(zones, extra []service.Zone) []service.Zone {
+	seen := make(map[string]bool, len(zones))
+	for _, zone := range zones {
+		seen[zone.ID] = true
+	}
+	for _, zone := range extra {
+		if !seen[zone.ID] {
+			seen[zone.ID] = true
+			zones = append(zones, zone)
+		}
+	}
+	sort.Slice(zones, func(i, j int) bool {
+		return zones[i].ID < zones[j].ID
+	})
+	return zones
+}
+
+// GetRegions fetches the regions of every enabled provider in the registry.
+// Providers that fail for some or all categories still contribute whatever
+// they retrieved, and their errors are joined into the returned error.
+// Providers that do not finish before ctx is done, or before their own
+// timeout, are left out of the result and reported in a *TimeoutError; the
+// regions of every other provider are still returned.
+func GetRegions(ctx context.Context) (map[string]service.Regions, error) {
+	results, err := GetResults(ctx)
+	return Regions(results), err
+}
+
+// GetResults is GetRegions returning the full result of each provider, with
+// the provenance of its regions.
+func GetResults(ctx context.Context) (map[string]service.FetchResult, error) {
+	return fetchProviders(ctx, service.Providers(), func(ctx context.Context, p service.Provider) service.FetchResult {
+		return p.Fetch(ctx)
+	})
+}
+
+// Regions returns the regions of each provider's result.
+func Regions(results map[string]service.FetchResult) map[string]service.Regions {
+	regions := make(map[string]service.Regions, len(results))
+	for provider, result := range results {
+		regions[provider] = result.Regions
+	}
+	return regions
+}
+
+// Provenance returns the provenance of each provider's result.
+func Provenance(results map[string]service.FetchResult) map[string]service.Provenance {
+	provenance := make(map[string]service.Provenance, len(results))
+	for provider, result := range results {
+		provenance[provider] = result.Provenance
+	}
+	return provenance
+}
+
+// providerOutcome is the result of fetching a single provider.
+type providerOutcome struct {
+	provider string
+	result   service.FetchResult
+	err      error
+}
+
+// fetchProviders runs fetch for each provider on a bounded worker pool and
+// collects the results keyed by provider name. Each provider gets its own
+// timeout from the registry, bounded by the deadline of ctx.
+func fetchProviders(ctx context.Context, providers []service.Provider, fetch func(context.Context, service.Provider) service.FetchResult) (map[string]service.FetchResult, error) {
 	workerCount := 10
-	regions := make(map[string]service.Regions)
+	results := make(map[string]service.FetchResult)
 	var wg sync.WaitGroup
-	providerRegions := make(chan service.ProviderRegions, len(Providers))
+	outcomes := make(chan providerOutcome, len(providers))
 	workerPool := make(chan struct{}, workerCount)
 
-	for _, provider := range Providers {
-		workerPool <- struct{}{}
+	for _, provider := range providers {
+		select {
+		case workerPool <- struct{}{}:
+		case <-ctx.Done():
+			outcomes <- providerOutcome{provider: provider.Name(), err: ctx.Err()}
+			continue
+		}
+
 		wg.Add(1)
-		go func(provider struct {
-			name string
-			fn   func() service.Regions
-		}) {
+		go func(provider service.Provider) {
 			defer func() {
 				<-workerPool
 				wg.Done()
 			}()
-			providerRegions <- service.ProviderRegions{Provider: provider.name, Regions: provider.fn()}
+			outcomes <- fetchWithTimeout(ctx, provider, fetch)
 		}(provider)
 	}
 
 	go func() {
 		wg.Wait()
-		close(providerRegions)
+		close(outcomes)
 	}()
 
-	for pr := range providerRegions {
-		regions[pr.Provider] = pr.Regions
+	var timedOut, stale []string
+	var errs []error
+	for i := 0; i < len(providers); i++ {
+		outcome, ok := <-outcomes
+		if !ok {
+			break
+		}
+		switch {
+		case outcome.err == nil:
+			results[outcome.provider] = outcome.result
+			if outcome.result.Stale {
+				stale = append(stale, outcome.provider)
+			}
+			if err := outcome.result.Err(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", outcome.provider, err))
+			}
+		case errors.Is(outcome.err, context.DeadlineExceeded) || errors.Is(outcome.err, context.Canceled):
+			timedOut = append(timedOut, outcome.provider)
+		default:
+			errs = append(errs, fmt.Errorf("%s: %w", outcome.provider, outcome.err))
+		}
 	}
 
-	return regions
+	if len(timedOut) > 0 {
+		sort.Strings(timedOut)
+		errs = append(errs, &TimeoutError{Providers: timedOut})
+	}
+	if len(stale) > 0 {
+		sort.Strings(stale)
+		errs = append(errs, &StaleError{Providers: stale})
+	}
+
+	return results, errors.Join(errs...)
+}
+
+// fetchWithTimeout runs fetch for a single provider and gives up once the
+// provider's timeout expires, even if the provider does not honour ctx.
+// Categories that fail are filled from the provider's fallback snapshot, and
+// how long the provider has been served from it is tracked.
+func fetchWithTimeout(ctx context.Context, provider service.Provider, fetch func(context.Context, service.Provider) service.FetchResult) providerOutcome {
+	ctx, cancel := context.WithTimeout(ctx, service.ProviderTimeout(provider.ID()))
+	defer cancel()
+
+	done := make(chan providerOutcome, 1)
+	go func() {
+		result := service.ApplyFallback(provider, fetchRecovered(ctx, provider, fetch))
+		trackFallback(ctx, provider.Name(), result)
+		done <- providerOutcome{provider: provider.Name(), result: result}
+	}()
+
+	select {
+	case outcome := <-done:
+		return outcome
+	case <-ctx.Done():
+		return providerOutcome{provider: provider.Name(), err: ctx.Err()}
+	}
+}
+
+// fetchRecovered runs fetch for a single provider, turning a panic of its
+// scraper, such as an index out of range after the page changed, into an
+// error of every category of the provider so that the others are unaffected.
+func fetchRecovered(ctx context.Context, provider service.Provider, fetch func(context.Context, service.Provider) service.FetchResult) (result service.FetchResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Provider %s panicked: %v", provider.Name(), r)
+			err := fmt.Errorf("provider panicked: %v", r)
+			result = service.FetchResult{}
+			for _, category := range provider.Categories() {
+				result.SetError(category, err)
+			}
+		}
+	}()
+	return fetch(ctx, provider)
 }
@@ -0,0 +1,33 @@
+package lib
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/sb-nour/providers-endpoints/service"
+)
+
+func TestFetchProvidersRecoversPanics(t *testing.T) {
+	broken := service.NewProvider("broken-cloud", "Broken Cloud", []service.Category{service.CategoryStorage}, func(ctx context.Context) service.FetchResult {
+		var codes []string
+		_ = codes[3] // a scraper indexing a page that changed
+		return service.FetchResult{}
+	})
+	working := service.NewProvider("working-cloud", "Working Cloud", []service.Category{service.CategoryStorage}, func(ctx context.Context) service.FetchResult {
+		return service.FetchResult{Regions: testRegions("a")}
+	})
+
+	results, err := fetchProviders(context.Background(), []service.Provider{broken, working}, func(ctx context.Context, p service.Provider) service.FetchResult {
+		return p.Fetch(ctx)
+	})
+	if err == nil || !strings.Contains(err.Error(), "panicked") {
+		t.Errorf("err = %v, want the panic reported", err)
+	}
+	if categoryErr := results["Broken Cloud"].Errors[service.CategoryStorage]; categoryErr == nil {
+		t.Errorf("Broken Cloud errors = %v, want the panic as a storage error", results["Broken Cloud"].Errors)
+	}
+	if got := results["Working Cloud"].Regions.Category(service.CategoryStorage); len(got) != 1 {
+		t.Errorf("Working Cloud regions = %v, want them fetched", got)
+	}
+}
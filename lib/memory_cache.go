@@ -0,0 +1,536 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sb-nour/providers-endpoints/service"
+)
+
+// memoryCache keeps the cache and its history in process memory. Regions are
+// copied in and out so that callers never share maps with the cache.
+type memoryCache struct {
+	mu         sync.RWMutex
+	entries    map[string]CacheEntry
+	history    map[string][]HistorySnapshot
+	sightings  map[string]map[sightingKey]RegionSighting
+	fallbacks  map[string]FallbackPeriod
+	health     map[string]ProviderHealth
+	quarantine map[string]QuarantinedResult
+	notified   map[notificationKey]NotificationState
+	events     map[string][]EventRecord
+	outbox     map[int64]OutboxMessage
+	// outboxID is the ID of the last message added to the outbox.
+	outboxID int64
+}
+
+// notificationKey identifies the notification state of a kind of event of a
+// provider.
+type notificationKey struct {
+	provider string
+	kind     string
+}
+
+// sharedMemoryCache is the memory backend, shared by every InitCache in the
+// process so that the cache outlives a single run.
+var sharedMemoryCache = newMemoryCache()
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{
+		entries:    make(map[string]CacheEntry),
+		history:    make(map[string][]HistorySnapshot),
+		sightings:  make(map[string]map[sightingKey]RegionSighting),
+		fallbacks:  make(map[string]FallbackPeriod),
+		health:     make(map[string]ProviderHealth),
+		quarantine: make(map[string]QuarantinedResult),
+		notified:   make(map[notificationKey]NotificationState),
+		events:     make(map[string][]EventRecord),
+		outbox:     make(map[int64]OutboxMessage),
+	}
+}
+
+func (c *memoryCache) Get(ctx context.Context, provider string) (*CacheEntry, bool, error) {
+	c.mu.RLock()
+	entry, ok := c.entries[provider]
+	c.mu.RUnlock()
+	if !ok {
+		return nil, false, nil
+	}
+
+	regions, err := cloneRegions(entry.Regions)
+	if err != nil {
+		return nil, false, err
+	}
+	entry.Regions = regions
+	return &entry, true, nil
+}
+
+func (c *memoryCache) Put(ctx context.Context, entry CacheEntry) error {
+	regions, err := cloneRegions(entry.Regions)
+	if err != nil {
+		return err
+	}
+	entry.Regions = regions
+
+	c.mu.Lock()
+	c.entries[entry.Provider] = entry
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memoryCache) Entries(ctx context.Context) ([]CacheEntry, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entries := make([]CacheEntry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		regions, err := cloneRegions(entry.Regions)
+		if err != nil {
+			return nil, err
+		}
+		entry.Regions = regions
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.After(entries[j].CreatedAt)
+	})
+	return entries, nil
+}
+
+func (c *memoryCache) Close() error {
+	return nil
+}
+
+func (c *memoryCache) MarkFallback(ctx context.Context, provider string, at time.Time) (FallbackPeriod, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	period, ok := c.fallbacks[provider]
+	if !ok {
+		period = FallbackPeriod{Provider: provider, Since: at}
+		c.fallbacks[provider] = period
+	}
+	return period, nil
+}
+
+func (c *memoryCache) MarkFallbackAlerted(ctx context.Context, provider string, at time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if period, ok := c.fallbacks[provider]; ok {
+		period.AlertedAt = &at
+		c.fallbacks[provider] = period
+	}
+	return nil
+}
+
+func (c *memoryCache) ClearFallback(ctx context.Context, provider string) error {
+	c.mu.Lock()
+	delete(c.fallbacks, provider)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memoryCache) FallbackPeriods(ctx context.Context) ([]FallbackPeriod, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	periods := make([]FallbackPeriod, 0, len(c.fallbacks))
+	for _, period := range c.fallbacks {
+		periods = append(periods, period)
+	}
+	sort.Slice(periods, func(i, j int) bool { return periods[i].Provider < periods[j].Provider })
+	return periods, nil
+}
+
+func (c *memoryCache) ProviderHealth(ctx context.Context, provider string) (*ProviderHealth, bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	health, ok := c.health[provider]
+	if !ok {
+		return nil, false, nil
+	}
+	return &health, true, nil
+}
+
+func (c *memoryCache) PutProviderHealth(ctx context.Context, health ProviderHealth) error {
+	c.mu.Lock()
+	c.health[health.Provider] = health
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memoryCache) DeleteProviderHealth(ctx context.Context, provider string) error {
+	c.mu.Lock()
+	delete(c.health, provider)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memoryCache) ProviderHealths(ctx context.Context) ([]ProviderHealth, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	healths := make([]ProviderHealth, 0, len(c.health))
+	for _, health := range c.health {
+		healths = append(healths, health)
+	}
+	sort.Slice(healths, func(i, j int) bool {
+		return healths[i].Provider < healths[j].Provider
+	})
+	return healths, nil
+}
+
+func (c *memoryCache) QuarantinedResult(ctx context.Context, provider string) (*QuarantinedResult, bool, error) {
+	c.mu.RLock()
+	result, ok := c.quarantine[provider]
+	c.mu.RUnlock()
+	if !ok {
+		return nil, false, nil
+	}
+	return &result, true, nil
+}
+
+func (c *memoryCache) PutQuarantinedResult(ctx context.Context, result QuarantinedResult) error {
+	regions, err := cloneRegions(result.Regions)
+	if err != nil {
+		return err
+	}
+	result.Regions = regions
+
+	c.mu.Lock()
+	c.quarantine[result.Provider] = result
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memoryCache) DeleteQuarantinedResult(ctx context.Context, provider string) error {
+	c.mu.Lock()
+	delete(c.quarantine, provider)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memoryCache) QuarantinedResults(ctx context.Context) ([]QuarantinedResult, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	results := make([]QuarantinedResult, 0, len(c.quarantine))
+	for _, result := range c.quarantine {
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Provider < results[j].Provider
+	})
+	return results, nil
+}
+
+func (c *memoryCache) NotificationState(ctx context.Context, provider, kind string) (*NotificationState, bool, error) {
+	c.mu.RLock()
+	state, ok := c.notified[notificationKey{provider, kind}]
+	c.mu.RUnlock()
+	if !ok {
+		return nil, false, nil
+	}
+	return &state, true, nil
+}
+
+func (c *memoryCache) PutNotificationState(ctx context.Context, state NotificationState) error {
+	c.mu.Lock()
+	c.notified[notificationKey{state.Provider, state.Kind}] = state
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memoryCache) DeleteNotificationState(ctx context.Context, provider, kind string) error {
+	c.mu.Lock()
+	delete(c.notified, notificationKey{provider, kind})
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memoryCache) NotificationStates(ctx context.Context) ([]NotificationState, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	states := make([]NotificationState, 0, len(c.notified))
+	for _, state := range c.notified {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Provider != states[j].Provider {
+			return states[i].Provider < states[j].Provider
+		}
+		return states[i].Kind < states[j].Kind
+	})
+	return states, nil
+}
+
+func (c *memoryCache) RecordEvent(ctx context.Context, record EventRecord) error {
+	c.mu.Lock()
+	c.events[record.Provider] = append(c.events[record.Provider], record)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memoryCache) Events(ctx context.Context, provider string, from, to time.Time) ([]EventRecord, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var records []EventRecord
+	for name, events := range c.events {
+		if provider != "" && name != provider {
+			continue
+		}
+		for _, record := range events {
+			if !record.At.Before(from) && !record.At.After(to) {
+				records = append(records, record)
+			}
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].At.Before(records[j].At) })
+	return records, nil
+}
+
+func (c *memoryCache) EnqueueNotifications(ctx context.Context, messages []OutboxMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, message := range messages {
+		c.outboxID++
+		message.ID = c.outboxID
+		c.outbox[message.ID] = message
+	}
+	return nil
+}
+
+func (c *memoryCache) PutWithNotifications(ctx context.Context, entry CacheEntry, messages []OutboxMessage) error {
+	if err := c.Put(ctx, entry); err != nil {
+		return err
+	}
+	return c.EnqueueNotifications(ctx, messages)
+}
+
+func (c *memoryCache) ClaimNotifications(ctx context.Context, at time.Time, lease time.Duration, limit int) ([]OutboxMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	claimed := c.dueNotifications(at, limit)
+	for i := range claimed {
+		claimed[i].NextAttemptAt = at.Add(lease)
+		c.outbox[claimed[i].ID] = claimed[i]
+	}
+	return claimed, nil
+}
+
+// dueNotifications returns up to limit pending messages due at the given
+// time, oldest first. The caller holds c.mu.
+func (c *memoryCache) dueNotifications(at time.Time, limit int) []OutboxMessage {
+	var due []OutboxMessage
+	for _, message := range c.outbox {
+		if message.Status == OutboxPending && !message.NextAttemptAt.After(at) {
+			due = append(due, message)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].ID < due[j].ID })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due
+}
+
+func (c *memoryCache) UpdateNotification(ctx context.Context, message OutboxMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.outbox[message.ID]; ok {
+		c.outbox[message.ID] = message
+	}
+	return nil
+}
+
+func (c *memoryCache) OutboxNotifications(ctx context.Context, status string) ([]OutboxMessage, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var messages []OutboxMessage
+	for _, message := range c.outbox {
+		if status == "" || message.Status == status {
+			messages = append(messages, message)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+	return messages, nil
+}
+
+func (c *memoryCache) RecordSnapshot(ctx context.Context, provider string, regions service.Regions, seenAt time.Time) error {
+	regions, err := cloneRegions(regions)
+	if err != nil {
+		return err
+	}
+	hash := hashRegions(regions)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	snapshots := c.history[provider]
+	if n := len(snapshots); n > 0 && snapshots[n-1].RegionsHash == hash {
+		if seenAt.After(snapshots[n-1].LastSeenAt) {
+			snapshots[n-1].LastSeenAt = seenAt
+		}
+	} else {
+		c.history[provider] = append(snapshots, HistorySnapshot{
+			Provider:    provider,
+			RegionsHash: hash,
+			Regions:     regions,
+			FirstSeenAt: seenAt,
+			LastSeenAt:  seenAt,
+		})
+	}
+
+	if c.sightings[provider] == nil {
+		c.sightings[provider] = make(map[sightingKey]RegionSighting)
+	}
+	updateSightings(c.sightings[provider], provider, regions, seenAt)
+	return nil
+}
+
+func (c *memoryCache) SnapshotAt(ctx context.Context, provider string, at time.Time) (*HistorySnapshot, bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	snapshots := c.history[provider]
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if !snapshots[i].FirstSeenAt.After(at) {
+			snapshot, err := cloneSnapshot(snapshots[i])
+			if err != nil {
+				return nil, false, err
+			}
+			return &snapshot, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func (c *memoryCache) Snapshots(ctx context.Context, provider string, from, to time.Time) ([]HistorySnapshot, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var snapshots []HistorySnapshot
+	for name, history := range c.history {
+		if provider != "" && name != provider {
+			continue
+		}
+		for _, snapshot := range history {
+			if snapshot.FirstSeenAt.Before(from) || snapshot.FirstSeenAt.After(to) {
+				continue
+			}
+			snapshot, err := cloneSnapshot(snapshot)
+			if err != nil {
+				return nil, err
+			}
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].FirstSeenAt.Before(snapshots[j].FirstSeenAt)
+	})
+	return snapshots, nil
+}
+
+func (c *memoryCache) Sightings(ctx context.Context, provider string) ([]RegionSighting, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var sightings []RegionSighting
+	for name, byCode := range c.sightings {
+		if provider != "" && name != provider {
+			continue
+		}
+		for _, sighting := range byCode {
+			sightings = append(sightings, sighting)
+		}
+	}
+	sortSightings(sightings)
+	return sightings, nil
+}
+
+// sortSightings sorts sightings by provider, category and code.
+func sortSightings(sightings []RegionSighting) {
+	sort.Slice(sightings, func(i, j int) bool {
+		a, b := sightings[i], sightings[j]
+		if a.Provider != b.Provider {
+			return a.Provider < b.Provider
+		}
+		if a.Category != b.Category {
+			return a.Category < b.Category
+		}
+		return a.Code < b.Code
+	})
+}
+
+func cloneSnapshot(snapshot HistorySnapshot) (HistorySnapshot, error) {
+	regions, err := cloneRegions(snapshot.Regions)
+	if err != nil {
+		return HistorySnapshot{}, err
+	}
+	snapshot.Regions = regions
+	return snapshot, nil
+}
+
+// cloneRegions returns a deep copy of regions.
+func cloneRegions(regions service.Regions) (service.Regions, error) {
+	data, err := json.Marshal(regions)
+	if err != nil {
+		return nil, err
+	}
+	var clone service.Regions
+	if err := json.Unmarshal(data, &clone); err != nil {
+		return nil, err
+	}
+	return clone, nil
+}
+
+func (c *memoryCache) ReplaceHistory(ctx context.Context, provider string, snapshots []HistorySnapshot, sightings []RegionSighting) error {
+	cloned := make([]HistorySnapshot, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		snapshot, err := cloneSnapshot(snapshot)
+		if err != nil {
+			return err
+		}
+		cloned = append(cloned, snapshot)
+	}
+	c.loadHistory(provider, cloned, sightings)
+	return nil
+}
+
+// providerHistory returns the snapshots and sightings of a provider.
+func (c *memoryCache) providerHistory(provider string) ([]HistorySnapshot, []RegionSighting) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	snapshots := append([]HistorySnapshot(nil), c.history[provider]...)
+	var sightings []RegionSighting
+	for _, sighting := range c.sightings[provider] {
+		sightings = append(sightings, sighting)
+	}
+	sortSightings(sightings)
+	return snapshots, sightings
+}
+
+// loadHistory replaces the snapshots and sightings of a provider.
+func (c *memoryCache) loadHistory(provider string, snapshots []HistorySnapshot, sightings []RegionSighting) {
+	byCode := make(map[sightingKey]RegionSighting, len(sightings))
+	for _, sighting := range sightings {
+		byCode[sightingKey{sighting.Category, sighting.Code}] = sighting
+	}
+
+	c.mu.Lock()
+	c.history[provider] = snapshots
+	c.sightings[provider] = byCode
+	c.mu.Unlock()
+}
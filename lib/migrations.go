@@ -0,0 +1,301 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// migration is a versioned change to the schema of the SQL cache. Migrations
+// run in order of version and each is recorded in schema_migrations once
+// applied. libsql does not run DDL in transactions over HTTP, so every
+// migration must be safe to run again if it fails halfway.
+type migration struct {
+	version int
+	name    string
+	up      func(ctx context.Context, db *sql.DB) error
+}
+
+// migrations is the schema of the SQL cache. Append new migrations with the
+// next version; never edit or reorder applied ones.
+var migrations = []migration{
+	{1, "create provider_regions_cache", execStatements(`
+		CREATE TABLE IF NOT EXISTS provider_regions_cache (
+			provider TEXT PRIMARY KEY,
+			regions_hash TEXT NOT NULL,
+			regions TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL
+		)
+	`)},
+	{2, "create provider_regions_history", execStatements(`
+		CREATE TABLE IF NOT EXISTS provider_regions_history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			provider TEXT NOT NULL,
+			regions_hash TEXT NOT NULL,
+			regions TEXT NOT NULL,
+			first_seen_at DATETIME NOT NULL,
+			last_seen_at DATETIME NOT NULL
+		)
+	`, `
+		CREATE INDEX IF NOT EXISTS provider_regions_history_provider
+		ON provider_regions_history (provider, first_seen_at)
+	`)},
+	{3, "create provider_region_sightings", execStatements(`
+		CREATE TABLE IF NOT EXISTS provider_region_sightings (
+			provider TEXT NOT NULL,
+			category TEXT NOT NULL,
+			code TEXT NOT NULL,
+			first_seen_at DATETIME NOT NULL,
+			last_seen_at DATETIME NOT NULL,
+			PRIMARY KEY (provider, category, code)
+		)
+	`)},
+	{4, "add cache policy columns", addColumns("provider_regions_cache",
+		"ttl_seconds INTEGER",
+		"max_stale_seconds INTEGER",
+		"refresh_policy TEXT",
+	)},
+	{5, "create refresh_leases", execStatements(`
+		CREATE TABLE IF NOT EXISTS refresh_leases (
+			name TEXT PRIMARY KEY,
+			owner TEXT NOT NULL,
+			expires_at DATETIME NOT NULL
+		)
+	`)},
+	{6, "add provenance column", addColumns("provider_regions_cache",
+		"provenance TEXT",
+	)},
+	{7, "create provider_fallbacks", execStatements(`
+		CREATE TABLE IF NOT EXISTS provider_fallbacks (
+			provider TEXT PRIMARY KEY,
+			since DATETIME NOT NULL,
+			alerted_at DATETIME
+		)
+	`)},
+	{8, "create provider_health", execStatements(`
+		CREATE TABLE IF NOT EXISTS provider_health (
+			provider TEXT PRIMARY KEY,
+			failures INTEGER NOT NULL,
+			last_error TEXT NOT NULL,
+			first_failure_at DATETIME NOT NULL,
+			last_failure_at DATETIME NOT NULL,
+			retry_at DATETIME
+		)
+	`)},
+	{9, "create provider_quarantine", execStatements(`
+		CREATE TABLE IF NOT EXISTS provider_quarantine (
+			provider TEXT PRIMARY KEY,
+			regions_hash TEXT NOT NULL,
+			regions TEXT NOT NULL,
+			reasons TEXT NOT NULL,
+			quarantined_at DATETIME NOT NULL
+		)
+	`)},
+	{10, "create notification_state", execStatements(`
+		CREATE TABLE IF NOT EXISTS notification_state (
+			provider TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			fingerprint TEXT NOT NULL,
+			first_at DATETIME NOT NULL,
+			last_at DATETIME NOT NULL,
+			last_sent_at DATETIME,
+			count INTEGER NOT NULL,
+			PRIMARY KEY (provider, kind)
+		)
+	`)},
+	{11, "create events", execStatements(`
+		CREATE TABLE IF NOT EXISTS events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			provider TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			at DATETIME NOT NULL,
+			summary TEXT NOT NULL
+		)
+	`, `CREATE INDEX IF NOT EXISTS idx_events_at ON events(at)`)},
+	{12, "create notification_outbox", execStatements(`
+		CREATE TABLE IF NOT EXISTS notification_outbox (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			notifier TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			provider TEXT NOT NULL,
+			event TEXT NOT NULL,
+			status TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			next_attempt_at DATETIME NOT NULL,
+			delivered_at DATETIME
+		)
+	`, `CREATE INDEX IF NOT EXISTS idx_notification_outbox_due ON notification_outbox(status, next_attempt_at)`)},
+}
+
+// MigrationStatus is a migration of the cache schema and when it was applied.
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+// Migrator is implemented by caches with a versioned schema.
+type Migrator interface {
+	// MigrationStatus lists every known migration, applied or not.
+	MigrationStatus(ctx context.Context) ([]MigrationStatus, error)
+	// Migrate applies the pending migrations and returns them.
+	Migrate(ctx context.Context) ([]MigrationStatus, error)
+}
+
+func (c *sqlCache) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := c.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		status := MigrationStatus{Version: m.version, Name: m.name}
+		if at, ok := applied[m.version]; ok {
+			status.AppliedAt = &at
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func (c *sqlCache) Migrate(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := c.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var ran []MigrationStatus
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+
+		log.Printf("Applying cache migration %d: %s", m.version, m.name)
+		if err := m.up(ctx, c.db); err != nil {
+			return ran, fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+
+		// Another instance starting at the same time may record it first
+		now := time.Now().UTC()
+		_, err := c.db.ExecContext(ctx, `
+			INSERT OR IGNORE INTO schema_migrations (version, name, applied_at)
+			VALUES (?, ?, ?)
+		`, m.version, m.name, sqlTimestamp(now))
+		if err != nil {
+			return ran, fmt.Errorf("failed to record migration %d: %w", m.version, err)
+		}
+		ran = append(ran, MigrationStatus{Version: m.version, Name: m.name, AppliedAt: &now})
+	}
+	return ran, nil
+}
+
+// appliedMigrations returns when each applied migration was applied, keyed by
+// version, creating schema_migrations if needed.
+func (c *sqlCache) appliedMigrations(ctx context.Context) (map[int]time.Time, error) {
+	_, err := c.db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at DATETIME NOT NULL
+		)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	rows, err := c.db.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt sqlTime
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan schema_migrations: %w", err)
+		}
+		applied[version] = appliedAt.Time
+	}
+	return applied, rows.Err()
+}
+
+// execStatements returns a migration step running each statement in turn.
+func execStatements(statements ...string) func(context.Context, *sql.DB) error {
+	return func(ctx context.Context, db *sql.DB) error {
+		for _, statement := range statements {
+			if _, err := db.ExecContext(ctx, statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addColumns returns a migration step adding the given column definitions to
+// a table, skipping the columns it already has.
+func addColumns(table string, columns ...string) func(context.Context, *sql.DB) error {
+	return func(ctx context.Context, db *sql.DB) error {
+		existing, err := tableColumns(ctx, db, table)
+		if err != nil {
+			return err
+		}
+		for _, column := range columns {
+			var name string
+			fmt.Sscan(column, &name)
+			if existing[name] {
+				continue
+			}
+			if _, err := db.ExecContext(ctx, "ALTER TABLE "+table+" ADD COLUMN "+column); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// tableColumns returns the names of the columns of a table.
+func tableColumns(ctx context.Context, db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name FROM pragma_table_info('"+table+"')")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+// MigrationStatusOf lists the migrations of a cache, which must have a
+// versioned schema.
+func MigrationStatusOf(ctx context.Context, c Cache) ([]MigrationStatus, error) {
+	migrator, ok := c.(Migrator)
+	if !ok {
+		return nil, fmt.Errorf("the %s cache backend has no schema to migrate", CacheBackend())
+	}
+	return migrator.MigrationStatus(ctx)
+}
+
+// MigrateCache applies the pending migrations of a cache, which must have a
+// versioned schema.
+func MigrateCache(ctx context.Context, c Cache) ([]MigrationStatus, error) {
+	migrator, ok := c.(Migrator)
+	if !ok {
+		return nil, fmt.Errorf("the %s cache backend has no schema to migrate", CacheBackend())
+	}
+	return migrator.Migrate(ctx)
+}
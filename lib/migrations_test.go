@@ -0,0 +1,69 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateUpgradesLegacySchema(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "legacy.db")
+
+	// The cache table as created before migrations existed
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := execStatements(`
+		CREATE TABLE provider_regions_cache (
+			provider TEXT PRIMARY KEY,
+			regions_hash TEXT NOT NULL,
+			regions TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL
+		)
+	`, `
+		INSERT INTO provider_regions_cache VALUES
+		('Example Cloud', 'hash', '{}', '2025-03-01 12:00:00', '2025-03-02 12:00:00')
+	`)(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	c, err := openSQLCache("sqlite", path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	statuses, err := c.MigrationStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if status.AppliedAt != nil {
+			t.Errorf("migration %d applied before migrating", status.Version)
+		}
+	}
+
+	ran, err := c.Migrate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != len(migrations) {
+		t.Errorf("applied %d migrations, want %d", len(ran), len(migrations))
+	}
+	if ran, err := c.Migrate(ctx); err != nil || len(ran) != 0 {
+		t.Errorf("second Migrate = %v, %v, want nothing to apply", ran, err)
+	}
+
+	entry, found, err := c.Get(ctx, "Example Cloud")
+	if err != nil || !found {
+		t.Fatalf("Get of the legacy entry = %v, %v", found, err)
+	}
+	if entry.Policy.TTL != 0 || entry.CreatedAt.IsZero() {
+		t.Errorf("legacy entry = %+v, want a creation time and no policy", entry)
+	}
+}
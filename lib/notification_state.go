@@ -0,0 +1,179 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultNotifyCooldown is how long repeats of an event are suppressed after
+// it was sent, unless NOTIFY_COOLDOWN is set.
+const DefaultNotifyCooldown = 6 * time.Hour
+
+// NotifyCooldown returns how long repeats of an event are suppressed after it
+// was sent, read from NOTIFY_COOLDOWN.
+func NotifyCooldown() time.Duration {
+	if d, ok := envDuration("NOTIFY_COOLDOWN"); ok {
+		return d
+	}
+	return DefaultNotifyCooldown
+}
+
+// NotificationState is what was last notified of one kind of event of a
+// provider.
+type NotificationState struct {
+	Provider string `json:"provider"`
+	Kind     string `json:"kind"`
+	// Fingerprint identifies the last event, so that repeats of the same
+	// error are told apart from new ones.
+	Fingerprint string `json:"fingerprint"`
+	// FirstAt is when the events with this fingerprint started.
+	FirstAt    time.Time `json:"first_at"`
+	LastAt     time.Time `json:"last_at"`
+	LastSentAt time.Time `json:"last_sent_at"`
+	// Count is the number of events with this fingerprint, sent or not.
+	Count int `json:"count"`
+}
+
+// NotificationStore is implemented by caches that keep the notification state
+// of each provider and kind of event, so that repeated alerts are suppressed
+// across runs.
+type NotificationStore interface {
+	// NotificationState returns the state of a kind of event of a provider,
+	// if it has one.
+	NotificationState(ctx context.Context, provider, kind string) (*NotificationState, bool, error)
+	// PutNotificationState stores the state of a kind of event of a provider.
+	PutNotificationState(ctx context.Context, state NotificationState) error
+	// DeleteNotificationState removes the state of a kind of event of a
+	// provider.
+	DeleteNotificationState(ctx context.Context, provider, kind string) error
+	// NotificationStates lists every state, by provider name and kind.
+	NotificationStates(ctx context.Context) ([]NotificationState, error)
+}
+
+// throttle records an event in the notification state of its provider and
+// reports whether to send it. Repeats of the event with the same fingerprint
+// are suppressed for NOTIFY_COOLDOWN after it was sent, and then sent again
+// with a summary of how long it has been going on. A recovered event is only
+// sent if its provider's failure was, and resolves it. Digests are always
+// sent.
+func throttle(ctx context.Context, event Event) (Event, bool) {
+	store, ok := cache.(NotificationStore)
+	if !ok || event.Kind() == EventDigest {
+		return event, true
+	}
+	info := event.Info()
+
+	if event.Kind() == EventRecovered {
+		_, found, err := store.NotificationState(ctx, info.Provider, EventFetchFailed)
+		if err != nil {
+			log.Printf("Failed to check notification state of provider %s: %v", info.Provider, err)
+			return event, true
+		}
+		if found {
+			resolveNotifications(ctx, info.Provider, EventFetchFailed)
+		}
+		return event, found
+	}
+
+	fingerprint := eventFingerprint(event)
+	state, found, err := store.NotificationState(ctx, info.Provider, event.Kind())
+	if err != nil {
+		log.Printf("Failed to check notification state of provider %s: %v", info.Provider, err)
+		return event, true
+	}
+	if !found || state.Fingerprint != fingerprint {
+		state = &NotificationState{Provider: info.Provider, Kind: event.Kind(), Fingerprint: fingerprint, FirstAt: info.At}
+	}
+	state.Count++
+	state.LastAt = info.At
+
+	send := state.LastSentAt.IsZero() || info.At.Sub(state.LastSentAt) >= NotifyCooldown()
+	if send {
+		state.LastSentAt = info.At
+		if state.Count > 1 {
+			info.Repeat = &Repeat{Count: state.Count, Since: state.FirstAt}
+			event = event.withInfo(info)
+		}
+	}
+
+	if err := store.PutNotificationState(ctx, *state); err != nil {
+		log.Printf("Failed to record notification state of provider %s: %v", info.Provider, err)
+	}
+	return event, send
+}
+
+// resolveNotifications forgets the notification state of a kind of event of a
+// provider once what it reported is over, so that the next occurrence is sent
+// right away.
+func resolveNotifications(ctx context.Context, providerName, kind string) {
+	store, ok := cache.(NotificationStore)
+	if !ok {
+		return
+	}
+	if err := store.DeleteNotificationState(context.WithoutCancel(ctx), providerName, kind); err != nil {
+		log.Printf("Failed to clear notification state of provider %s: %v", providerName, err)
+	}
+}
+
+// volatileDigits matches the numbers in error messages and reasons, such as
+// durations, counts and ports, which differ between otherwise identical
+// failures.
+var volatileDigits = regexp.MustCompile(`[0-9]+`)
+
+// eventFingerprint identifies an event among repeats of the same kind of
+// event of a provider.
+func eventFingerprint(event Event) string {
+	var key string
+	switch e := event.(type) {
+	case FetchFailed:
+		key = volatileDigits.ReplaceAllString(e.Error, "#")
+	case SuspiciousResult:
+		key = volatileDigits.ReplaceAllString(strings.Join(e.Reasons, "\n"), "#")
+	case RegionsChanged:
+		key = hashRegions(e.NewRegions)
+	case FallbackServed:
+		key = e.Since.UTC().Format(time.RFC3339)
+	default:
+		key = event.Kind()
+	}
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:8])
+}
+
+// repeatSummary describes how long an event has been going on, e.g. "Failing
+// for 3 days, 14 attempts".
+func repeatSummary(kind string, repeat *Repeat, at time.Time) string {
+	since := humanDuration(at.Sub(repeat.Since))
+	switch kind {
+	case EventFetchFailed:
+		return fmt.Sprintf("Failing for %s, %d attempts", since, repeat.Count)
+	case EventSuspiciousResult:
+		return fmt.Sprintf("Suspicious for %s, %d fetches", since, repeat.Count)
+	default:
+		return fmt.Sprintf("Repeated %d times in %s", repeat.Count, since)
+	}
+}
+
+// humanDuration rounds a duration to the largest whole unit, e.g. "3 days".
+func humanDuration(d time.Duration) string {
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s", unit)
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+	switch {
+	case d >= 24*time.Hour:
+		return plural(int(d/(24*time.Hour)), "day")
+	case d >= time.Hour:
+		return plural(int(d/time.Hour), "hour")
+	default:
+		return plural(int(d/time.Minute), "minute")
+	}
+}
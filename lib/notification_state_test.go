@@ -0,0 +1,92 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNotificationThrottling(t *testing.T) {
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	var sent []webhookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Kind  string          `json:"kind"`
+			Event json.RawMessage `json:"event"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		var info EventInfo
+		if err := json.Unmarshal(payload.Event, &info); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		sent = append(sent, webhookPayload{Kind: payload.Kind, Event: FetchFailed{EventInfo: info}})
+		mu.Unlock()
+	}))
+	defer server.Close()
+	t.Setenv("NOTIFIERS", NotifierWebhook)
+	t.Setenv("NOTIFY_WEBHOOK_URL", server.URL)
+	t.Setenv("NOTIFY_COOLDOWN", "1h")
+
+	for backend, open := range openTestCaches(t) {
+		t.Run(backend, func(t *testing.T) {
+			useTestCache(t, open())
+			sent = nil
+
+			start := time.Now().UTC().Add(-3 * 24 * time.Hour)
+			failure := func(at time.Time, err string) FetchFailed {
+				return FetchFailed{EventInfo: EventInfo{Provider: "Example Cloud", At: at}, Error: err}
+			}
+
+			// The same error, bar its numbers, is only sent once per cooldown
+			Notify(ctx, failure(start, "timeout after 30s"))
+			Notify(ctx, failure(start.Add(10*time.Minute), "timeout after 31s"))
+			waitForDeliveries()
+			if len(sent) != 1 {
+				t.Fatalf("sent %d notifications, want the repeat suppressed", len(sent))
+			}
+
+			// and then summarized
+			Notify(ctx, failure(start.Add(2*time.Hour), "timeout after 30s"))
+			waitForDeliveries()
+			if len(sent) != 2 {
+				t.Fatalf("sent %d notifications, want a summary after the cooldown", len(sent))
+			}
+			if repeat := sent[1].Event.Info().Repeat; repeat == nil || repeat.Count != 3 || !repeat.Since.Equal(start) {
+				t.Errorf("summary repeat = %+v, want 3 attempts since the first failure", repeat)
+			}
+			if got, want := repeatSummary(EventFetchFailed, &Repeat{Count: 14, Since: start}, start.Add(3*24*time.Hour)), "Failing for 3 days, 14 attempts"; got != want {
+				t.Errorf("repeatSummary = %q, want %q", got, want)
+			}
+
+			// A different error is sent right away
+			Notify(ctx, failure(start.Add(3*time.Hour), "connection refused"))
+			waitForDeliveries()
+			if len(sent) != 3 || sent[2].Event.Info().Repeat != nil {
+				t.Fatalf("sent %+v, want the new error sent as a first occurrence", sent)
+			}
+
+			// Recovering is only announced once, after a failure was
+			recovered := Recovered{EventInfo: EventInfo{Provider: "Example Cloud", At: start.Add(4 * time.Hour)}}
+			Notify(ctx, recovered)
+			Notify(ctx, recovered)
+			waitForDeliveries()
+			if len(sent) != 4 || sent[3].Kind != EventRecovered {
+				t.Fatalf("sent %+v, want a single recovered notification", sent)
+			}
+			Notify(ctx, failure(start.Add(5*time.Hour), "timeout after 30s"))
+			waitForDeliveries()
+			if len(sent) != 5 || sent[4].Event.Info().Repeat != nil {
+				t.Errorf("sent %+v, want a failure after recovering sent as a first occurrence", sent)
+			}
+		})
+	}
+}
@@ -0,0 +1,571 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sb-nour/providers-endpoints/service"
+)
+
+// Kinds of events sent to the notifiers.
+const (
+	EventFetchFailed      = "fetch_failed"
+	EventRegionsChanged   = "regions_changed"
+	EventRecovered        = "recovered"
+	EventSuspiciousResult = "suspicious_result"
+	EventFallbackServed   = "fallback_served"
+)
+
+// Event is something that happened to a provider that people should be told
+// about.
+type Event interface {
+	// Kind returns one of the Event* constants.
+	Kind() string
+	// Info returns the provider and time of the event.
+	Info() EventInfo
+	// withInfo returns the event with its info replaced.
+	withInfo(info EventInfo) Event
+}
+
+// EventInfo is common to every event.
+type EventInfo struct {
+	Provider string    `json:"provider"`
+	At       time.Time `json:"at"`
+	// Repeat is set on events that keep happening and are sent again once
+	// the notification cooldown has passed.
+	Repeat *Repeat `json:"repeat,omitempty"`
+}
+
+// Repeat summarizes an event that keeps happening.
+type Repeat struct {
+	// Count is how many times it happened, including the first.
+	Count int       `json:"count"`
+	Since time.Time `json:"since"`
+}
+
+func (e EventInfo) Info() EventInfo { return e }
+
+// newEventInfo describes an event of a provider happening now.
+func newEventInfo(provider string) EventInfo {
+	return EventInfo{Provider: provider, At: time.Now().UTC()}
+}
+
+// FetchFailed is sent when a live fetch of a provider fails.
+type FetchFailed struct {
+	EventInfo
+	Error string `json:"error"`
+}
+
+func (FetchFailed) Kind() string { return EventFetchFailed }
+
+func (e FetchFailed) withInfo(info EventInfo) Event {
+	e.EventInfo = info
+	return e
+}
+
+// RegionsChanged is sent when the fetched regions of a provider differ from
+// its cached ones.
+type RegionsChanged struct {
+	EventInfo
+	OldRegions service.Regions `json:"old_regions"`
+	NewRegions service.Regions `json:"new_regions"`
+	// DocsURLs are the documentation pages the regions were read from, by
+	// category.
+	DocsURLs map[service.Category]string `json:"docs_urls,omitempty"`
+}
+
+func (RegionsChanged) Kind() string { return EventRegionsChanged }
+
+func (e RegionsChanged) withInfo(info EventInfo) Event {
+	e.EventInfo = info
+	return e
+}
+
+// Recovered is sent when a provider whose live fetches had been failing is
+// fetched successfully again.
+type Recovered struct {
+	EventInfo
+	Health ProviderHealth `json:"health"`
+}
+
+func (Recovered) Kind() string { return EventRecovered }
+
+func (e Recovered) withInfo(info EventInfo) Event {
+	e.EventInfo = info
+	return e
+}
+
+// SuspiciousResult is sent when the fetched regions of a provider fail the
+// sanity rules and are quarantined instead of cached.
+type SuspiciousResult struct {
+	EventInfo
+	Reasons []string `json:"reasons"`
+}
+
+func (SuspiciousResult) Kind() string { return EventSuspiciousResult }
+
+func (e SuspiciousResult) withInfo(info EventInfo) Event {
+	e.EventInfo = info
+	return e
+}
+
+// FallbackServed is sent when a provider has been served from its fallback
+// snapshot for longer than FALLBACK_ALERT_AFTER.
+type FallbackServed struct {
+	EventInfo
+	Since      time.Time          `json:"since"`
+	Categories []service.Category `json:"categories"`
+}
+
+func (FallbackServed) Kind() string { return EventFallbackServed }
+
+func (e FallbackServed) withInfo(info EventInfo) Event {
+	e.EventInfo = info
+	return e
+}
+
+// providerDocsURLs returns the documentation pages of a registered provider,
+// by category.
+func providerDocsURLs(providerName string) map[service.Category]string {
+	if p, ok := registeredProvider(providerName); ok {
+		return service.ProviderDocsURLs(p.ID())
+	}
+	return nil
+}
+
+// Notifier delivers events to a chat or another service.
+type Notifier interface {
+	// Name returns the name the notifier is selected by in NOTIFIERS.
+	Name() string
+	// Notify delivers an event.
+	Notify(ctx context.Context, event Event) error
+}
+
+// Names of the notifiers that can be listed in NOTIFIERS.
+const (
+	NotifierSlack   = "slack"
+	NotifierWebhook = "webhook"
+	NotifierDiscord = "discord"
+	NotifierTeams   = "teams"
+)
+
+// notifierBackends build each notifier from its configuration, reporting
+// false if it is not configured.
+var notifierBackends = map[string]func() (Notifier, bool){
+	NotifierSlack: func() (Notifier, bool) {
+		n := &slackNotifier{url: os.Getenv("SLACK_WEBHOOK_URL"), token: os.Getenv("SLACK_BOT_TOKEN")}
+		return n, n.url != "" || n.token != ""
+	},
+	NotifierWebhook: func() (Notifier, bool) {
+		n := &webhookNotifier{url: os.Getenv("NOTIFY_WEBHOOK_URL")}
+		return n, n.url != ""
+	},
+	NotifierDiscord: func() (Notifier, bool) {
+		n := &discordNotifier{url: os.Getenv("DISCORD_WEBHOOK_URL")}
+		return n, n.url != ""
+	},
+	NotifierTeams: func() (Notifier, bool) {
+		n := &teamsNotifier{url: os.Getenv("TEAMS_WEBHOOK_URL")}
+		return n, n.url != ""
+	},
+}
+
+// notifierOrder is the order notifiers are enabled in when NOTIFIERS is unset.
+var notifierOrder = []string{NotifierSlack, NotifierWebhook, NotifierDiscord, NotifierTeams}
+
+// Notifiers returns the notifiers events are sent to. NOTIFIERS selects them
+// as a comma separated list of slack, webhook, discord and teams, or "none";
+// when it is unset every configured notifier is used.
+func Notifiers() []Notifier {
+	names := notifierOrder
+	explicit := false
+	if value := strings.TrimSpace(os.Getenv("NOTIFIERS")); value != "" {
+		names, explicit = strings.Split(value, ","), true
+	}
+
+	var notifiers []Notifier
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "none" || name == "" {
+			continue
+		}
+		backend, ok := notifierBackends[name]
+		if !ok {
+			log.Printf("Unknown notifier %q in NOTIFIERS, expected one of %s", name, strings.Join(notifierOrder, ", "))
+			continue
+		}
+		notifier, configured := backend()
+		if !configured {
+			if explicit {
+				log.Printf("Notifier %s is enabled in NOTIFIERS but its URL is not set", name)
+			}
+			continue
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	return notifiers
+}
+
+// Notify sends an event to every configured notifier, logging the ones that
+// fail. Repeats of an event are throttled when the cache keeps notification
+// state. When the cache keeps an outbox the event is only queued in it, and
+// delivered in the background, so that deliveries that fail are retried
+// without holding up the caller. It is not bound to ctx being
+// done, so that a fetch that timed out is still reported.
+func Notify(ctx context.Context, event Event) {
+	ctx = context.WithoutCancel(ctx)
+	event, send := prepareNotification(ctx, event)
+	if !send {
+		return
+	}
+	if outbox, ok := cache.(Outbox); ok {
+		err := enqueueNotifications(ctx, outbox, event, nil)
+		if err == nil {
+			deliverInBackground(outbox)
+			return
+		}
+		log.Printf("Failed to queue %s notification for provider %s, sending it right away: %v", event.Kind(), event.Info().Provider, err)
+	}
+	sendNotification(ctx, event)
+}
+
+// prepareNotification records an event in the event log and throttles it,
+// reporting whether to send it.
+func prepareNotification(ctx context.Context, event Event) (Event, bool) {
+	if event.Kind() != EventDigest {
+		recordEvent(ctx, eventRecord(event))
+	}
+	event, send := throttle(ctx, event)
+	if !send {
+		log.Printf("Suppressed %s notification for provider %s", event.Kind(), event.Info().Provider)
+	}
+	return event, send
+}
+
+// sendNotification sends an event to every configured notifier once, without
+// going through the outbox.
+func sendNotification(ctx context.Context, event Event) {
+	info := event.Info()
+	for _, notifier := range Notifiers() {
+		if err := notifier.Notify(ctx, event); err != nil {
+			log.Printf("Failed to send %s notification for provider %s via %s: %v", event.Kind(), info.Provider, notifier.Name(), err)
+			continue
+		}
+		log.Printf("Sent %s notification for provider %s via %s", event.Kind(), info.Provider, notifier.Name())
+	}
+}
+
+// notifyClient posts notifications, bounding each to a few seconds so that a
+// slow chat service does not hold up a refresh.
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// newJSONRequest returns a request posting payload as JSON to url.
+func newJSONRequest(ctx context.Context, url string, payload interface{}) (*http.Request, error) {
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal notification: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create notification request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	return req, nil
+}
+
+// postJSON posts payload as JSON to url and fails unless it is accepted.
+func postJSON(ctx context.Context, url string, payload interface{}) error {
+	req, err := newJSONRequest(ctx, url, payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send notification: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("notification failed with status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Levels of the messages of events, named after the Slack attachment colors.
+const (
+	levelDanger  = "danger"
+	levelWarning = "warning"
+	levelGood    = "good"
+)
+
+// eventMessage is the human readable form of an event rendered by the chat
+// notifiers.
+type eventMessage struct {
+	Title  string
+	Text   string
+	Level  string
+	Fields []messageField
+}
+
+type messageField struct {
+	Title string
+	Value string
+	Short bool
+}
+
+// markup formats text in the syntax of a chat service.
+type markup struct {
+	bold func(string) string
+	code func(string) string
+	link func(url, text string) string
+	// text escapes plain text, such as region names.
+	text func(string) string
+}
+
+// markdownMarkup is the markup of Discord and Teams.
+var markdownMarkup = markup{
+	bold: func(text string) string { return "**" + text + "**" },
+	code: func(text string) string { return "`" + text + "`" },
+	link: func(url, text string) string { return "[" + text + "](" + url + ")" },
+	text: func(text string) string { return text },
+}
+
+// inlineChanges is how many changes of each kind a notification lists before
+// leaving the rest out.
+const inlineChanges = 10
+
+// messageFor describes an event for people in the markup of the chat service,
+// summarizing how long it has been going on if it is a repeat.
+func messageFor(event Event, m markup) eventMessage {
+	message := eventMessageFor(event, m)
+	if info := event.Info(); info.Repeat != nil {
+		message.Text = m.bold(repeatSummary(event.Kind(), info.Repeat, info.At)) + "\n" + message.Text
+	}
+	return message
+}
+
+func eventMessageFor(event Event, m markup) eventMessage {
+	bold := m.bold
+	info := event.Info()
+	provider := messageField{Title: "Provider", Value: info.Provider, Short: true}
+	timestamp := messageField{Title: "Timestamp", Value: info.At.Format("2006-01-02 15:04:05"), Short: true}
+
+	switch e := event.(type) {
+	case Digest:
+		return digestMessage(e, m)
+
+	case FetchFailed:
+		return eventMessage{
+			Title:  "🚨 Provider Regions Fetch Failed",
+			Text:   fmt.Sprintf("Failed to fetch regions for provider: %s", bold(info.Provider)),
+			Level:  levelDanger,
+			Fields: []messageField{provider, {Title: "Error", Value: e.Error}, timestamp},
+		}
+
+	case RegionsChanged:
+		fields := []messageField{provider}
+		changes := groupChanges(e.OldRegions, e.NewRegions, m)
+		for _, c := range changes {
+			fields = append(fields, messageField{
+				Title: fmt.Sprintf("%s Regions Count", categoryTitle(c.category)),
+				Value: fmt.Sprintf("Old: %d → New: %d", c.oldCount, c.newCount),
+				Short: true,
+			})
+		}
+		for _, c := range changes {
+			if len(c.groups) == 0 {
+				continue
+			}
+			var lines []string
+			for _, group := range c.groups {
+				lines = append(lines, bold(fmt.Sprintf("%s (%d)", group.title, len(group.lines))))
+				lines = append(lines, limitLines(group.lines, inlineChanges)...)
+			}
+			if url := e.DocsURLs[c.category]; url != "" {
+				lines = append(lines, m.link(url, "Source documentation"))
+			}
+			fields = append(fields, messageField{
+				Title: fmt.Sprintf("%s Regions Changes", categoryTitle(c.category)),
+				Value: strings.Join(lines, "\n"),
+			})
+		}
+		return eventMessage{
+			Title:  "🔄 Provider Regions Changed",
+			Text:   fmt.Sprintf("Regions have changed for provider: %s", bold(info.Provider)),
+			Level:  levelWarning,
+			Fields: append(fields, timestamp),
+		}
+
+	case Recovered:
+		return eventMessage{
+			Title: "✅ Provider Recovered",
+			Text:  fmt.Sprintf("Regions for provider %s were fetched successfully again", bold(info.Provider)),
+			Level: levelGood,
+			Fields: []messageField{
+				provider,
+				{Title: "Failed Attempts", Value: fmt.Sprintf("%d", e.Health.Failures), Short: true},
+				{Title: "Failing Since", Value: e.Health.FirstFailureAt.Format("2006-01-02 15:04:05"), Short: true},
+				{Title: "Last Error", Value: e.Health.LastError},
+			},
+		}
+
+	case SuspiciousResult:
+		return eventMessage{
+			Title: "🧩 Probable Scraper Breakage",
+			Text:  fmt.Sprintf("Regions fetched for provider %s look wrong and were quarantined; the last good regions are still served", bold(info.Provider)),
+			Level: levelDanger,
+			Fields: []messageField{
+				provider,
+				timestamp,
+				{Title: "Failed Checks", Value: "• " + strings.Join(e.Reasons, "\n• ")},
+			},
+		}
+
+	case FallbackServed:
+		categoryTitles := make([]string, 0, len(e.Categories))
+		for _, category := range e.Categories {
+			categoryTitles = append(categoryTitles, categoryTitle(category))
+		}
+		return eventMessage{
+			Title: "⏳ Provider Served From Fallback",
+			Text:  fmt.Sprintf("Regions for provider %s have come from the fallback snapshot for %s", bold(info.Provider), info.At.Sub(e.Since).Round(time.Hour)),
+			Level: levelWarning,
+			Fields: []messageField{
+				provider,
+				{Title: "Since", Value: e.Since.Format("2006-01-02 15:04:05"), Short: true},
+				{Title: "Categories", Value: strings.Join(categoryTitles, ", ")},
+			},
+		}
+	}
+
+	return eventMessage{
+		Title:  event.Kind(),
+		Text:   fmt.Sprintf("Event %s for provider %s", event.Kind(), bold(info.Provider)),
+		Level:  levelWarning,
+		Fields: []messageField{provider, timestamp},
+	}
+}
+
+// changedCategories returns the union of the categories of both region sets, sorted.
+func changedCategories(oldRegions, newRegions service.Regions) []service.Category {
+	seen := make(map[service.Category]bool)
+	var categories []service.Category
+	for _, regions := range []service.Regions{oldRegions, newRegions} {
+		for _, category := range regions.Categories() {
+			if !seen[category] {
+				seen[category] = true
+				categories = append(categories, category)
+			}
+		}
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		return categories[i] < categories[j]
+	})
+	return categories
+}
+
+// categoryTitle turns a category such as "block-storage" into "Block Storage".
+func categoryTitle(category service.Category) string {
+	words := strings.Split(string(category), "-")
+	for i, word := range words {
+		if word == "gpu" || word == "db" {
+			words[i] = strings.ToUpper(word)
+		} else if word != "" {
+			words[i] = strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// Titles of the kinds of changes listed by notifications.
+const (
+	changesAdded   = "Added"
+	changesRemoved = "Removed"
+	changesRenamed = "Renamed"
+	changesUpdated = "Updated"
+)
+
+// changeGroup is the changes of one kind to a category of regions, formatted
+// one per line.
+type changeGroup struct {
+	title string
+	lines []string
+}
+
+// categoryChanges is the changes to a category of a provider's regions.
+type categoryChanges struct {
+	category           service.Category
+	oldCount, newCount int
+	// groups lists the added, removed, renamed and otherwise updated regions,
+	// leaving out the kinds without any.
+	groups []changeGroup
+}
+
+// groupChanges lists the changes from oldRegions to newRegions by category,
+// and within a category by kind, formatted in the markup of a chat service.
+// Regions whose name is unchanged but whose location or endpoints changed
+// are updated.
+func groupChanges(oldRegions, newRegions service.Regions, m markup) []categoryChanges {
+	changes := diffRegions("", oldRegions, newRegions, time.Time{})
+
+	var result []categoryChanges
+	for _, category := range changedCategories(oldRegions, newRegions) {
+		lines := make(map[string][]string)
+		for _, change := range changes {
+			if change.Category != category {
+				continue
+			}
+			code := m.code(change.Code)
+			switch {
+			case change.Kind == ChangeAdded:
+				lines[changesAdded] = append(lines[changesAdded], regionLine(code, *change.New, m))
+			case change.Kind == ChangeRemoved:
+				lines[changesRemoved] = append(lines[changesRemoved], regionLine(code, *change.Old, m))
+			case change.Old.Name != change.New.Name:
+				lines[changesRenamed] = append(lines[changesRenamed],
+					fmt.Sprintf("• %s %s → %s", code, m.text(change.Old.Name), m.text(change.New.Name)))
+			default:
+				lines[changesUpdated] = append(lines[changesUpdated], regionLine(code, *change.New, m))
+			}
+		}
+
+		c := categoryChanges{
+			category: category,
+			oldCount: len(oldRegions.Category(category)),
+			newCount: len(newRegions.Category(category)),
+		}
+		for _, title := range []string{changesAdded, changesRemoved, changesRenamed, changesUpdated} {
+			if len(lines[title]) > 0 {
+				c.groups = append(c.groups, changeGroup{title: title, lines: lines[title]})
+			}
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+// regionLine formats a region of a list of changes.
+func regionLine(code string, region service.Region, m markup) string {
+	if region.Name == "" || region.Name == region.Code {
+		return "• " + code
+	}
+	return fmt.Sprintf("• %s %s", code, m.text(region.Name))
+}
+
+// limitLines returns the first n lines, followed by how many were left out.
+func limitLines(lines []string, n int) []string {
+	if len(lines) <= n {
+		return lines
+	}
+	return append(lines[:n:n], fmt.Sprintf("…and %d more", len(lines)-n))
+}
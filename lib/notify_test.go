@@ -0,0 +1,224 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sb-nour/providers-endpoints/service"
+)
+
+func TestNotifiers(t *testing.T) {
+	var mu sync.Mutex
+	bodies := make(map[string]map[string]interface{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("notification to %s is not JSON: %v", r.URL.Path, err)
+		}
+		mu.Lock()
+		bodies[r.URL.Path] = body
+		mu.Unlock()
+		// Discord answers webhooks without content
+		if r.URL.Path == "/discord" {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("SLACK_WEBHOOK_URL", server.URL+"/slack")
+	t.Setenv("SLACK_BOT_TOKEN", "")
+	t.Setenv("NOTIFY_WEBHOOK_URL", server.URL+"/webhook")
+	t.Setenv("DISCORD_WEBHOOK_URL", server.URL+"/discord")
+	t.Setenv("TEAMS_WEBHOOK_URL", server.URL+"/teams")
+	t.Setenv("SLACK_ERROR_CHANNEL", "alerts")
+
+	// Every configured notifier is used unless NOTIFIERS picks some
+	if n := len(Notifiers()); n != len(notifierOrder) {
+		t.Errorf("%d notifiers by default, want %d", n, len(notifierOrder))
+	}
+	t.Setenv("NOTIFIERS", "none")
+	if n := len(Notifiers()); n != 0 {
+		t.Errorf("%d notifiers with NOTIFIERS=none, want 0", n)
+	}
+	t.Setenv("NOTIFIERS", "slack, webhook,discord,teams")
+
+	Notify(context.Background(), SuspiciousResult{
+		EventInfo: EventInfo{Provider: "Example Cloud", At: time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)},
+		Reasons:   []string{"storage has 0 regions, fewer than 1"},
+	})
+
+	for path, check := range map[string]func(body map[string]interface{}) bool{
+		"/slack": func(body map[string]interface{}) bool {
+			text := body["blocks"].([]interface{})[1].(map[string]interface{})["text"].(map[string]interface{})
+			return body["channel"] == "#alerts" && strings.Contains(text["text"].(string), "*Example Cloud*")
+		},
+		"/webhook": func(body map[string]interface{}) bool {
+			event := body["event"].(map[string]interface{})
+			return body["kind"] == EventSuspiciousResult && event["provider"] == "Example Cloud" && len(event["reasons"].([]interface{})) == 1
+		},
+		"/discord": func(body map[string]interface{}) bool {
+			embed := body["embeds"].([]interface{})[0].(map[string]interface{})
+			return embed["timestamp"] == "2025-03-01T00:00:00Z" && strings.Contains(embed["description"].(string), "**Example Cloud**")
+		},
+		"/teams": func(body map[string]interface{}) bool {
+			attachment := body["attachments"].([]interface{})[0].(map[string]interface{})
+			return attachment["contentType"] == "application/vnd.microsoft.card.adaptive"
+		},
+	} {
+		body, ok := bodies[path]
+		if !ok {
+			t.Errorf("nothing posted to %s", path)
+			continue
+		}
+		if !check(body) {
+			t.Errorf("notification posted to %s = %v", path, body)
+		}
+	}
+}
+
+func TestSlackRegionsChanged(t *testing.T) {
+	var codes []string
+	for i := 0; i < 15; i++ {
+		codes = append(codes, fmt.Sprintf("eu-%02d", i))
+	}
+	event := RegionsChanged{
+		EventInfo:  EventInfo{Provider: "Example Cloud", At: time.Now().UTC()},
+		OldRegions: testRegions("us-1"),
+		NewRegions: testRegions(codes...),
+		DocsURLs:   map[service.Category]string{service.CategoryStorage: "https://example.com/regions"},
+	}
+	event.NewRegions[service.CategoryStorage]["us-1"] = service.Region{Code: "us-1", Name: "Renamed"}
+
+	// Without a bot token the message says how to get the whole diff
+	blocks, replies := slackChangesBlocks(event, messageFor(event, slackMarkup), false)
+	text := slackBlocksText(blocks)
+	for _, want := range []string{"*Added (15)*", "…and 5 more", "*Renamed (1)*", "Region us-1 → Renamed", "<https://example.com/regions|source documentation>", "changes` for the full diff"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("blocks do not contain %q: %s", want, text)
+		}
+	}
+	if replies != nil {
+		t.Errorf("replies without a bot token = %v, want none", replies)
+	}
+
+	// With one the full diff is posted in the thread of the message
+	var mu sync.Mutex
+	var posted []SlackMessage
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer xoxb-test" {
+			t.Errorf("Authorization = %q", r.Header.Get("Authorization"))
+		}
+		var message SlackMessage
+		if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		posted = append(posted, message)
+		mu.Unlock()
+		fmt.Fprint(w, `{"ok": true, "ts": "1700000000.000100"}`)
+	}))
+	defer api.Close()
+	previous := slackAPIURL
+	slackAPIURL = api.URL
+	t.Cleanup(func() { slackAPIURL = previous })
+	t.Setenv("SLACK_CHANGES_CHANNEL", "")
+	t.Setenv("SLACK_CHANNEL", "#regions")
+
+	notifier := &slackNotifier{token: "xoxb-test"}
+	if err := notifier.Notify(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	if len(posted) != 2 || posted[0].ThreadTS != "" || posted[1].ThreadTS != "1700000000.000100" || posted[1].Channel != "#regions" {
+		t.Fatalf("posted %+v, want the message followed by a reply in its thread", posted)
+	}
+	if text := slackBlocksText(posted[1].Blocks); !strings.Contains(text, "eu-14") {
+		t.Errorf("thread reply does not list every change: %s", text)
+	}
+}
+
+func TestSlackReplyFailure(t *testing.T) {
+	var codes []string
+	for i := 0; i < 15; i++ {
+		codes = append(codes, fmt.Sprintf("eu-%02d", i))
+	}
+	event := RegionsChanged{
+		EventInfo:  EventInfo{Provider: "Example Cloud", At: time.Now().UTC()},
+		OldRegions: testRegions("us-1"),
+		NewRegions: testRegions(codes...),
+	}
+
+	// A reply that fails does not fail the message already posted, which a
+	// retry would post again
+	var mu sync.Mutex
+	var posted []SlackMessage
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message SlackMessage
+		if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		posted = append(posted, message)
+		mu.Unlock()
+		if message.ThreadTS != "" {
+			fmt.Fprint(w, `{"ok": false, "error": "ratelimited"}`)
+			return
+		}
+		fmt.Fprint(w, `{"ok": true, "ts": "1700000000.000100"}`)
+	}))
+	defer api.Close()
+	previous := slackAPIURL
+	slackAPIURL = api.URL
+	t.Cleanup(func() { slackAPIURL = previous })
+	t.Setenv("SLACK_CHANGES_CHANNEL", "")
+	t.Setenv("SLACK_CHANNEL", "#regions")
+
+	notifier := &slackNotifier{token: "xoxb-test"}
+	if err := notifier.Notify(context.Background(), event); err != nil {
+		t.Errorf("Notify = %v, want the message delivered", err)
+	}
+	if len(posted) != 2 {
+		t.Errorf("posted %d messages, want the message and the failed reply", len(posted))
+	}
+}
+
+func TestSlackBlocksLimits(t *testing.T) {
+	long := strings.Repeat("timeout ", 1000)
+	blocks := slackBlocks(eventMessage{
+		Title:  strings.Repeat("Title ", 50),
+		Text:   long,
+		Fields: []messageField{{Title: "Error", Value: long, Short: true}, {Title: "Details", Value: long}},
+	})
+	if n := len([]rune(blocks[0].Text.Text)); n > slackMaxHeaderLength {
+		t.Errorf("header has %d characters, want at most %d", n, slackMaxHeaderLength)
+	}
+	if n := len([]rune(blocks[1].Text.Text)); n > slackMaxTextLength {
+		t.Errorf("section has %d characters, want at most %d", n, slackMaxTextLength)
+	}
+	if n := len([]rune(blocks[1].Fields[0].Text)); n > slackMaxFieldLength || !strings.HasSuffix(blocks[1].Fields[0].Text, "…") {
+		t.Errorf("field has %d characters, want at most %d ending with an ellipsis", n, slackMaxFieldLength)
+	}
+	if n := len([]rune(blocks[2].Text.Text)); n > slackMaxTextLength {
+		t.Errorf("long field has %d characters, want at most %d", n, slackMaxTextLength)
+	}
+}
+
+// slackBlocksText joins the text of the sections and context of blocks.
+func slackBlocksText(blocks []SlackBlock) string {
+	var texts []string
+	for _, block := range blocks {
+		if block.Text != nil {
+			texts = append(texts, block.Text.Text)
+		}
+		for _, element := range block.Elements {
+			texts = append(texts, element.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
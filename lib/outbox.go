@@ -0,0 +1,379 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Statuses of an outbox message.
+const (
+	// OutboxPending messages are delivered once their next attempt is due.
+	OutboxPending = "pending"
+	// OutboxDelivered messages were accepted by their notifier.
+	OutboxDelivered = "delivered"
+	// OutboxFailed messages ran out of attempts and are only delivered again
+	// when replayed.
+	OutboxFailed = "failed"
+)
+
+// Defaults of the delivery of outbox messages, unless NOTIFY_MAX_ATTEMPTS and
+// NOTIFY_RETRY_BACKOFF are set.
+const (
+	DefaultNotifyMaxAttempts  = 10
+	DefaultNotifyRetryBackoff = time.Minute
+)
+
+// maxNotifyRetryBackoff caps the doubling of the wait between attempts.
+const maxNotifyRetryBackoff = time.Hour
+
+// outboxLease is how long a claimed message is held back from other workers
+// while it is delivered.
+const outboxLease = time.Minute
+
+// outboxBatch is the most messages delivered in one go.
+const outboxBatch = 100
+
+// NotifyMaxAttempts returns how many times delivering a notification is
+// attempted before it is marked failed, read from NOTIFY_MAX_ATTEMPTS.
+func NotifyMaxAttempts() int {
+	if n, ok := envInt("NOTIFY_MAX_ATTEMPTS"); ok {
+		return n
+	}
+	return DefaultNotifyMaxAttempts
+}
+
+// NotifyRetryBackoff returns how long to wait before attempting to deliver a
+// notification again after the given number of failed attempts:
+// NOTIFY_RETRY_BACKOFF after the first, doubling with every further attempt
+// up to an hour.
+func NotifyRetryBackoff(attempts int) time.Duration {
+	backoff, ok := envDuration("NOTIFY_RETRY_BACKOFF")
+	if !ok {
+		backoff = DefaultNotifyRetryBackoff
+	}
+	for i := 1; i < attempts && backoff < maxNotifyRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxNotifyRetryBackoff {
+		backoff = maxNotifyRetryBackoff
+	}
+	return backoff
+}
+
+// OutboxMessage is the delivery of an event to one notifier, kept until the
+// notifier accepts it.
+type OutboxMessage struct {
+	ID       int64  `json:"id"`
+	Notifier string `json:"notifier"`
+	Kind     string `json:"kind"`
+	Provider string `json:"provider"`
+	// Event is the event as JSON, decoded again by its kind when delivered.
+	Event     json.RawMessage `json:"event"`
+	Status    string          `json:"status"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last_error,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	// NextAttemptAt is when a pending message is due.
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+}
+
+// Outbox is implemented by caches that keep the notifications to deliver
+// until every notifier accepted them, so that an alert outlives a notifier
+// being down.
+type Outbox interface {
+	// EnqueueNotifications adds pending messages to the outbox.
+	EnqueueNotifications(ctx context.Context, messages []OutboxMessage) error
+	// PutWithNotifications replaces the entry of a provider and adds pending
+	// messages to the outbox together, so that the notifications of a change
+	// are not lost once the change is cached. Backends that cannot do both at
+	// once write the entry first, so a change is never notified without being
+	// cached.
+	PutWithNotifications(ctx context.Context, entry CacheEntry, messages []OutboxMessage) error
+	// ClaimNotifications returns up to limit pending messages due at the
+	// given time, oldest first, and holds them back from other claims for
+	// lease.
+	ClaimNotifications(ctx context.Context, at time.Time, lease time.Duration, limit int) ([]OutboxMessage, error)
+	// UpdateNotification stores the outcome of delivering a message.
+	UpdateNotification(ctx context.Context, message OutboxMessage) error
+	// OutboxNotifications lists the messages with the given status, or every
+	// message when it is empty, oldest first.
+	OutboxNotifications(ctx context.Context, status string) ([]OutboxMessage, error)
+}
+
+// outboxMessages returns the messages delivering an event to every
+// configured notifier.
+func outboxMessages(event Event, notifiers []Notifier) ([]OutboxMessage, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s event: %w", event.Kind(), err)
+	}
+
+	now := time.Now().UTC()
+	messages := make([]OutboxMessage, 0, len(notifiers))
+	for _, notifier := range notifiers {
+		messages = append(messages, OutboxMessage{
+			Notifier:      notifier.Name(),
+			Kind:          event.Kind(),
+			Provider:      event.Info().Provider,
+			Event:         data,
+			Status:        OutboxPending,
+			CreatedAt:     now,
+			NextAttemptAt: now,
+		})
+	}
+	return messages, nil
+}
+
+// decodeEvent decodes an event of the given kind from JSON.
+func decodeEvent(kind string, data []byte) (Event, error) {
+	var event Event
+	var err error
+	switch kind {
+	case EventFetchFailed:
+		var e FetchFailed
+		err = json.Unmarshal(data, &e)
+		event = e
+	case EventRegionsChanged:
+		var e RegionsChanged
+		err = json.Unmarshal(data, &e)
+		event = e
+	case EventRecovered:
+		var e Recovered
+		err = json.Unmarshal(data, &e)
+		event = e
+	case EventSuspiciousResult:
+		var e SuspiciousResult
+		err = json.Unmarshal(data, &e)
+		event = e
+	case EventFallbackServed:
+		var e FallbackServed
+		err = json.Unmarshal(data, &e)
+		event = e
+	case EventDigest:
+		var e Digest
+		err = json.Unmarshal(data, &e)
+		event = e
+	default:
+		return nil, fmt.Errorf("unknown event kind %q", kind)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s event: %w", kind, err)
+	}
+	return event, nil
+}
+
+// enqueueNotifications adds the messages delivering an event to every
+// configured notifier to the outbox, storing entry along with them if it is
+// not nil.
+func enqueueNotifications(ctx context.Context, outbox Outbox, event Event, entry *CacheEntry) error {
+	messages, err := outboxMessages(event, Notifiers())
+	if err != nil {
+		return err
+	}
+	if entry != nil {
+		return outbox.PutWithNotifications(ctx, *entry, messages)
+	}
+	return outbox.EnqueueNotifications(ctx, messages)
+}
+
+// putWithNotification caches an entry and queues the notification of the
+// change it makes in one step, so that if the notification cannot be queued
+// the entry is not cached either and the change is detected again on the next
+// refresh. Without an outbox the event is sent right away.
+func putWithNotification(ctx context.Context, entry CacheEntry, event Event) error {
+	ctx = context.WithoutCancel(ctx)
+	event, send := prepareNotification(ctx, event)
+	outbox, ok := cache.(Outbox)
+	if !send || !ok {
+		if send {
+			sendNotification(ctx, event)
+		}
+		return cache.Put(ctx, entry)
+	}
+
+	if err := enqueueNotifications(ctx, outbox, event, &entry); err != nil {
+		return err
+	}
+	deliverInBackground(outbox)
+	return nil
+}
+
+// outboxDeliveryDeadline bounds a background delivery of the outbox, so
+// that a notifier that is down does not keep it running.
+const outboxDeliveryDeadline = 30 * time.Second
+
+var (
+	// deliveryMu guards deliveryOutbox, deliveryRunning and deliveryRequested.
+	deliveryMu        sync.Mutex
+	deliveryOutbox    Outbox
+	deliveryRunning   bool
+	deliveryRequested bool
+	deliveries        sync.WaitGroup
+)
+
+// deliverInBackground delivers the messages of outbox that are due without
+// blocking the caller. A single delivery runs at a time: it goes on while
+// there are more due messages than it claims at once, or another delivery was
+// requested while it ran.
+func deliverInBackground(outbox Outbox) {
+	deliveryMu.Lock()
+	defer deliveryMu.Unlock()
+	deliveryOutbox = outbox
+	if deliveryRunning {
+		deliveryRequested = true
+		return
+	}
+	deliveryRunning = true
+
+	deliveries.Add(1)
+	go func() {
+		defer deliveries.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), outboxDeliveryDeadline)
+		defer cancel()
+
+		for {
+			claimed, _, err := deliverDue(ctx, outbox)
+			if err != nil {
+				log.Printf("Failed to deliver notifications: %v", err)
+			}
+			deliveryMu.Lock()
+			if err != nil || ctx.Err() != nil || (claimed < outboxBatch && !deliveryRequested) {
+				deliveryRunning, deliveryRequested = false, false
+				deliveryMu.Unlock()
+				return
+			}
+			deliveryRequested = false
+			outbox = deliveryOutbox
+			deliveryMu.Unlock()
+		}
+	}()
+}
+
+// waitForDeliveries waits for the background delivery of the outbox, if one
+// is running.
+func waitForDeliveries() {
+	deliveries.Wait()
+}
+
+// DeliverOutbox delivers the pending outbox messages that are due, retrying
+// the ones that fail with a backoff until they run out of attempts, and
+// returns how many were delivered. Messages it has no time left for by the
+// deadline of ctx are left for the next delivery.
+func DeliverOutbox(ctx context.Context) (int, error) {
+	outbox, ok := cache.(Outbox)
+	if !ok {
+		return 0, nil
+	}
+	_, delivered, err := deliverDue(ctx, outbox)
+	return delivered, err
+}
+
+// deliverDue claims a batch of the pending messages of outbox that are due and
+// delivers them, returning how many were claimed and delivered.
+func deliverDue(ctx context.Context, outbox Outbox) (int, int, error) {
+	// Outcomes are recorded even once ctx is done
+	store := context.WithoutCancel(ctx)
+
+	messages, err := outbox.ClaimNotifications(store, time.Now().UTC(), outboxLease, outboxBatch)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to claim notifications: %w", err)
+	}
+
+	notifiers := make(map[string]Notifier)
+	for _, notifier := range Notifiers() {
+		notifiers[notifier.Name()] = notifier
+	}
+
+	delivered := 0
+	for _, message := range messages {
+		// The claim of the rest expires and they are delivered later
+		if ctx.Err() != nil {
+			break
+		}
+		err := deliverMessage(ctx, message, notifiers)
+		now := time.Now().UTC()
+		message.Attempts++
+		if err == nil {
+			message.Status = OutboxDelivered
+			message.LastError = ""
+			message.DeliveredAt = &now
+			delivered++
+			log.Printf("Sent %s notification for provider %s via %s", message.Kind, message.Provider, message.Notifier)
+		} else {
+			message.LastError = err.Error()
+			if message.Attempts >= NotifyMaxAttempts() {
+				message.Status = OutboxFailed
+				log.Printf("Giving up on %s notification %d for provider %s via %s after %d attempts: %v", message.Kind, message.ID, message.Provider, message.Notifier, message.Attempts, err)
+			} else {
+				message.NextAttemptAt = now.Add(NotifyRetryBackoff(message.Attempts))
+				log.Printf("Failed to send %s notification for provider %s via %s, retrying at %s: %v", message.Kind, message.Provider, message.Notifier, message.NextAttemptAt.Format(time.RFC3339), err)
+			}
+		}
+		if err := outbox.UpdateNotification(store, message); err != nil {
+			log.Printf("Failed to record delivery of notification %d: %v", message.ID, err)
+		}
+	}
+	return len(messages), delivered, nil
+}
+
+// deliverMessage sends an outbox message through its notifier.
+func deliverMessage(ctx context.Context, message OutboxMessage, notifiers map[string]Notifier) error {
+	notifier, ok := notifiers[message.Notifier]
+	if !ok {
+		return fmt.Errorf("notifier %s is not configured", message.Notifier)
+	}
+	event, err := decodeEvent(message.Kind, message.Event)
+	if err != nil {
+		return err
+	}
+	return notifier.Notify(ctx, event)
+}
+
+// OutboxNotifications lists the outbox messages with the given status, or
+// every message when it is empty.
+func OutboxNotifications(ctx context.Context, status string) ([]OutboxMessage, error) {
+	outbox, ok := cache.(Outbox)
+	if !ok {
+		return nil, fmt.Errorf("the %s cache backend does not keep an outbox", CacheBackend())
+	}
+	return outbox.OutboxNotifications(ctx, status)
+}
+
+// ReplayNotifications makes failed outbox messages pending again with a fresh
+// set of attempts, all of them or only the ones with the given IDs, and
+// returns them.
+func ReplayNotifications(ctx context.Context, ids []int64) ([]OutboxMessage, error) {
+	outbox, ok := cache.(Outbox)
+	if !ok {
+		return nil, fmt.Errorf("the %s cache backend does not keep an outbox", CacheBackend())
+	}
+	failed, err := outbox.OutboxNotifications(ctx, OutboxFailed)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		selected[id] = true
+	}
+	now := time.Now().UTC()
+	replayed := []OutboxMessage{}
+	for _, message := range failed {
+		if len(ids) > 0 && !selected[message.ID] {
+			continue
+		}
+		message.Status = OutboxPending
+		message.Attempts = 0
+		message.NextAttemptAt = now
+		if err := outbox.UpdateNotification(ctx, message); err != nil {
+			return replayed, fmt.Errorf("failed to replay notification %d: %w", message.ID, err)
+		}
+		replayed = append(replayed, message)
+	}
+	return replayed, nil
+}
@@ -0,0 +1,167 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sb-nour/providers-endpoints/service"
+)
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	down := true
+	var received []RegionsChanged
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var payload struct {
+			Event RegionsChanged `json:"event"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		received = append(received, payload.Event)
+	}))
+	defer server.Close()
+	t.Setenv("NOTIFIERS", NotifierWebhook)
+	t.Setenv("NOTIFY_WEBHOOK_URL", server.URL)
+	t.Setenv("NOTIFY_MAX_ATTEMPTS", "2")
+	t.Setenv("NOTIFY_RETRY_BACKOFF", "1ms")
+
+	for backend, open := range openTestCaches(t) {
+		t.Run(backend, func(t *testing.T) {
+			useTestCache(t, open())
+			down, received = true, nil
+
+			// The change is cached and its notification queued although the
+			// notifier is down, and delivered in the background
+			entry := newCacheEntry("Example Cloud", testRegions("a", "b"), CachePolicyFor("Example Cloud"))
+			event := RegionsChanged{EventInfo: newEventInfo("Example Cloud"), OldRegions: testRegions("a"), NewRegions: entry.Regions}
+			if err := putWithNotification(ctx, entry, event); err != nil {
+				t.Fatal(err)
+			}
+			waitForDeliveries()
+			if _, found, err := cache.Get(ctx, "Example Cloud"); err != nil || !found {
+				t.Fatalf("entry not cached: %v", err)
+			}
+			pending, err := OutboxNotifications(ctx, OutboxPending)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pending) != 1 || pending[0].Attempts != 1 || pending[0].LastError == "" {
+				t.Fatalf("pending = %+v, want the failed first attempt", pending)
+			}
+
+			// It is retried after the backoff, and fails for good once out of
+			// attempts
+			time.Sleep(10 * time.Millisecond)
+			if _, err := DeliverOutbox(ctx); err != nil {
+				t.Fatal(err)
+			}
+			failed, err := OutboxNotifications(ctx, OutboxFailed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(failed) != 1 || failed[0].Attempts != 2 {
+				t.Fatalf("failed = %+v, want the message out of attempts", failed)
+			}
+
+			// Replaying delivers it once the notifier is back
+			mu.Lock()
+			down = false
+			mu.Unlock()
+			if _, err := ReplayNotifications(ctx, []int64{failed[0].ID}); err != nil {
+				t.Fatal(err)
+			}
+			delivered, err := DeliverOutbox(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if delivered != 1 || len(received) != 1 {
+				t.Fatalf("delivered %d, received %d, want the replayed message", delivered, len(received))
+			}
+			if got := received[0].NewRegions.Category(service.CategoryStorage); len(got) != 2 {
+				t.Errorf("received regions %v, want the new regions", got)
+			}
+			messages, err := OutboxNotifications(ctx, OutboxDelivered)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != 1 || messages[0].DeliveredAt == nil {
+				t.Errorf("delivered = %+v, want the message marked delivered", messages)
+			}
+		})
+	}
+}
+
+func TestFileOutboxConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	c, err := openFileCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages are delivered while others are still being queued
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				if err := c.EnqueueNotifications(ctx, []OutboxMessage{{Notifier: NotifierWebhook, Kind: EventFetchFailed, Status: OutboxPending}}); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	delivered := make(chan struct{})
+	go func() {
+		defer close(delivered)
+		for n := 0; n < 100; {
+			claimed, err := c.ClaimNotifications(ctx, time.Now().UTC(), time.Minute, 10)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for _, message := range claimed {
+				message.Status = OutboxDelivered
+				if err := c.UpdateNotification(ctx, message); err != nil {
+					t.Error(err)
+				}
+				n++
+			}
+		}
+	}()
+	wg.Wait()
+	<-delivered
+
+	// and what is on disk is what was kept in memory
+	reopened, err := openFileCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := reopened.OutboxNotifications(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 100 {
+		t.Fatalf("reopened outbox has %d messages, want 100", len(messages))
+	}
+	for _, message := range messages {
+		if message.Status != OutboxDelivered {
+			t.Errorf("message %d is %s on disk, want delivered", message.ID, message.Status)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package lib
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/sb-nour/providers-endpoints/service"
+)
+
+// DefaultFallbackAlertAfter is how long a provider may be served from its
+// fallback snapshot before an alert is sent, unless FALLBACK_ALERT_AFTER is set.
+const DefaultFallbackAlertAfter = 72 * time.Hour
+
+// FallbackAlertAfter returns how long a provider may be served from its
+// fallback snapshot before an alert is sent, read from FALLBACK_ALERT_AFTER
+// (e.g. "24h").
+func FallbackAlertAfter() time.Duration {
+	if d, ok := envDuration("FALLBACK_ALERT_AFTER"); ok {
+		return d
+	}
+	return DefaultFallbackAlertAfter
+}
+
+// FallbackPeriod is a stretch of time during which a provider has been served
+// from its fallback snapshot without a complete live fetch in between.
+type FallbackPeriod struct {
+	Provider  string     `json:"provider"`
+	Since     time.Time  `json:"since"`
+	AlertedAt *time.Time `json:"alerted_at,omitempty"`
+}
+
+// FallbackTracker is implemented by caches that remember since when each
+// provider has been served from its fallback snapshot, so that long periods
+// are alerted on once.
+type FallbackTracker interface {
+	// MarkFallback records that a provider was served from its fallback
+	// snapshot at the given time and returns the period it belongs to,
+	// starting one if there is none.
+	MarkFallback(ctx context.Context, provider string, at time.Time) (FallbackPeriod, error)
+	// MarkFallbackAlerted records that the period of a provider was alerted on.
+	MarkFallbackAlerted(ctx context.Context, provider string, at time.Time) error
+	// ClearFallback ends the period of a provider, if it has one.
+	ClearFallback(ctx context.Context, provider string) error
+	// FallbackPeriods lists the current period of every provider, by
+	// provider name.
+	FallbackPeriods(ctx context.Context) ([]FallbackPeriod, error)
+}
+
+// cachedResult is the result of serving a cache entry, with the provenance of
+// the fetch it was cached from.
+func cachedResult(entry *CacheEntry, stale bool) service.FetchResult {
+	provenance := entry.Provenance
+	provenance.Source = service.SourceCache
+	return service.FetchResult{Regions: entry.Regions, Stale: stale, FetchedAt: entry.CreatedAt, Provenance: provenance}
+}
+
+// trackFallback records whether a provider was served from its fallback
+// snapshot, if the cache tracks it, and alerts once the provider has been
+// served from it for longer than FallbackAlertAfter. A complete live fetch
+// ends the period.
+func trackFallback(ctx context.Context, providerName string, result service.FetchResult) {
+	tracker, ok := cache.(FallbackTracker)
+	if !ok {
+		return
+	}
+
+	switch {
+	case result.Provenance.Source == service.SourceFallback:
+		now := time.Now().UTC()
+		recordEvent(ctx, EventRecord{Provider: providerName, Kind: EventFallbackUsed, At: now})
+		period, err := tracker.MarkFallback(ctx, providerName, now)
+		if err != nil {
+			log.Printf("Failed to track fallback of provider %s: %v", providerName, err)
+			return
+		}
+		if period.AlertedAt != nil || now.Sub(period.Since) < FallbackAlertAfter() {
+			return
+		}
+
+		log.Printf("Provider %s has been served from its fallback snapshot since %s", providerName, period.Since.Format(time.RFC3339))
+		Notify(ctx, FallbackServed{EventInfo: newEventInfo(providerName), Since: period.Since, Categories: result.Provenance.FallbackCategories})
+		if err := tracker.MarkFallbackAlerted(ctx, providerName, now); err != nil {
+			log.Printf("Failed to record fallback alert of provider %s: %v", providerName, err)
+		}
+	case result.Provenance.Source == service.SourceLive && len(result.Errors) == 0:
+		resolveNotifications(ctx, providerName, EventFallbackServed)
+		if err := tracker.ClearFallback(ctx, providerName); err != nil {
+			log.Printf("Failed to clear fallback of provider %s: %v", providerName, err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package lib
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sb-nour/providers-endpoints/service"
+)
+
+func TestCachedProviderFunctionKeepsProvenance(t *testing.T) {
+	ctx := context.Background()
+
+	for backend, open := range openTestCaches(t) {
+		t.Run(backend, func(t *testing.T) {
+			useTestCache(t, open())
+
+			live := service.Provenance{
+				Source:          service.SourceLive,
+				SourceURLs:      []string{"https://example.com/regions"},
+				FetchDurationMS: 42,
+				ParserVersion:   "2",
+				Warnings:        []string{"skipped a region"},
+			}
+			fetch := CachedProviderFunction("Example Cloud", func(context.Context) service.FetchResult {
+				return service.FetchResult{Regions: testRegions("eu-1"), Warnings: live.Warnings, Provenance: live}
+			})
+
+			if got := fetch(ctx).Provenance; !reflect.DeepEqual(got, live) {
+				t.Errorf("provenance of the live fetch = %+v, want %+v", got, live)
+			}
+
+			entry, found, err := cache.Get(ctx, "Example Cloud")
+			if err != nil || !found {
+				t.Fatalf("Get = %v, %v", found, err)
+			}
+			if !reflect.DeepEqual(entry.Provenance, live) {
+				t.Errorf("cached provenance = %+v, want %+v", entry.Provenance, live)
+			}
+
+			want := live
+			want.Source = service.SourceCache
+			if got := fetch(ctx).Provenance; !reflect.DeepEqual(got, want) {
+				t.Errorf("provenance served from the cache = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestTrackFallback(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("FALLBACK_ALERT_AFTER", "1ns")
+	t.Setenv("SLACK_WEBHOOK_URL", "")
+
+	fallback := service.FetchResult{Provenance: service.Provenance{Source: service.SourceFallback}}
+	live := service.FetchResult{Provenance: service.Provenance{Source: service.SourceLive}}
+
+	for backend, open := range openTestCaches(t) {
+		t.Run(backend, func(t *testing.T) {
+			useTestCache(t, open())
+			tracker := cache.(FallbackTracker)
+
+			// The period starts with the first fallback and is alerted on once
+			// it is older than FALLBACK_ALERT_AFTER
+			trackFallback(ctx, "Example Cloud", fallback)
+			trackFallback(ctx, "Example Cloud", fallback)
+			period, err := tracker.MarkFallback(ctx, "Example Cloud", time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if period.AlertedAt == nil || !period.Since.Before(*period.AlertedAt) {
+				t.Errorf("period = %+v, want it alerted on after it started", period)
+			}
+
+			// A complete live fetch ends it
+			trackFallback(ctx, "Example Cloud", live)
+			next, err := tracker.MarkFallback(ctx, "Example Cloud", time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !next.Since.After(period.Since) || next.AlertedAt != nil {
+				t.Errorf("period after a live fetch = %+v, want a new one", next)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sb-nour/providers-endpoints/service"
+)
+
+// Defaults of the sanity rules, unless SANITY_MIN_REGIONS and SANITY_MAX_DROP
+// are set.
+const (
+	DefaultSanityMinRegions     = 1
+	DefaultSanityMaxDropPercent = 50
+)
+
+// SanityRulesFor returns the sanity rules of the provider with the given name.
+// The rules it was registered with are overridden by SANITY_MIN_REGIONS_<ID>,
+// SANITY_MAX_DROP_<ID> (a percentage) and SANITY_REQUIRED_<ID> (a comma
+// separated list of category:code, e.g. "storage:us-east-1,compute:us-east-1"),
+// where <ID> is the upper-cased provider ID. Fields still unset come from
+// SANITY_MIN_REGIONS and SANITY_MAX_DROP.
+func SanityRulesFor(providerName string) service.SanityRules {
+	var rules service.SanityRules
+	if p, ok := registeredProvider(providerName); ok {
+		rules = service.ProviderSanityRules(p.ID())
+
+		key := strings.ToUpper(strings.ReplaceAll(p.ID(), "-", "_"))
+		if n, ok := envInt("SANITY_MIN_REGIONS_" + key); ok {
+			rules.MinRegions = n
+		}
+		if n, ok := envInt("SANITY_MAX_DROP_" + key); ok {
+			rules.MaxDropPercent = n
+		}
+		if value := os.Getenv("SANITY_REQUIRED_" + key); value != "" {
+			rules.Required = requiredCodes(value)
+		}
+	}
+
+	if rules.MinRegions == 0 {
+		rules.MinRegions = DefaultSanityMinRegions
+		if n, ok := envInt("SANITY_MIN_REGIONS"); ok {
+			rules.MinRegions = n
+		}
+	}
+	if rules.MaxDropPercent == 0 {
+		rules.MaxDropPercent = DefaultSanityMaxDropPercent
+		if n, ok := envInt("SANITY_MAX_DROP"); ok {
+			rules.MaxDropPercent = n
+		}
+	}
+	return rules
+}
+
+// requiredCodes parses a list of category:code pairs.
+func requiredCodes(value string) map[service.Category][]string {
+	required := make(map[service.Category][]string)
+	for _, item := range strings.Split(value, ",") {
+		category, code, ok := strings.Cut(strings.TrimSpace(item), ":")
+		if !ok || category == "" || code == "" {
+			log.Printf("Ignoring required region %q, expected category:code", item)
+			continue
+		}
+		required[service.Category(category)] = append(required[service.Category(category)], code)
+	}
+	return required
+}
+
+// sanityViolation is a category of fetched regions that failed a sanity rule.
+type sanityViolation struct {
+	category service.Category
+	reason   string
+}
+
+func (v sanityViolation) String() string {
+	return fmt.Sprintf("%s %s", v.category, v.reason)
+}
+
+// checkSanity returns the sanity rules the fetched regions of a provider
+// break, which suggest a broken scraper rather than real changes, comparing
+// them with its cache entry if it has one. Categories that failed are not
+// checked.
+func checkSanity(providerName string, result service.FetchResult, entry *CacheEntry) []sanityViolation {
+	rules := SanityRulesFor(providerName)
+
+	categories := result.Regions.Categories()
+	if p, ok := registeredProvider(providerName); ok {
+		categories = p.Categories()
+	}
+
+	var violations []sanityViolation
+	for _, category := range categories {
+		if _, failed := result.Errors[category]; failed {
+			continue
+		}
+		regions := result.Regions.Category(category)
+
+		if len(regions) < rules.MinRegions {
+			violations = append(violations, sanityViolation{category,
+				fmt.Sprintf("has %d regions, fewer than %d", len(regions), rules.MinRegions)})
+		}
+		if entry != nil {
+			if cached := len(entry.Regions.Category(category)); cached > 0 && len(regions) < cached {
+				if drop := (cached - len(regions)) * 100 / cached; drop > rules.MaxDropPercent {
+					violations = append(violations, sanityViolation{category,
+						fmt.Sprintf("dropped from %d to %d regions (%d%%, more than %d%%)", cached, len(regions), drop, rules.MaxDropPercent)})
+				}
+			}
+		}
+		var missing []string
+		for _, code := range rules.Required[category] {
+			if _, ok := regions[code]; !ok {
+				missing = append(missing, code)
+			}
+		}
+		if len(missing) > 0 {
+			violations = append(violations, sanityViolation{category, "is missing " + strings.Join(missing, ", ")})
+		}
+	}
+	return violations
+}
+
+// QuarantinedResult is fetched regions of a provider that failed the sanity
+// rules, kept for inspection instead of being cached.
+type QuarantinedResult struct {
+	Provider      string          `json:"provider"`
+	RegionsHash   string          `json:"regions_hash"`
+	Regions       service.Regions `json:"regions"`
+	Reasons       []string        `json:"reasons"`
+	QuarantinedAt time.Time       `json:"quarantined_at"`
+}
+
+// Quarantine is implemented by caches that keep the latest quarantined result
+// of each provider.
+type Quarantine interface {
+	// QuarantinedResult returns the quarantined result of a provider, if it
+	// has one.
+	QuarantinedResult(ctx context.Context, provider string) (*QuarantinedResult, bool, error)
+	// PutQuarantinedResult stores the quarantined result of a provider.
+	PutQuarantinedResult(ctx context.Context, result QuarantinedResult) error
+	// DeleteQuarantinedResult removes the quarantined result of a provider.
+	DeleteQuarantinedResult(ctx context.Context, provider string) error
+	// QuarantinedResults lists every quarantined result, by provider name.
+	QuarantinedResults(ctx context.Context) ([]QuarantinedResult, error)
+}
+
+// SanityError is the error of a category whose fetched regions failed the
+// sanity rules and that has no cached regions to serve instead.
+type SanityError struct {
+	Reasons []string
+}
+
+func (e *SanityError) Error() string {
+	return "probable scraper breakage: " + strings.Join(e.Reasons, "; ")
+}
+
+// quarantine keeps a result that failed the sanity rules out of the cache and
+// returns what to serve instead: the cached regions if there are any, or the
+// result with the suspicious categories failed, so that they are filled from
+// the fallback snapshot. Repeated notifications of the same suspicious result
+// are throttled by Notify.
+func quarantine(ctx context.Context, providerName string, result service.FetchResult, entry *CacheEntry, violations []sanityViolation) service.FetchResult {
+	reasons := make([]string, 0, len(violations))
+	for _, violation := range violations {
+		reasons = append(reasons, violation.String())
+	}
+	log.Printf("Quarantining regions of provider %s: %s", providerName, strings.Join(reasons, "; "))
+
+	quarantined := QuarantinedResult{
+		Provider:      providerName,
+		RegionsHash:   hashRegions(result.Regions),
+		Regions:       result.Regions,
+		Reasons:       reasons,
+		QuarantinedAt: time.Now().UTC(),
+	}
+	if q, ok := cache.(Quarantine); ok {
+		previous, found, err := q.QuarantinedResult(ctx, providerName)
+		if err != nil {
+			log.Printf("Failed to check quarantine of provider %s: %v", providerName, err)
+		}
+		// Keep when the same result was first quarantined
+		if !found || previous.RegionsHash != quarantined.RegionsHash {
+			if err := q.PutQuarantinedResult(ctx, quarantined); err != nil {
+				log.Printf("Failed to quarantine regions of provider %s: %v", providerName, err)
+			}
+		}
+	}
+	Notify(ctx, SuspiciousResult{EventInfo: newEventInfo(providerName), Reasons: reasons})
+
+	err := &SanityError{Reasons: reasons}
+	if entry != nil {
+		served := cachedResult(entry, entry.Expired())
+		served.Warn("serving the last good regions: %v", err)
+		return served
+	}
+
+	// Without cached regions, fail the suspicious categories only
+	for _, violation := range violations {
+		result.Regions.SetCategory(violation.category, nil)
+		result.SetError(violation.category, err)
+	}
+	result.Warn("%v", err)
+	return result
+}
+
+// releaseQuarantine drops the quarantined result of a provider once its
+// regions pass the sanity rules again.
+func releaseQuarantine(ctx context.Context, providerName string) {
+	resolveNotifications(ctx, providerName, EventSuspiciousResult)
+
+	q, ok := cache.(Quarantine)
+	if !ok {
+		return
+	}
+	if err := q.DeleteQuarantinedResult(ctx, providerName); err != nil {
+		log.Printf("Failed to release quarantine of provider %s: %v", providerName, err)
+	}
+}
+
+// QuarantinedResults lists the quarantined result of every provider, if the
+// cache keeps them.
+func QuarantinedResults(ctx context.Context) ([]QuarantinedResult, error) {
+	q, ok := cache.(Quarantine)
+	if !ok {
+		return nil, fmt.Errorf("the %s cache backend does not keep quarantined results", CacheBackend())
+	}
+	return q.QuarantinedResults(ctx)
+}
@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sb-nour/providers-endpoints/service"
+)
+
+func TestSanityRulesFor(t *testing.T) {
+	t.Setenv("SANITY_MAX_DROP", "30")
+	t.Setenv("SANITY_MIN_REGIONS_AWS", "10")
+	t.Setenv("SANITY_REQUIRED_AWS", "storage:eu-west-1, compute:eu-west-1,bogus")
+
+	rules := SanityRulesFor("Amazon AWS")
+	want := service.SanityRules{
+		MinRegions:     10,
+		MaxDropPercent: 30,
+		Required: map[service.Category][]string{
+			service.CategoryStorage: {"eu-west-1"},
+			service.CategoryCompute: {"eu-west-1"},
+		},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("SanityRulesFor(Amazon AWS) = %+v, want %+v", rules, want)
+	}
+
+	if rules := SanityRulesFor("Example Cloud"); rules.MinRegions != DefaultSanityMinRegions || rules.MaxDropPercent != 30 {
+		t.Errorf("SanityRulesFor(Example Cloud) = %+v, want the global defaults", rules)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	ctx := context.Background()
+
+	var notifications atomic.Int32
+	slack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notifications.Add(1)
+	}))
+	defer slack.Close()
+	t.Setenv("SLACK_WEBHOOK_URL", slack.URL)
+
+	for backend, open := range openTestCaches(t) {
+		t.Run(backend, func(t *testing.T) {
+			useTestCache(t, open())
+			notifications.Store(0)
+
+			good := newCacheEntry("Example Cloud", testRegions("eu-1", "eu-2", "eu-3", "eu-4"), CachePolicyFor("Example Cloud"))
+			if err := cache.Put(ctx, good); err != nil {
+				t.Fatal(err)
+			}
+
+			regions := testRegions("eu-1")
+			fetch := func(context.Context) service.FetchResult {
+				return service.FetchResult{Regions: regions}
+			}
+
+			// A sudden drop is quarantined and the last good regions served,
+			// with a single notification for the same suspicious result
+			for i := 0; i < 2; i++ {
+				result := refreshProvider(ctx, "Example Cloud", fetch, &good)
+				if !reflect.DeepEqual(result.Regions, good.Regions) || len(result.Warnings) != 1 {
+					t.Errorf("result of a suspicious fetch = %+v, want the cached regions and a warning", result)
+				}
+			}
+			waitForDeliveries()
+			if n := notifications.Load(); n != 1 {
+				t.Errorf("sent %d notifications, want 1", n)
+			}
+			entry, _, err := cache.Get(ctx, "Example Cloud")
+			if err != nil || entry.RegionsHash != good.RegionsHash {
+				t.Errorf("cached entry = %+v, %v, want the last good one", entry, err)
+			}
+			quarantined, err := QuarantinedResults(ctx)
+			if err != nil || len(quarantined) != 1 || len(quarantined[0].Regions.Category(service.CategoryStorage)) != 1 {
+				t.Fatalf("QuarantinedResults = %+v, %v, want the suspicious result", quarantined, err)
+			}
+
+			// Regions that pass again are cached and release the quarantine
+			regions = testRegions("eu-1", "eu-2", "eu-3")
+			if result := refreshProvider(ctx, "Example Cloud", fetch, &good); len(result.Warnings) != 0 {
+				t.Errorf("warnings of a sane fetch = %v, want none", result.Warnings)
+			}
+			if quarantined, err := QuarantinedResults(ctx); err != nil || len(quarantined) != 0 {
+				t.Errorf("QuarantinedResults after a sane fetch = %+v, %v, want none", quarantined, err)
+			}
+			entry, _, err = cache.Get(ctx, "Example Cloud")
+			if err != nil || entry.RegionsHash != hashRegions(regions) {
+				t.Errorf("cached entry after a sane fetch = %+v, %v, want the new regions", entry, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sb-nour/providers-endpoints/service"
+)
+
+// Leaser is implemented by caches shared between instances, so that a single
+// instance refreshes a provider at a time. A lease is held by an owner until
+// it is released or expires.
+type Leaser interface {
+	// AcquireLease takes the named lease for ttl, or extends it if owner
+	// already holds it. It reports false if another owner holds it.
+	AcquireLease(ctx context.Context, name, owner string, ttl time.Duration) (bool, error)
+	// ReleaseLease releases the named lease if owner holds it.
+	ReleaseLease(ctx context.Context, name, owner string) error
+}
+
+// leaseMargin is added to the provider timeout to get the lease TTL, so that
+// a lease outlives the refresh it guards. Leases are not renewed: a refresh
+// is bound to the provider timeout, so the lease must be taken for longer.
+const leaseMargin = 30 * time.Second
+
+// leasePollInterval is how often an instance waiting for another instance's
+// refresh checks the cache.
+var leasePollInterval = 500 * time.Millisecond
+
+// instanceID identifies this process as a lease owner.
+var instanceID = newInstanceID()
+
+func newInstanceID() string {
+	host, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(suffix))
+}
+
+// flightGroup runs a single refresh per provider at a time. Callers arriving
+// while a refresh is running wait for it and share its result.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	done   chan struct{}
+	result service.FetchResult
+}
+
+var refreshFlights = &flightGroup{flights: make(map[string]*flight)}
+
+// do runs fn in the background unless a call for key is already running, and
+// waits for it until ctx is done. It reports whether the result came from
+// another caller's call, and whether ctx was done first, leaving the call
+// running for the other callers. The call is waited for by WaitForRefreshes.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() service.FetchResult) (result service.FetchResult, shared, abandoned bool) {
+	g.mu.Lock()
+	f, shared := g.flights[key]
+	if !shared {
+		f = &flight{done: make(chan struct{})}
+		g.flights[key] = f
+
+		refreshes.Add(1)
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Refresh of provider %s panicked: %v", key, r)
+					f.result = failedResult(key, fmt.Errorf("provider panicked: %v", r))
+				}
+				g.mu.Lock()
+				delete(g.flights, key)
+				g.mu.Unlock()
+				close(f.done)
+				refreshes.Done()
+			}()
+			f.result = fn()
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.result, shared, false
+	case <-ctx.Done():
+		return service.FetchResult{}, shared, true
+	}
+}
+
+// refreshOnce refreshes a provider, joining a refresh of the same provider
+// already running in this process, and taking the provider's lease so that
+// no other instance refreshes it at the same time. A caller whose ctx is done
+// first gets the expired entry while the refresh goes on for the others.
+func refreshOnce(ctx context.Context, providerName string, originalFunc func(context.Context) service.FetchResult, entry *CacheEntry) service.FetchResult {
+	result, shared, abandoned := refreshFlights.do(ctx, providerName, func() service.FetchResult {
+		// The refresh is shared, so it must not end with the caller that
+		// started it
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), providerTimeout(providerName))
+		defer cancel()
+		return refreshWithLease(ctx, providerName, originalFunc, entry)
+	})
+	if abandoned {
+		log.Printf("Gave up waiting for the refresh of provider %s: %v", providerName, ctx.Err())
+		return abandonedRefresh(ctx, providerName, entry)
+	}
+	if !shared {
+		return result
+	}
+
+	// Every caller gets its own copy, as fallbacks are filled in place
+	log.Printf("Reusing the refresh of provider %s already in progress", providerName)
+	regions, err := cloneRegions(result.Regions)
+	if err != nil {
+		log.Printf("Failed to copy regions of provider %s: %v", providerName, err)
+	}
+	copied := result
+	copied.Regions = regions
+	copied.Errors = nil
+	for category, err := range result.Errors {
+		copied.SetError(category, err)
+	}
+	copied.Warnings = append([]string(nil), result.Warnings...)
+	return copied
+}
+
+// refreshWithLease refreshes a provider if it can take the provider's lease,
+// and otherwise waits for the instance holding it to cache fresh regions.
+func refreshWithLease(ctx context.Context, providerName string, originalFunc func(context.Context) service.FetchResult, entry *CacheEntry) service.FetchResult {
+	leaser, ok := cache.(Leaser)
+	if !ok {
+		return refreshProvider(ctx, providerName, originalFunc, entry)
+	}
+
+	lease := "refresh:" + providerName
+	ttl := providerTimeout(providerName) + leaseMargin
+	for {
+		acquired, err := leaser.AcquireLease(ctx, lease, instanceID, ttl)
+		if err != nil {
+			// Refreshing twice is better than not refreshing at all
+			log.Printf("Failed to acquire refresh lease for provider %s: %v", providerName, err)
+			return refreshProvider(ctx, providerName, originalFunc, entry)
+		}
+		if acquired {
+			defer func() {
+				if err := leaser.ReleaseLease(context.Background(), lease, instanceID); err != nil {
+					log.Printf("Failed to release refresh lease for provider %s: %v", providerName, err)
+				}
+			}()
+			return refreshProvider(ctx, providerName, originalFunc, entry)
+		}
+
+		log.Printf("Provider %s is being refreshed by another instance, waiting", providerName)
+		select {
+		case <-time.After(leasePollInterval):
+		case <-ctx.Done():
+			return abandonedRefresh(ctx, providerName, entry)
+		}
+
+		current, found, err := cache.Get(ctx, providerName)
+		if err != nil {
+			log.Printf("Error checking cache for provider %s: %v", providerName, err)
+			continue
+		}
+		if found && (entry == nil || current.CreatedAt.After(entry.CreatedAt)) {
+			log.Printf("Using regions of provider %s refreshed by another instance", providerName)
+			return cachedResult(current, false)
+		}
+	}
+}
+
+// abandonedRefresh is the result of a refresh given up on while waiting for
+// it: the expired entry if there is one, or an error for every category of
+// the provider.
+func abandonedRefresh(ctx context.Context, providerName string, entry *CacheEntry) service.FetchResult {
+	if entry != nil {
+		return cachedResult(entry, true)
+	}
+
+	result := failedResult(providerName, ctx.Err())
+	result.Warn("gave up waiting for the regions to be refreshed: %v", ctx.Err())
+	return result
+}
+
+// failedResult is a result with err for every category of the provider.
+func failedResult(providerName string, err error) service.FetchResult {
+	var result service.FetchResult
+	if p, ok := registeredProvider(providerName); ok {
+		for _, category := range p.Categories() {
+			result.SetError(category, err)
+		}
+	}
+	return result
+}
@@ -0,0 +1,135 @@
+package lib
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sb-nour/providers-endpoints/service"
+)
+
+func TestConcurrentRefreshesFetchOnce(t *testing.T) {
+	useTestCache(t, newMemoryCache())
+
+	var fetches atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	fetch := CachedProviderFunction("Example Cloud", func(context.Context) service.FetchResult {
+		if fetches.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return service.FetchResult{Regions: testRegions("eu-1")}
+	})
+
+	results := make([]service.FetchResult, 5)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = fetch(context.Background())
+		}(i)
+	}
+
+	<-started
+	time.Sleep(50 * time.Millisecond) // let the other callers join the refresh
+	close(release)
+	wg.Wait()
+
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("fetched %d times, want 1", n)
+	}
+	for i, result := range results {
+		if len(result.Regions.Category(service.CategoryStorage)) != 1 {
+			t.Errorf("caller %d got %v, want the fetched regions", i, result.Regions)
+		}
+	}
+}
+
+func TestAbandonedRefreshGoesOn(t *testing.T) {
+	useTestCache(t, newMemoryCache())
+
+	started, release := make(chan struct{}), make(chan struct{})
+	var fetchErr error
+	fetch := CachedProviderFunction("Example Cloud", func(ctx context.Context) service.FetchResult {
+		close(started)
+		<-release
+		fetchErr = ctx.Err()
+		return service.FetchResult{Regions: testRegions("eu-1")}
+	})
+
+	// The caller that started the refresh gives up on it
+	ctx, cancel := context.WithCancel(context.Background())
+	abandoned := make(chan service.FetchResult)
+	go func() { abandoned <- fetch(ctx) }()
+	<-started
+	cancel()
+	if result := <-abandoned; result.Err() == nil && len(result.Regions) != 0 {
+		t.Errorf("abandoned caller got %v, want no regions", result.Regions)
+	}
+
+	// while another one still gets its result
+	joined := make(chan service.FetchResult)
+	go func() { joined <- fetch(context.Background()) }()
+	time.Sleep(50 * time.Millisecond) // let the caller join the refresh
+	close(release)
+	if result := <-joined; len(result.Regions.Category(service.CategoryStorage)) != 1 {
+		t.Errorf("joined caller got %v, want the fetched regions", result.Regions)
+	}
+	WaitForRefreshes()
+	if fetchErr != nil {
+		t.Errorf("refresh ended with %v, want it to outlive the caller that started it", fetchErr)
+	}
+	if _, found, err := cache.Get(context.Background(), "Example Cloud"); err != nil || !found {
+		t.Errorf("regions not cached: %v", err)
+	}
+}
+
+func TestRefreshWaitsForLeaseHolder(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "cache.db")
+	open := func() *sqlCache {
+		c, err := openSQLCache("sqlite", path, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	other, ours := open(), open()
+
+	useTestCache(t, ours)
+	interval := leasePollInterval
+	leasePollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { leasePollInterval = interval })
+
+	// Another instance holds the lease and is refreshing the provider
+	if ok, err := other.AcquireLease(ctx, "refresh:Example Cloud", "other", time.Minute); err != nil || !ok {
+		t.Fatalf("AcquireLease = %v, %v", ok, err)
+	}
+	if ok, _ := ours.AcquireLease(ctx, "refresh:Example Cloud", instanceID, time.Minute); ok {
+		t.Fatal("took a lease held by another instance")
+	}
+
+	var fetches atomic.Int32
+	done := make(chan service.FetchResult)
+	go func() {
+		done <- CachedProviderFunction("Example Cloud", func(context.Context) service.FetchResult {
+			fetches.Add(1)
+			return service.FetchResult{Regions: testRegions("us-1")}
+		})(ctx)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if err := other.Put(ctx, newCacheEntry("Example Cloud", testRegions("eu-1", "eu-2"), CachePolicyFor("Example Cloud"))); err != nil {
+		t.Fatal(err)
+	}
+
+	result := <-done
+	if fetches.Load() != 0 || len(result.Regions.Category(service.CategoryStorage)) != 2 {
+		t.Errorf("fetched %d times and got %v, want the other instance's regions", fetches.Load(), result.Regions)
+	}
+}
@@ -1,21 +1,21 @@
 package lib
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
-	"time"
-
-	"github.com/sb-nour/providers-endpoints/service"
+	"strings"
 )
 
 type SlackMessage struct {
 	Text        string            `json:"text,omitempty"`
 	Channel     string            `json:"channel,omitempty"`
 	Attachments []SlackAttachment `json:"attachments,omitempty"`
+	Blocks      []SlackBlock      `json:"blocks,omitempty"`
+	// ThreadTS posts the message as a reply in the thread of another one.
+	ThreadTS string `json:"thread_ts,omitempty"`
 }
 
 type SlackAttachment struct {
@@ -32,6 +32,21 @@ type SlackField struct {
 	Short bool   `json:"short"`
 }
 
+// SlackBlock is a Block Kit header, section, context or divider block.
+type SlackBlock struct {
+	Type     string      `json:"type"`
+	Text     *SlackText  `json:"text,omitempty"`
+	Fields   []SlackText `json:"fields,omitempty"`
+	Elements []SlackText `json:"elements,omitempty"`
+}
+
+// SlackText is a Block Kit text object, "plain_text" or "mrkdwn".
+type SlackText struct {
+	Type  string `json:"type"`
+	Text  string `json:"text"`
+	Emoji bool   `json:"emoji,omitempty"`
+}
+
 func SendSlackNotification(webhookURL, message string) error {
 	return SendSlackNotificationWithChannel(webhookURL, message, "")
 }
@@ -42,215 +57,250 @@ func SendSlackNotificationWithChannel(webhookURL, message, channel string) error
 		return nil
 	}
 
-	slackMessage := SlackMessage{
-		Text:    message,
-		Channel: channel,
-	}
-
-	jsonData, err := json.Marshal(slackMessage)
-	if err != nil {
-		return fmt.Errorf("failed to marshal slack message: %w", err)
-	}
-
-	resp, err := http.Post(webhookURL, "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
+	if err := postJSON(context.Background(), webhookURL, SlackMessage{Text: message, Channel: channel}); err != nil {
 		return fmt.Errorf("failed to send slack notification: %w", err)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("slack notification failed with status: %d", resp.StatusCode)
-	}
 
 	log.Printf("Slack notification sent successfully")
 	return nil
 }
 
-func SendRegionsFetchErrorNotification(provider string, err error) {
-	webhookURL := os.Getenv("SLACK_WEBHOOK_URL")
-	if webhookURL == "" {
-		return
-	}
+// Limits of Slack messages: the blocks of a message, the fields of a section,
+// and the length of a header, a section's text and a field. Blocks past them
+// make Slack reject the whole message as invalid_blocks.
+const (
+	slackMaxBlocks       = 50
+	slackMaxFields       = 10
+	slackMaxHeaderLength = 150
+	slackMaxTextLength   = 3000
+	slackMaxFieldLength  = 2000
+)
 
-	// Check for error-specific channel override
-	var errorChannel string
-	if envChannel := os.Getenv("SLACK_ERROR_CHANNEL"); envChannel != "" {
-		errorChannel = fmt.Sprintf("#%s", envChannel)
-	}
+// slackAPIURL is the base URL of the Slack Web API.
+var slackAPIURL = "https://slack.com/api"
 
-	message := SlackMessage{
-		Channel: errorChannel,
-		Attachments: []SlackAttachment{
-			{
-				Color: "danger",
-				Title: "🚨 Provider Regions Fetch Failed",
-				Text:  fmt.Sprintf("Failed to fetch regions for provider: *%s*", provider),
-				Fields: []SlackField{
-					{
-						Title: "Provider",
-						Value: provider,
-						Short: true,
-					},
-					{
-						Title: "Error",
-						Value: err.Error(),
-						Short: false,
-					},
-					{
-						Title: "Timestamp",
-						Value: time.Now().Format("2006-01-02 15:04:05"),
-						Short: true,
-					},
-				},
-				Timestamp: time.Now().Unix(),
-			},
-		},
-	}
+var slackMarkup = markup{
+	bold: func(text string) string { return "*" + text + "*" },
+	code: func(text string) string { return "`" + text + "`" },
+	link: func(url, text string) string { return "<" + url + "|" + text + ">" },
+	text: slackEscape,
+}
 
-	jsonData, marshalErr := json.Marshal(message)
-	if marshalErr != nil {
-		log.Printf("Failed to marshal slack message for provider %s: %v", provider, marshalErr)
-		return
-	}
+// slackEscape escapes the characters that are markup in Slack's mrkdwn.
+func slackEscape(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+// slackNotifier posts events to Slack as Block Kit messages, sending failures
+// to SLACK_ERROR_CHANNEL and region changes to SLACK_CHANGES_CHANNEL when
+// they are set. With a bot token it posts through the Web API instead of an
+// incoming webhook, which lets it add the full diff of long region changes
+// as replies in the thread of the message.
+type slackNotifier struct {
+	url   string
+	token string
+}
 
-	resp, postErr := http.Post(webhookURL, "application/json", bytes.NewBuffer(jsonData))
-	if postErr != nil {
-		log.Printf("Failed to send slack notification for provider %s: %v", provider, postErr)
-		return
+func (n *slackNotifier) Name() string { return NotifierSlack }
+
+func (n *slackNotifier) Notify(ctx context.Context, event Event) error {
+	threaded := n.token != ""
+	message := messageFor(event, slackMarkup)
+	blocks := slackBlocks(message)
+	var replies [][]SlackBlock
+	if e, ok := event.(RegionsChanged); ok {
+		blocks, replies = slackChangesBlocks(e, message, threaded)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Slack notification failed for provider %s with status: %d", provider, resp.StatusCode)
-		return
+	channel := slackChannel(event)
+	slackMessage := SlackMessage{Text: message.Title, Channel: channel, Blocks: blocks}
+	if !threaded {
+		return postJSON(ctx, n.url, slackMessage)
 	}
 
-	log.Printf("Sent regions fetch error notification for provider: %s", provider)
+	if channel == "" {
+		channel = os.Getenv("SLACK_CHANNEL")
+	}
+	if channel == "" {
+		return fmt.Errorf("SLACK_CHANNEL must be set to post with SLACK_BOT_TOKEN")
+	}
+	slackMessage.Channel = channel
+	ts, err := n.postMessage(ctx, slackMessage)
+	if err != nil {
+		return err
+	}
+	// The message is delivered once posted: failing it for a reply would post
+	// it again when the delivery is retried
+	for _, reply := range replies {
+		if _, err := n.postMessage(ctx, SlackMessage{Text: "Full diff", Channel: channel, Blocks: reply, ThreadTS: ts}); err != nil {
+			log.Printf("Failed to post the full diff of provider %s in the thread of its Slack message: %v", event.Info().Provider, err)
+			break
+		}
+	}
+	return nil
 }
 
-func SendRegionsChangedNotification(provider string, oldRegions, newRegions service.Regions) {
-	webhookURL := os.Getenv("SLACK_WEBHOOK_URL")
-	if webhookURL == "" {
-		return
+// postMessage posts a message with chat.postMessage and returns its ts, the
+// ID replies in its thread refer to.
+func (n *slackNotifier) postMessage(ctx context.Context, message SlackMessage) (string, error) {
+	req, err := newJSONRequest(ctx, slackAPIURL+"/chat.postMessage", message)
+	if err != nil {
+		return "", err
 	}
+	req.Header.Set("Authorization", "Bearer "+n.token)
 
-	// Check for changes-specific channel override
-	var changesChannel string
-	if envChannel := os.Getenv("SLACK_CHANGES_CHANNEL"); envChannel != "" {
-		changesChannel = fmt.Sprintf("#%s", envChannel)
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send notification: %w", err)
 	}
+	defer resp.Body.Close()
 
-	// Calculate changes
-	storageChanges := calculateRegionChanges(oldRegions.Storage, newRegions.Storage)
-	computeChanges := calculateRegionChanges(oldRegions.Compute, newRegions.Compute)
+	var response struct {
+		OK    bool   `json:"ok"`
+		TS    string `json:"ts"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", fmt.Errorf("notification failed with status %d: %w", resp.StatusCode, err)
+	}
+	if !response.OK {
+		return "", fmt.Errorf("slack API error: %s", response.Error)
+	}
+	return response.TS, nil
+}
 
-	var changeDetails []string
-	if len(storageChanges) > 0 {
-		changeDetails = append(changeDetails, fmt.Sprintf("*Storage regions:* %s", storageChanges))
+// slackChannel returns the channel override of an event, or "" to post to the
+// webhook's own channel.
+func slackChannel(event Event) string {
+	env := "SLACK_ERROR_CHANNEL"
+	if event.Kind() == EventRegionsChanged {
+		env = "SLACK_CHANGES_CHANNEL"
 	}
-	if len(computeChanges) > 0 {
-		changeDetails = append(changeDetails, fmt.Sprintf("*Compute regions:* %s", computeChanges))
+	if envChannel := os.Getenv(env); envChannel != "" {
+		return fmt.Sprintf("#%s", envChannel)
 	}
+	return ""
+}
 
-	changeText := "No specific changes detected"
-	if len(changeDetails) > 0 {
-		changeText = fmt.Sprintf("%s", changeDetails[0])
-		if len(changeDetails) > 1 {
-			changeText += fmt.Sprintf("\n%s", changeDetails[1])
+// slackBlocks lays out a message as a header, its text with the short fields
+// alongside, and a section for every long field, cutting the text that is
+// longer than Slack takes.
+func slackBlocks(message eventMessage) []SlackBlock {
+	blocks := []SlackBlock{slackHeader(message.Title)}
+	text := slackSection(message.Text)
+	var long []SlackBlock
+	for _, field := range message.Fields {
+		value := fmt.Sprintf("*%s*\n%s", field.Title, field.Value)
+		if field.Short && len(text.Fields) < slackMaxFields {
+			text.Fields = append(text.Fields, SlackText{Type: "mrkdwn", Text: slackTruncate(value, slackMaxFieldLength)})
+		} else {
+			long = append(long, slackSection(value))
 		}
 	}
+	return append(append(blocks, text), long...)
+}
 
-	message := SlackMessage{
-		Channel: changesChannel,
-		Attachments: []SlackAttachment{
-			{
-				Color: "warning",
-				Title: "🔄 Provider Regions Changed",
-				Text:  fmt.Sprintf("Regions have changed for provider: *%s*", provider),
-				Fields: []SlackField{
-					{
-						Title: "Provider",
-						Value: provider,
-						Short: true,
-					},
-					{
-						Title: "Storage Regions Count",
-						Value: fmt.Sprintf("Old: %d → New: %d", len(oldRegions.Storage), len(newRegions.Storage)),
-						Short: true,
-					},
-					{
-						Title: "Compute Regions Count",
-						Value: fmt.Sprintf("Old: %d → New: %d", len(oldRegions.Compute), len(newRegions.Compute)),
-						Short: true,
-					},
-					{
-						Title: "Changes",
-						Value: changeText,
-						Short: false,
-					},
-					{
-						Title: "Timestamp",
-						Value: time.Now().Format("2006-01-02 15:04:05"),
-						Short: true,
-					},
-				},
-				Timestamp: time.Now().Unix(),
-			},
-		},
+// slackChangesBlocks lays out the changes of a provider's regions with a
+// section for every kind of change in every category, listing the first
+// inlineChanges of each. If some were left out, the full diff is returned as
+// replies to post in the thread of the message when threaded, and otherwise
+// the message says how to get it.
+func slackChangesBlocks(e RegionsChanged, message eventMessage, threaded bool) ([]SlackBlock, [][]SlackBlock) {
+	changes := groupChanges(e.OldRegions, e.NewRegions, slackMarkup)
+	summary := slackSection(message.Text)
+	for _, c := range changes {
+		if len(summary.Fields) < slackMaxFields {
+			summary.Fields = append(summary.Fields, SlackText{Type: "mrkdwn",
+				Text: fmt.Sprintf("*%s Regions*\n%d → %d", categoryTitle(c.category), c.oldCount, c.newCount)})
+		}
 	}
+	blocks := []SlackBlock{slackHeader(message.Title), summary}
 
-	jsonData, marshalErr := json.Marshal(message)
-	if marshalErr != nil {
-		log.Printf("Failed to marshal slack message for provider %s: %v", provider, marshalErr)
-		return
+	truncated := false
+	var full []SlackBlock
+	for _, c := range changes {
+		if len(c.groups) == 0 {
+			continue
+		}
+		title := fmt.Sprintf("*%s regions*", categoryTitle(c.category))
+		if url := e.DocsURLs[c.category]; url != "" {
+			title += " · " + slackMarkup.link(url, "source documentation")
+		}
+		blocks = append(blocks, SlackBlock{Type: "divider"}, slackSection(title))
+		full = append(full, slackSection(title))
+
+		for _, group := range c.groups {
+			heading := fmt.Sprintf("*%s (%d)*", group.title, len(group.lines))
+			if len(group.lines) > inlineChanges {
+				truncated = true
+			}
+			blocks = append(blocks, slackSection(heading+"\n"+strings.Join(limitLines(group.lines, inlineChanges), "\n")))
+			for _, chunk := range chunkLines(group.lines, slackMaxTextLength-len(heading)-1) {
+				full = append(full, slackSection(heading+"\n"+chunk))
+			}
+		}
 	}
 
-	resp, postErr := http.Post(webhookURL, "application/json", bytes.NewBuffer(jsonData))
-	if postErr != nil {
-		log.Printf("Failed to send slack notification for provider %s: %v", provider, postErr)
-		return
+	footer := fmt.Sprintf("%s · %s", slackEscape(e.Provider), e.At.Format("2006-01-02 15:04:05"))
+	if truncated && !threaded {
+		footer += fmt.Sprintf(" · Run `go run main.go -provider %q changes` for the full diff", e.Provider)
+	} else if truncated {
+		footer += " · Full diff in the thread"
 	}
-	defer resp.Body.Close()
+	blocks = append(blocks, SlackBlock{Type: "context", Elements: []SlackText{{Type: "mrkdwn", Text: footer}}})
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Slack notification failed for provider %s with status: %d", provider, resp.StatusCode)
-		return
+	// A message only takes so many blocks: keep the summary and the context
+	if len(blocks) > slackMaxBlocks {
+		blocks = append(blocks[:slackMaxBlocks-2:slackMaxBlocks-2],
+			slackSection("_More categories changed than fit in this message._"), blocks[len(blocks)-1])
+		truncated = true
 	}
 
-	log.Printf("Sent regions changed notification for provider: %s", provider)
+	if !truncated || !threaded {
+		return blocks, nil
+	}
+	var replies [][]SlackBlock
+	for len(full) > 0 {
+		n := min(len(full), slackMaxBlocks)
+		replies = append(replies, full[:n])
+		full = full[n:]
+	}
+	return blocks, replies
 }
 
-func calculateRegionChanges(oldRegions, newRegions map[string]string) string {
-	var changes []string
-
-	// Find added regions
-	for key, value := range newRegions {
-		if _, exists := oldRegions[key]; !exists {
-			changes = append(changes, fmt.Sprintf("+ %s: %s", key, value))
+// chunkLines joins lines into chunks of at most size bytes.
+func chunkLines(lines []string, size int) []string {
+	var chunks []string
+	var chunk strings.Builder
+	for _, line := range lines {
+		if chunk.Len() > 0 && chunk.Len()+1+len(line) > size {
+			chunks = append(chunks, chunk.String())
+			chunk.Reset()
 		}
-	}
-
-	// Find removed regions
-	for key, value := range oldRegions {
-		if _, exists := newRegions[key]; !exists {
-			changes = append(changes, fmt.Sprintf("- %s: %s", key, value))
+		if chunk.Len() > 0 {
+			chunk.WriteString("\n")
 		}
+		chunk.WriteString(line)
 	}
-
-	// Find modified regions
-	for key, newValue := range newRegions {
-		if oldValue, exists := oldRegions[key]; exists && oldValue != newValue {
-			changes = append(changes, fmt.Sprintf("~ %s: %s → %s", key, oldValue, newValue))
-		}
+	if chunk.Len() > 0 {
+		chunks = append(chunks, chunk.String())
 	}
+	return chunks
+}
 
-	if len(changes) == 0 {
-		return "No changes detected"
-	}
+func slackHeader(text string) SlackBlock {
+	return SlackBlock{Type: "header", Text: &SlackText{Type: "plain_text", Text: slackTruncate(text, slackMaxHeaderLength), Emoji: true}}
+}
 
-	if len(changes) > 5 {
-		return fmt.Sprintf("%d changes detected (showing first 5): %v...", len(changes), changes[:5])
-	}
+func slackSection(text string) SlackBlock {
+	return SlackBlock{Type: "section", Text: &SlackText{Type: "mrkdwn", Text: slackTruncate(text, slackMaxTextLength)}}
+}
 
-	return fmt.Sprintf("%d changes: %v", len(changes), changes)
+// slackTruncate cuts text to at most limit characters, ending it with "…" if
+// it was longer.
+func slackTruncate(text string, limit int) string {
+	if runes := []rune(text); len(runes) > limit {
+		return string(runes[:limit-1]) + "…"
+	}
+	return text
 }
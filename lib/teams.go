@@ -0,0 +1,80 @@
+package lib
+
+import "context"
+
+// teamsMessage is a message with an Adaptive Card, as accepted by Microsoft
+// Teams workflow and incoming webhooks.
+type teamsMessage struct {
+	Type        string            `json:"type"`
+	Attachments []teamsAttachment `json:"attachments"`
+}
+
+type teamsAttachment struct {
+	ContentType string    `json:"contentType"`
+	Content     teamsCard `json:"content"`
+}
+
+type teamsCard struct {
+	Schema  string          `json:"$schema"`
+	Type    string          `json:"type"`
+	Version string          `json:"version"`
+	Body    []teamsCardItem `json:"body"`
+}
+
+// teamsCardItem is a TextBlock or a FactSet of an Adaptive Card.
+type teamsCardItem struct {
+	Type   string      `json:"type"`
+	Text   string      `json:"text,omitempty"`
+	Size   string      `json:"size,omitempty"`
+	Weight string      `json:"weight,omitempty"`
+	Color  string      `json:"color,omitempty"`
+	Wrap   bool        `json:"wrap,omitempty"`
+	Facts  []teamsFact `json:"facts,omitempty"`
+}
+
+type teamsFact struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+}
+
+// teamsColors are the Adaptive Card text colors of the message levels.
+var teamsColors = map[string]string{
+	levelDanger:  "attention",
+	levelWarning: "warning",
+	levelGood:    "good",
+}
+
+// teamsNotifier posts events to a Microsoft Teams channel as Adaptive Cards.
+type teamsNotifier struct {
+	url string
+}
+
+func (n *teamsNotifier) Name() string { return NotifierTeams }
+
+func (n *teamsNotifier) Notify(ctx context.Context, event Event) error {
+	message := messageFor(event, markdownMarkup)
+
+	facts := make([]teamsFact, 0, len(message.Fields))
+	for _, field := range message.Fields {
+		facts = append(facts, teamsFact{Title: field.Title, Value: field.Value})
+	}
+
+	return postJSON(ctx, n.url, teamsMessage{
+		Type: "message",
+		Attachments: []teamsAttachment{
+			{
+				ContentType: "application/vnd.microsoft.card.adaptive",
+				Content: teamsCard{
+					Schema:  "http://adaptivecards.io/schemas/adaptive-card.json",
+					Type:    "AdaptiveCard",
+					Version: "1.4",
+					Body: []teamsCardItem{
+						{Type: "TextBlock", Text: message.Title, Size: "Medium", Weight: "Bolder", Color: teamsColors[message.Level], Wrap: true},
+						{Type: "TextBlock", Text: message.Text, Wrap: true},
+						{Type: "FactSet", Facts: facts},
+					},
+				},
+			},
+		},
+	})
+}
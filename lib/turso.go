@@ -1,168 +1,1005 @@
 package lib
 
 import (
-	"crypto/sha256"
+	"context"
 	"database/sql"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/sb-nour/providers-endpoints/service"
 	_ "github.com/tursodatabase/libsql-client-go/libsql" // Register libsql driver
+	_ "modernc.org/sqlite"                               // Register sqlite driver
 )
 
-type CacheEntry struct {
-	Provider    string    `json:"provider"`
-	RegionsHash string    `json:"regions_hash"`
-	Regions     string    `json:"regions"`
-	CreatedAt   time.Time `json:"created_at"`
-	ExpiresAt   time.Time `json:"expires_at"`
+// sqlCache stores the cache in a SQL database, either Turso through libsql or
+// a local SQLite file.
+type sqlCache struct {
+	db *sql.DB
 }
 
-const (
-	CacheDuration = 24 * time.Hour // Cache for 24 hours
-)
+// InitTursoDB opens the Turso database configured by TURSO_DATABASE_URL and
+// TURSO_AUTH_TOKEN as the cache, regardless of CACHE_BACKEND, and applies the
+// pending schema migrations.
+func InitTursoDB() error {
+	c, err := openTursoCache(true)
+	if err != nil {
+		return err
+	}
+	if cache != nil {
+		cache.Close()
+	}
+	cache = c
+	return nil
+}
 
-var db *sql.DB
+// CloseTursoDB closes the cache opened by InitTursoDB.
+func CloseTursoDB() error {
+	return CloseCache()
+}
 
-func InitTursoDB() error {
+func openTursoCache(migrate bool) (*sqlCache, error) {
 	dbURL := os.Getenv("TURSO_DATABASE_URL")
 	authToken := os.Getenv("TURSO_AUTH_TOKEN")
 
 	if dbURL == "" {
-		return fmt.Errorf("TURSO_DATABASE_URL environment variable is required")
+		return nil, fmt.Errorf("TURSO_DATABASE_URL environment variable is required")
 	}
 
 	log.Printf("Attempting to connect to Turso DB: %s", dbURL)
 
-	var err error
 	if authToken != "" {
-		db, err = sql.Open("libsql", dbURL+"?authToken="+authToken)
-	} else {
-		db, err = sql.Open("libsql", dbURL)
+		dsn, err := dsnWithParam(dbURL, "authToken", authToken)
+		if err != nil {
+			return nil, err
+		}
+		return openSQLCache("libsql", dsn, migrate)
+	}
+	return openSQLCache("libsql", dbURL, migrate)
+}
+
+// dsnWithParam adds a query parameter to a database URL or file name, keeping
+// the parameters it already has.
+func dsnWithParam(dsn, key, value string) (string, error) {
+	base, query, _ := strings.Cut(dsn, "?")
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse database parameters: %w", err)
 	}
+	params.Add(key, value)
+	return base + "?" + params.Encode(), nil
+}
 
+// openSQLCache opens a database with the given driver, applying the pending
+// schema migrations if migrate is set.
+func openSQLCache(driver, dsn string, migrate bool) (*sqlCache, error) {
+	// Wait for the locks of other processes sharing a SQLite file rather than
+	// failing with SQLITE_BUSY
+	if driver == "sqlite" {
+		var err error
+		if dsn, err = dsnWithParam(dsn, "_pragma", "busy_timeout(5000)"); err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := sql.Open(driver, dsn)
 	if err != nil {
-		return fmt.Errorf("failed to open database: %w", err)
+		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
 	// Test the connection
 	if err := db.Ping(); err != nil {
-		return fmt.Errorf("failed to ping database: %w", err)
+		db.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	c := &sqlCache{db: db}
+	if migrate {
+		if _, err := c.Migrate(context.Background()); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to migrate database: %w", err)
+		}
+	}
+
+	return c, nil
+}
+
+func (c *sqlCache) Get(ctx context.Context, provider string) (*CacheEntry, bool, error) {
+	query := `
+		SELECT ` + cacheColumns + `
+		FROM provider_regions_cache
+		WHERE provider = ?
+	`
+
+	entry, err := scanCacheEntry(c.db.QueryRowContext(ctx, query, provider))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, false, nil // Cache miss
+		}
+		return nil, false, fmt.Errorf("failed to query cache: %w", err)
 	}
 
-	if err := createTable(); err != nil {
-		return fmt.Errorf("failed to create table: %w", err)
+	return &entry, true, nil
+}
+
+func (c *sqlCache) Put(ctx context.Context, entry CacheEntry) error {
+	if err := putEntry(ctx, c.db, entry); err != nil {
+		return err
 	}
 
+	log.Printf("Cached regions for provider: %s", entry.Provider)
 	return nil
 }
 
-func createTable() error {
+// sqlExecer is implemented by *sql.DB and *sql.Tx.
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// putEntry replaces the entry of a provider.
+func putEntry(ctx context.Context, db sqlExecer, entry CacheEntry) error {
+	regionsJSON, err := json.Marshal(entry.Regions)
+	if err != nil {
+		return fmt.Errorf("failed to marshal regions: %w", err)
+	}
+	provenanceJSON, err := json.Marshal(entry.Provenance)
+	if err != nil {
+		return fmt.Errorf("failed to marshal provenance: %w", err)
+	}
+
 	query := `
-		CREATE TABLE IF NOT EXISTS provider_regions_cache (
-			provider TEXT PRIMARY KEY,
-			regions_hash TEXT NOT NULL,
-			regions TEXT NOT NULL,
-			created_at DATETIME NOT NULL,
-			expires_at DATETIME NOT NULL
-		)
+		INSERT OR REPLACE INTO provider_regions_cache
+		(provider, regions_hash, regions, created_at, expires_at, ttl_seconds, max_stale_seconds, refresh_policy, provenance)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
-	_, err := db.Exec(query)
-	return err
+
+	_, err = db.ExecContext(ctx, query, entry.Provider, entry.RegionsHash, string(regionsJSON),
+		sqlTimestamp(entry.CreatedAt), sqlTimestamp(entry.ExpiresAt),
+		int64(entry.Policy.TTL.Seconds()), int64(entry.Policy.MaxStale.Seconds()), entry.Policy.Refresh,
+		string(provenanceJSON))
+	if err != nil {
+		return fmt.Errorf("failed to cache regions: %w", err)
+	}
+	return nil
 }
 
-func hashRegions(regions service.Regions) string {
-	regionsJSON, _ := json.Marshal(regions)
-	hash := sha256.Sum256(regionsJSON)
-	return hex.EncodeToString(hash[:])
+func (c *sqlCache) Entries(ctx context.Context) ([]CacheEntry, error) {
+	query := `
+		SELECT ` + cacheColumns + `
+		FROM provider_regions_cache
+		ORDER BY created_at DESC
+	`
+
+	rows, err := c.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query cache: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []CacheEntry
+	for rows.Next() {
+		entry, err := scanCacheEntry(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan cache entry: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
 }
 
-func GetCachedRegions(provider string) (*service.Regions, bool, error) {
-	if db == nil {
-		return nil, false, fmt.Errorf("database not initialized")
+// cacheColumns are the columns of provider_regions_cache read by scanCacheEntry.
+const cacheColumns = `provider, regions_hash, regions, created_at, expires_at, ttl_seconds, max_stale_seconds, refresh_policy, provenance`
+
+func scanCacheEntry(row rowScanner) (CacheEntry, error) {
+	var entry CacheEntry
+	var regionsJSON string
+	var createdAt, expiresAt sqlTime
+	var ttl, maxStale sql.NullInt64
+	var refresh, provenanceJSON sql.NullString
+	if err := row.Scan(&entry.Provider, &entry.RegionsHash, &regionsJSON, &createdAt, &expiresAt, &ttl, &maxStale, &refresh, &provenanceJSON); err != nil {
+		return CacheEntry{}, err
+	}
+	if err := json.Unmarshal([]byte(regionsJSON), &entry.Regions); err != nil {
+		return CacheEntry{}, fmt.Errorf("failed to unmarshal cached regions of %s: %w", entry.Provider, err)
+	}
+	// Entries cached before provenance was recorded have none
+	if provenanceJSON.Valid && provenanceJSON.String != "" {
+		if err := json.Unmarshal([]byte(provenanceJSON.String), &entry.Provenance); err != nil {
+			return CacheEntry{}, fmt.Errorf("failed to unmarshal provenance of %s: %w", entry.Provider, err)
+		}
+	}
+	entry.CreatedAt, entry.ExpiresAt = createdAt.Time, expiresAt.Time
+	entry.Policy = service.CachePolicy{
+		TTL:      time.Duration(ttl.Int64) * time.Second,
+		MaxStale: time.Duration(maxStale.Int64) * time.Second,
+		Refresh:  refresh.String,
+	}
+	return entry, nil
+}
+
+func (c *sqlCache) Close() error {
+	return c.db.Close()
+}
+
+func (c *sqlCache) RecordSnapshot(ctx context.Context, provider string, regions service.Regions, seenAt time.Time) error {
+	regionsJSON, err := json.Marshal(regions)
+	if err != nil {
+		return fmt.Errorf("failed to marshal regions: %w", err)
+	}
+	hash := hashRegions(regions)
+	seen := sqlTimestamp(seenAt)
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The sightings are written first, so that the transaction holds the
+	// write lock when it reads the latest snapshot and no concurrent refresh
+	// records the same one in between
+	for _, category := range regions.Categories() {
+		for code := range regions.Category(category) {
+			_, err := tx.ExecContext(ctx, `
+				INSERT INTO provider_region_sightings
+				(provider, category, code, first_seen_at, last_seen_at)
+				VALUES (?, ?, ?, ?, ?)
+				ON CONFLICT (provider, category, code) DO UPDATE SET
+					first_seen_at = MIN(first_seen_at, excluded.first_seen_at),
+					last_seen_at = MAX(last_seen_at, excluded.last_seen_at)
+			`, provider, string(category), code, seen, seen)
+			if err != nil {
+				return fmt.Errorf("failed to record sighting of %s: %w", code, err)
+			}
+		}
 	}
 
 	query := `
-		SELECT regions_hash, regions, expires_at 
-		FROM provider_regions_cache 
-		WHERE provider = ? AND expires_at > datetime('now')
+		SELECT id, regions_hash
+		FROM provider_regions_history
+		WHERE provider = ?
+		ORDER BY first_seen_at DESC, id DESC
+		LIMIT 1
 	`
 
-	var regionsHash, regionsJSON string
-	var expiresAt time.Time
+	var id int64
+	var latestHash string
+	err = tx.QueryRowContext(ctx, query, provider).Scan(&id, &latestHash)
+	switch {
+	case err == nil && latestHash == hash:
+		_, err = tx.ExecContext(ctx, `
+			UPDATE provider_regions_history
+			SET last_seen_at = MAX(last_seen_at, ?)
+			WHERE id = ?
+		`, seen, id)
+	case err == nil || err == sql.ErrNoRows:
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO provider_regions_history
+			(provider, regions_hash, regions, first_seen_at, last_seen_at)
+			VALUES (?, ?, ?, ?, ?)
+		`, provider, hash, string(regionsJSON), seen, seen)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record snapshot: %w", err)
+	}
 
-	err := db.QueryRow(query, provider).Scan(&regionsHash, &regionsJSON, &expiresAt)
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to record snapshot: %w", err)
+	}
+	return nil
+}
+
+func (c *sqlCache) SnapshotAt(ctx context.Context, provider string, at time.Time) (*HistorySnapshot, bool, error) {
+	query := `
+		SELECT provider, regions_hash, regions, first_seen_at, last_seen_at
+		FROM provider_regions_history
+		WHERE provider = ? AND first_seen_at <= ?
+		ORDER BY first_seen_at DESC, id DESC
+		LIMIT 1
+	`
+
+	snapshot, err := scanSnapshot(c.db.QueryRowContext(ctx, query, provider, sqlTimestamp(at)))
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, false, nil // Cache miss
+			return nil, false, nil
 		}
-		return nil, false, fmt.Errorf("failed to query cache: %w", err)
+		return nil, false, fmt.Errorf("failed to query history: %w", err)
 	}
+	return &snapshot, true, nil
+}
+
+func (c *sqlCache) Snapshots(ctx context.Context, provider string, from, to time.Time) ([]HistorySnapshot, error) {
+	query := `
+		SELECT provider, regions_hash, regions, first_seen_at, last_seen_at
+		FROM provider_regions_history
+		WHERE (? = '' OR provider = ?) AND first_seen_at >= ? AND first_seen_at <= ?
+		ORDER BY first_seen_at, id
+	`
 
-	var regions service.Regions
-	if err := json.Unmarshal([]byte(regionsJSON), &regions); err != nil {
-		return nil, false, fmt.Errorf("failed to unmarshal cached regions: %w", err)
+	rows, err := c.db.QueryContext(ctx, query, provider, provider, sqlTimestamp(from), sqlTimestamp(to))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query history: %w", err)
 	}
+	defer rows.Close()
 
-	return &regions, true, nil
+	var snapshots []HistorySnapshot
+	for rows.Next() {
+		snapshot, err := scanSnapshot(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan history: %w", err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, rows.Err()
 }
 
-func CacheRegions(provider string, regions service.Regions) error {
-	if db == nil {
-		return fmt.Errorf("database not initialized")
+func (c *sqlCache) Sightings(ctx context.Context, provider string) ([]RegionSighting, error) {
+	query := `
+		SELECT provider, category, code, first_seen_at, last_seen_at
+		FROM provider_region_sightings
+		WHERE ? = '' OR provider = ?
+		ORDER BY provider, category, code
+	`
+
+	rows, err := c.db.QueryContext(ctx, query, provider, provider)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sightings: %w", err)
+	}
+	defer rows.Close()
+
+	var sightings []RegionSighting
+	for rows.Next() {
+		var sighting RegionSighting
+		var category string
+		var firstSeenAt, lastSeenAt sqlTime
+		if err := rows.Scan(&sighting.Provider, &category, &sighting.Code, &firstSeenAt, &lastSeenAt); err != nil {
+			return nil, fmt.Errorf("failed to scan sighting: %w", err)
+		}
+		sighting.Category = service.Category(category)
+		sighting.FirstSeenAt, sighting.LastSeenAt = firstSeenAt.Time, lastSeenAt.Time
+		sightings = append(sightings, sighting)
 	}
+	return sightings, rows.Err()
+}
 
-	regionsJSON, err := json.Marshal(regions)
+func (c *sqlCache) ReplaceHistory(ctx context.Context, provider string, snapshots []HistorySnapshot, sightings []RegionSighting) error {
+	// The history is only replaced if all of it is imported
+	tx, err := c.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to marshal regions: %w", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"provider_regions_history", "provider_region_sightings"} {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE provider = ?", provider); err != nil {
+			return fmt.Errorf("failed to clear history: %w", err)
+		}
+	}
+
+	for _, snapshot := range snapshots {
+		regionsJSON, err := json.Marshal(snapshot.Regions)
+		if err != nil {
+			return fmt.Errorf("failed to marshal regions: %w", err)
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO provider_regions_history
+			(provider, regions_hash, regions, first_seen_at, last_seen_at)
+			VALUES (?, ?, ?, ?, ?)
+		`, provider, hashRegions(snapshot.Regions), string(regionsJSON),
+			sqlTimestamp(snapshot.FirstSeenAt), sqlTimestamp(snapshot.LastSeenAt))
+		if err != nil {
+			return fmt.Errorf("failed to import snapshot: %w", err)
+		}
+	}
+
+	for _, sighting := range sightings {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO provider_region_sightings
+			(provider, category, code, first_seen_at, last_seen_at)
+			VALUES (?, ?, ?, ?, ?)
+		`, provider, string(sighting.Category), sighting.Code,
+			sqlTimestamp(sighting.FirstSeenAt), sqlTimestamp(sighting.LastSeenAt))
+		if err != nil {
+			return fmt.Errorf("failed to import sighting of %s: %w", sighting.Code, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to import history: %w", err)
+	}
+	return nil
+}
+
+func (c *sqlCache) AcquireLease(ctx context.Context, name, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+
+	// Take the lease if it is free, expired or already ours
+	_, err := c.db.ExecContext(ctx, `
+		INSERT INTO refresh_leases (name, owner, expires_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET
+			owner = excluded.owner,
+			expires_at = excluded.expires_at
+		WHERE refresh_leases.expires_at <= ? OR refresh_leases.owner = excluded.owner
+	`, name, owner, sqlTimestamp(now.Add(ttl)), sqlTimestamp(now))
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire lease: %w", err)
+	}
+
+	var holder string
+	err = c.db.QueryRowContext(ctx, `SELECT owner FROM refresh_leases WHERE name = ?`, name).Scan(&holder)
+	if err != nil {
+		return false, fmt.Errorf("failed to check lease: %w", err)
+	}
+	return holder == owner, nil
+}
+
+func (c *sqlCache) ReleaseLease(ctx context.Context, name, owner string) error {
+	_, err := c.db.ExecContext(ctx, `DELETE FROM refresh_leases WHERE name = ? AND owner = ?`, name, owner)
+	if err != nil {
+		return fmt.Errorf("failed to release lease: %w", err)
+	}
+	return nil
+}
+
+func (c *sqlCache) MarkFallback(ctx context.Context, provider string, at time.Time) (FallbackPeriod, error) {
+	_, err := c.db.ExecContext(ctx, `
+		INSERT OR IGNORE INTO provider_fallbacks (provider, since)
+		VALUES (?, ?)
+	`, provider, sqlTimestamp(at))
+	if err != nil {
+		return FallbackPeriod{}, fmt.Errorf("failed to record fallback: %w", err)
 	}
 
-	regionsHash := hashRegions(regions)
-	now := time.Now()
-	expiresAt := now.Add(CacheDuration)
+	period := FallbackPeriod{Provider: provider}
+	var since, alertedAt sqlTime
+	err = c.db.QueryRowContext(ctx, `
+		SELECT since, alerted_at FROM provider_fallbacks WHERE provider = ?
+	`, provider).Scan(&since, &alertedAt)
+	if err != nil {
+		return FallbackPeriod{}, fmt.Errorf("failed to query fallback: %w", err)
+	}
+	period.Since = since.Time
+	if !alertedAt.IsZero() {
+		period.AlertedAt = &alertedAt.Time
+	}
+	return period, nil
+}
 
+func (c *sqlCache) MarkFallbackAlerted(ctx context.Context, provider string, at time.Time) error {
+	_, err := c.db.ExecContext(ctx, `
+		UPDATE provider_fallbacks SET alerted_at = ? WHERE provider = ?
+	`, sqlTimestamp(at), provider)
+	if err != nil {
+		return fmt.Errorf("failed to record fallback alert: %w", err)
+	}
+	return nil
+}
+
+func (c *sqlCache) ClearFallback(ctx context.Context, provider string) error {
+	_, err := c.db.ExecContext(ctx, `DELETE FROM provider_fallbacks WHERE provider = ?`, provider)
+	if err != nil {
+		return fmt.Errorf("failed to clear fallback: %w", err)
+	}
+	return nil
+}
+
+func (c *sqlCache) FallbackPeriods(ctx context.Context) ([]FallbackPeriod, error) {
+	rows, err := c.db.QueryContext(ctx, `
+		SELECT provider, since, alerted_at FROM provider_fallbacks ORDER BY provider
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query fallbacks: %w", err)
+	}
+	defer rows.Close()
+
+	var periods []FallbackPeriod
+	for rows.Next() {
+		period := FallbackPeriod{}
+		var since, alertedAt sqlTime
+		if err := rows.Scan(&period.Provider, &since, &alertedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan fallback: %w", err)
+		}
+		period.Since = since.Time
+		if !alertedAt.IsZero() {
+			period.AlertedAt = &alertedAt.Time
+		}
+		periods = append(periods, period)
+	}
+	return periods, rows.Err()
+}
+
+func (c *sqlCache) ProviderHealth(ctx context.Context, provider string) (*ProviderHealth, bool, error) {
 	query := `
-		INSERT OR REPLACE INTO provider_regions_cache 
-		(provider, regions_hash, regions, created_at, expires_at)
-		VALUES (?, ?, ?, ?, ?)
+		SELECT ` + healthColumns + `
+		FROM provider_health
+		WHERE provider = ?
 	`
 
-	_, err = db.Exec(query, provider, regionsHash, string(regionsJSON), now, expiresAt)
+	health, err := scanProviderHealth(c.db.QueryRowContext(ctx, query, provider))
 	if err != nil {
-		return fmt.Errorf("failed to cache regions: %w", err)
+		if err == sql.ErrNoRows {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("failed to query provider health: %w", err)
 	}
+	return &health, true, nil
+}
 
-	log.Printf("Cached regions for provider: %s", provider)
+func (c *sqlCache) PutProviderHealth(ctx context.Context, health ProviderHealth) error {
+	var retryAt interface{}
+	if !health.RetryAt.IsZero() {
+		retryAt = sqlTimestamp(health.RetryAt)
+	}
+
+	_, err := c.db.ExecContext(ctx, `
+		INSERT OR REPLACE INTO provider_health
+		(provider, failures, last_error, first_failure_at, last_failure_at, retry_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, health.Provider, health.Failures, health.LastError,
+		sqlTimestamp(health.FirstFailureAt), sqlTimestamp(health.LastFailureAt), retryAt)
+	if err != nil {
+		return fmt.Errorf("failed to record provider health: %w", err)
+	}
 	return nil
 }
 
-func CheckRegionsChanged(provider string, newRegions service.Regions) (bool, error) {
-	if db == nil {
-		return false, fmt.Errorf("database not initialized")
+func (c *sqlCache) DeleteProviderHealth(ctx context.Context, provider string) error {
+	_, err := c.db.ExecContext(ctx, `DELETE FROM provider_health WHERE provider = ?`, provider)
+	if err != nil {
+		return fmt.Errorf("failed to clear provider health: %w", err)
 	}
+	return nil
+}
 
-	query := `SELECT regions_hash FROM provider_regions_cache WHERE provider = ?`
+func (c *sqlCache) ProviderHealths(ctx context.Context) ([]ProviderHealth, error) {
+	query := `
+		SELECT ` + healthColumns + `
+		FROM provider_health
+		ORDER BY provider
+	`
 
-	var oldHash string
-	err := db.QueryRow(query, provider).Scan(&oldHash)
+	rows, err := c.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query provider health: %w", err)
+	}
+	defer rows.Close()
+
+	var healths []ProviderHealth
+	for rows.Next() {
+		health, err := scanProviderHealth(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan provider health: %w", err)
+		}
+		healths = append(healths, health)
+	}
+	return healths, rows.Err()
+}
+
+// healthColumns are the columns of provider_health read by scanProviderHealth.
+const healthColumns = `provider, failures, last_error, first_failure_at, last_failure_at, retry_at`
+
+func scanProviderHealth(row rowScanner) (ProviderHealth, error) {
+	var health ProviderHealth
+	var firstFailureAt, lastFailureAt, retryAt sqlTime
+	if err := row.Scan(&health.Provider, &health.Failures, &health.LastError, &firstFailureAt, &lastFailureAt, &retryAt); err != nil {
+		return ProviderHealth{}, err
+	}
+	health.FirstFailureAt, health.LastFailureAt, health.RetryAt = firstFailureAt.Time, lastFailureAt.Time, retryAt.Time
+	return health, nil
+}
+
+func (c *sqlCache) QuarantinedResult(ctx context.Context, provider string) (*QuarantinedResult, bool, error) {
+	query := `
+		SELECT provider, regions_hash, regions, reasons, quarantined_at
+		FROM provider_quarantine
+		WHERE provider = ?
+	`
+
+	result, err := scanQuarantinedResult(c.db.QueryRowContext(ctx, query, provider))
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return true, nil // No previous cache, consider it changed
+			return nil, false, nil
 		}
-		return false, fmt.Errorf("failed to check regions hash: %w", err)
+		return nil, false, fmt.Errorf("failed to query quarantine: %w", err)
+	}
+	return &result, true, nil
+}
+
+func (c *sqlCache) PutQuarantinedResult(ctx context.Context, result QuarantinedResult) error {
+	regionsJSON, err := json.Marshal(result.Regions)
+	if err != nil {
+		return fmt.Errorf("failed to marshal regions: %w", err)
+	}
+	reasonsJSON, err := json.Marshal(result.Reasons)
+	if err != nil {
+		return fmt.Errorf("failed to marshal reasons: %w", err)
 	}
 
-	newHash := hashRegions(newRegions)
-	return oldHash != newHash, nil
+	_, err = c.db.ExecContext(ctx, `
+		INSERT OR REPLACE INTO provider_quarantine
+		(provider, regions_hash, regions, reasons, quarantined_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, result.Provider, result.RegionsHash, string(regionsJSON), string(reasonsJSON), sqlTimestamp(result.QuarantinedAt))
+	if err != nil {
+		return fmt.Errorf("failed to quarantine regions: %w", err)
+	}
+	return nil
 }
 
-func CloseTursoDB() error {
-	if db != nil {
-		return db.Close()
+func (c *sqlCache) DeleteQuarantinedResult(ctx context.Context, provider string) error {
+	_, err := c.db.ExecContext(ctx, `DELETE FROM provider_quarantine WHERE provider = ?`, provider)
+	if err != nil {
+		return fmt.Errorf("failed to release quarantine: %w", err)
+	}
+	return nil
+}
+
+func (c *sqlCache) QuarantinedResults(ctx context.Context) ([]QuarantinedResult, error) {
+	rows, err := c.db.QueryContext(ctx, `
+		SELECT provider, regions_hash, regions, reasons, quarantined_at
+		FROM provider_quarantine
+		ORDER BY provider
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query quarantine: %w", err)
+	}
+	defer rows.Close()
+
+	var results []QuarantinedResult
+	for rows.Next() {
+		result, err := scanQuarantinedResult(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan quarantine: %w", err)
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+func scanQuarantinedResult(row rowScanner) (QuarantinedResult, error) {
+	var result QuarantinedResult
+	var regionsJSON, reasonsJSON string
+	var quarantinedAt sqlTime
+	if err := row.Scan(&result.Provider, &result.RegionsHash, &regionsJSON, &reasonsJSON, &quarantinedAt); err != nil {
+		return QuarantinedResult{}, err
+	}
+	if err := json.Unmarshal([]byte(regionsJSON), &result.Regions); err != nil {
+		return QuarantinedResult{}, fmt.Errorf("failed to unmarshal quarantined regions of %s: %w", result.Provider, err)
+	}
+	if err := json.Unmarshal([]byte(reasonsJSON), &result.Reasons); err != nil {
+		return QuarantinedResult{}, fmt.Errorf("failed to unmarshal quarantine reasons of %s: %w", result.Provider, err)
+	}
+	result.QuarantinedAt = quarantinedAt.Time
+	return result, nil
+}
+
+func (c *sqlCache) NotificationState(ctx context.Context, provider, kind string) (*NotificationState, bool, error) {
+	query := `
+		SELECT ` + notificationColumns + `
+		FROM notification_state
+		WHERE provider = ? AND kind = ?
+	`
+
+	state, err := scanNotificationState(c.db.QueryRowContext(ctx, query, provider, kind))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("failed to query notification state: %w", err)
+	}
+	return &state, true, nil
+}
+
+func (c *sqlCache) PutNotificationState(ctx context.Context, state NotificationState) error {
+	var lastSentAt interface{}
+	if !state.LastSentAt.IsZero() {
+		lastSentAt = sqlTimestamp(state.LastSentAt)
+	}
+	_, err := c.db.ExecContext(ctx, `
+		INSERT OR REPLACE INTO notification_state
+		(provider, kind, fingerprint, first_at, last_at, last_sent_at, count)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, state.Provider, state.Kind, state.Fingerprint,
+		sqlTimestamp(state.FirstAt), sqlTimestamp(state.LastAt), lastSentAt, state.Count)
+	if err != nil {
+		return fmt.Errorf("failed to record notification state: %w", err)
+	}
+	return nil
+}
+
+func (c *sqlCache) DeleteNotificationState(ctx context.Context, provider, kind string) error {
+	_, err := c.db.ExecContext(ctx, `DELETE FROM notification_state WHERE provider = ? AND kind = ?`, provider, kind)
+	if err != nil {
+		return fmt.Errorf("failed to clear notification state: %w", err)
+	}
+	return nil
+}
+
+func (c *sqlCache) NotificationStates(ctx context.Context) ([]NotificationState, error) {
+	rows, err := c.db.QueryContext(ctx, `
+		SELECT `+notificationColumns+`
+		FROM notification_state
+		ORDER BY provider, kind
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notification state: %w", err)
+	}
+	defer rows.Close()
+
+	var states []NotificationState
+	for rows.Next() {
+		state, err := scanNotificationState(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan notification state: %w", err)
+		}
+		states = append(states, state)
+	}
+	return states, rows.Err()
+}
+
+// notificationColumns are the columns of notification_state read by
+// scanNotificationState.
+const notificationColumns = `provider, kind, fingerprint, first_at, last_at, last_sent_at, count`
+
+func scanNotificationState(row rowScanner) (NotificationState, error) {
+	var state NotificationState
+	var firstAt, lastAt, lastSentAt sqlTime
+	if err := row.Scan(&state.Provider, &state.Kind, &state.Fingerprint, &firstAt, &lastAt, &lastSentAt, &state.Count); err != nil {
+		return NotificationState{}, err
+	}
+	state.FirstAt, state.LastAt, state.LastSentAt = firstAt.Time, lastAt.Time, lastSentAt.Time
+	return state, nil
+}
+
+func (c *sqlCache) RecordEvent(ctx context.Context, record EventRecord) error {
+	_, err := c.db.ExecContext(ctx, `
+		INSERT INTO events (provider, kind, at, summary)
+		VALUES (?, ?, ?, ?)
+	`, record.Provider, record.Kind, sqlTimestamp(record.At), record.Summary)
+	if err != nil {
+		return fmt.Errorf("failed to record event: %w", err)
+	}
+	return nil
+}
+
+func (c *sqlCache) Events(ctx context.Context, provider string, from, to time.Time) ([]EventRecord, error) {
+	rows, err := c.db.QueryContext(ctx, `
+		SELECT provider, kind, at, summary
+		FROM events
+		WHERE (? = '' OR provider = ?) AND at >= ? AND at <= ?
+		ORDER BY at, id
+	`, provider, provider, sqlTimestamp(from), sqlTimestamp(to))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query events: %w", err)
+	}
+	defer rows.Close()
+
+	var records []EventRecord
+	for rows.Next() {
+		var record EventRecord
+		var at sqlTime
+		if err := rows.Scan(&record.Provider, &record.Kind, &at, &record.Summary); err != nil {
+			return nil, fmt.Errorf("failed to scan event: %w", err)
+		}
+		record.At = at.Time
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func (c *sqlCache) EnqueueNotifications(ctx context.Context, messages []OutboxMessage) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := enqueueMessages(ctx, tx, messages); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (c *sqlCache) PutWithNotifications(ctx context.Context, entry CacheEntry, messages []OutboxMessage) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := putEntry(ctx, tx, entry); err != nil {
+		return err
+	}
+	if err := enqueueMessages(ctx, tx, messages); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to cache regions: %w", err)
+	}
+
+	log.Printf("Cached regions for provider: %s", entry.Provider)
+	return nil
+}
+
+// enqueueMessages adds pending messages to the outbox.
+func enqueueMessages(ctx context.Context, db sqlExecer, messages []OutboxMessage) error {
+	for _, message := range messages {
+		_, err := db.ExecContext(ctx, `
+			INSERT INTO notification_outbox
+			(notifier, kind, provider, event, status, attempts, last_error, created_at, next_attempt_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, message.Notifier, message.Kind, message.Provider, string(message.Event), message.Status,
+			message.Attempts, message.LastError, sqlTimestamp(message.CreatedAt), sqlTimestamp(message.NextAttemptAt))
+		if err != nil {
+			return fmt.Errorf("failed to queue notification: %w", err)
+		}
+	}
+	return nil
+}
+
+func (c *sqlCache) ClaimNotifications(ctx context.Context, at time.Time, lease time.Duration, limit int) ([]OutboxMessage, error) {
+	// A single statement, so that concurrent workers never claim the same message
+	rows, err := c.db.QueryContext(ctx, `
+		UPDATE notification_outbox
+		SET next_attempt_at = ?
+		WHERE id IN (
+			SELECT id FROM notification_outbox
+			WHERE status = ? AND next_attempt_at <= ?
+			ORDER BY id
+			LIMIT ?
+		) AND status = ? AND next_attempt_at <= ?
+		RETURNING `+outboxColumns,
+		sqlTimestamp(at.Add(lease)), OutboxPending, sqlTimestamp(at), limit, OutboxPending, sqlTimestamp(at))
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim notifications: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []OutboxMessage
+	for rows.Next() {
+		message, err := scanOutboxMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan notification: %w", err)
+		}
+		messages = append(messages, message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+	return messages, nil
+}
+
+func (c *sqlCache) UpdateNotification(ctx context.Context, message OutboxMessage) error {
+	var deliveredAt interface{}
+	if message.DeliveredAt != nil {
+		deliveredAt = sqlTimestamp(*message.DeliveredAt)
+	}
+	_, err := c.db.ExecContext(ctx, `
+		UPDATE notification_outbox
+		SET status = ?, attempts = ?, last_error = ?, next_attempt_at = ?, delivered_at = ?
+		WHERE id = ?
+	`, message.Status, message.Attempts, message.LastError, sqlTimestamp(message.NextAttemptAt), deliveredAt, message.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update notification: %w", err)
 	}
 	return nil
 }
+
+func (c *sqlCache) OutboxNotifications(ctx context.Context, status string) ([]OutboxMessage, error) {
+	rows, err := c.db.QueryContext(ctx, `
+		SELECT `+outboxColumns+`
+		FROM notification_outbox
+		WHERE ? = '' OR status = ?
+		ORDER BY id
+	`, status, status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notifications: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []OutboxMessage
+	for rows.Next() {
+		message, err := scanOutboxMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan notification: %w", err)
+		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+// outboxColumns are the columns of notification_outbox read by
+// scanOutboxMessage.
+const outboxColumns = `id, notifier, kind, provider, event, status, attempts, last_error, created_at, next_attempt_at, delivered_at`
+
+func scanOutboxMessage(row rowScanner) (OutboxMessage, error) {
+	var message OutboxMessage
+	var event string
+	var createdAt, nextAttemptAt, deliveredAt sqlTime
+	if err := row.Scan(&message.ID, &message.Notifier, &message.Kind, &message.Provider, &event, &message.Status,
+		&message.Attempts, &message.LastError, &createdAt, &nextAttemptAt, &deliveredAt); err != nil {
+		return OutboxMessage{}, err
+	}
+	message.Event = json.RawMessage(event)
+	message.CreatedAt, message.NextAttemptAt = createdAt.Time, nextAttemptAt.Time
+	if !deliveredAt.IsZero() {
+		message.DeliveredAt = &deliveredAt.Time
+	}
+	return message, nil
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSnapshot(row rowScanner) (HistorySnapshot, error) {
+	var snapshot HistorySnapshot
+	var regionsJSON string
+	var firstSeenAt, lastSeenAt sqlTime
+	if err := row.Scan(&snapshot.Provider, &snapshot.RegionsHash, &regionsJSON, &firstSeenAt, &lastSeenAt); err != nil {
+		return HistorySnapshot{}, err
+	}
+	if err := json.Unmarshal([]byte(regionsJSON), &snapshot.Regions); err != nil {
+		return HistorySnapshot{}, fmt.Errorf("failed to unmarshal regions of %s: %w", snapshot.Provider, err)
+	}
+	snapshot.FirstSeenAt, snapshot.LastSeenAt = firstSeenAt.Time, lastSeenAt.Time
+	return snapshot, nil
+}
+
+// sqlTimestamp formats t as fixed width UTC text, so that timestamps compare
+// correctly as strings whatever the driver.
+func sqlTimestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000000000Z")
+}
+
+// sqlTime scans a DATETIME column, which drivers return either as a time or
+// as text depending on how the row was written.
+type sqlTime struct {
+	time.Time
+}
+
+// sqlTimeLayouts are the text forms of DATETIME values written by the libsql
+// and sqlite drivers and by SQLite itself.
+var sqlTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	"2006-01-02 15:04:05",
+}
+
+func (t *sqlTime) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case time.Time:
+		t.Time = v
+		return nil
+	case string:
+		return t.parse(v)
+	case []byte:
+		return t.parse(string(v))
+	case int64:
+		t.Time = time.Unix(v, 0).UTC()
+		return nil
+	case nil:
+		t.Time = time.Time{}
+		return nil
+	}
+	return fmt.Errorf("cannot scan %T into a time", value)
+}
+
+func (t *sqlTime) parse(value string) error {
+	for _, layout := range sqlTimeLayouts {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			t.Time = parsed
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot parse time %q", value)
+}
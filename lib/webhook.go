@@ -0,0 +1,21 @@
+package lib
+
+import "context"
+
+// webhookPayload is the body posted by the generic webhook notifier.
+type webhookPayload struct {
+	Kind  string `json:"kind"`
+	Event Event  `json:"event"`
+}
+
+// webhookNotifier posts every event as plain JSON, its kind alongside the
+// event's own fields, for services that route alerts themselves.
+type webhookNotifier struct {
+	url string
+}
+
+func (n *webhookNotifier) Name() string { return NotifierWebhook }
+
+func (n *webhookNotifier) Notify(ctx context.Context, event Event) error {
+	return postJSON(ctx, n.url, webhookPayload{Kind: event.Kind(), Event: event})
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/sb-nour/providers-endpoints/lib"
@@ -20,25 +28,103 @@ func main() {
 	// Set up logging
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
+	format := flag.String("format", lib.FormatLegacy, "output format: legacy (code to display string) or detailed (structured regions)")
+	provider := flag.String("provider", "", "history, changes and sightings: only show this provider")
+	at := flag.String("at", "", "history: show the regions as of this time (RFC 3339 or YYYY-MM-DD, default now)")
+	from := flag.String("from", "", "changes and digest: start of the range (RFC 3339 or YYYY-MM-DD, default the beginning of history)")
+	to := flag.String("to", "", "changes and digest: end of the range (RFC 3339 or YYYY-MM-DD, default now)")
+	providers := flag.String("providers", "", "export and import: only these providers, comma separated display names")
+	overwrite := flag.Bool("overwrite", false, "import: replace cached entries and history instead of merging them")
+	dryRun := flag.Bool("dry-run", false, "digest: print the digest without sending it")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [regions|zones|provenance|history|changes|sightings|quarantine|refresh|digest [daily|weekly]|outbox [list [status]|deliver|worker|replay [id...]]|migrate [status]|export [file]|import file]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	command := flag.Arg(0)
+	if command == "" {
+		command = "regions"
+	}
+	switch command {
+	case "regions", "zones", "provenance":
+	case "history", "changes", "sightings", "quarantine":
+		checkEnvironmentVariables()
+		runHistory(command, *provider, *at, *from, *to)
+		return
+	case "refresh":
+		checkEnvironmentVariables()
+		runRefresh()
+		return
+	case "digest":
+		checkEnvironmentVariables()
+		runDigest(flag.Arg(1), *from, *to, *dryRun)
+		return
+	case "outbox":
+		checkEnvironmentVariables()
+		runOutbox(flag.Arg(1), flag.Args()[min(2, flag.NArg()):])
+		return
+	case "migrate":
+		runMigrate(flag.Arg(1) == "status")
+		return
+	case "export", "import":
+		checkEnvironmentVariables()
+		runBundle(command, flag.Arg(1), splitList(*providers), *overwrite)
+		return
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	// Check for required environment variables
 	checkEnvironmentVariables()
 
-	// Use cached version if Turso DB is configured, otherwise fall back to original
-	var regions map[string]service.Regions
+	// Bound the whole run so a hung upstream cannot block forever
+	ctx, cancel := context.WithTimeout(context.Background(), lib.FetchDeadline(2*time.Minute))
+	defer cancel()
+
+	// Use cached version if a cache backend is configured, otherwise fall back to original
+	var results map[string]service.FetchResult
+	var err error
+
+	if lib.CacheConfigured() {
+		log.Printf("Using cached regions with %s cache", lib.CacheBackend())
+		if err := lib.InitCache(); err != nil {
+			log.Printf("Failed to initialize cache: %v", err)
+		}
+		defer lib.CloseCache()
+		// Let stale-while-revalidate refreshes finish before the cache is closed
+		defer lib.WaitForRefreshes()
 
-	if os.Getenv("TURSO_DATABASE_URL") != "" {
-		log.Printf("Using cached regions with Turso DB")
-		regions = lib.GetRegionsWithCache()
+		results, err = lib.GetResultsWithCache(ctx)
 
 		// Log cache statistics for debugging
 		lib.LogCacheStats()
 	} else {
-		log.Printf("Turso DB not configured, using original non-cached version")
-		regions = lib.GetRegions()
+		log.Printf("No cache backend configured, using original non-cached version")
+		results, err = lib.GetResults(ctx)
+	}
+
+	if err != nil {
+		log.Printf("Some providers could not be fetched: %v", err)
+	}
+
+	regions := lib.Regions(results)
+	var output interface{}
+	switch command {
+	case "zones":
+		output = lib.Zones(regions)
+	case "provenance":
+		output = lib.Provenance(results)
+	default:
+		output, err = lib.FormatRegions(regions, *format)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
 	}
 
 	// Marshal and output the results
-	regionsJson, err := json.Marshal(regions)
+	regionsJson, err := json.Marshal(output)
 	if err != nil {
 		log.Printf("Error marshalling JSON: %v", err)
 		fmt.Println("Error marshalling JSON:", err)
@@ -48,7 +134,334 @@ func main() {
 	fmt.Println(string(regionsJson))
 }
 
+// runHistory prints the history of the regions kept by the cache backend.
+func runHistory(command, provider, at, from, to string) {
+	if !lib.CacheConfigured() {
+		log.Fatalf("%s needs a cache backend, set CACHE_BACKEND or TURSO_DATABASE_URL", command)
+	}
+	if err := lib.InitCache(); err != nil {
+		log.Fatalf("Failed to initialize cache: %v", err)
+	}
+	defer lib.CloseCache()
+
+	parseTime := func(value string) time.Time {
+		if value == "" {
+			return time.Time{}
+		}
+		t, err := lib.ParseTime(value)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		return t
+	}
+
+	ctx := context.Background()
+	var output interface{}
+	var err error
+	switch command {
+	case "history":
+		asOf := parseTime(at)
+		if asOf.IsZero() {
+			asOf = time.Now()
+		}
+		output, err = lib.RegionsAt(ctx, provider, asOf)
+	case "changes":
+		output, err = lib.RegionChanges(ctx, provider, parseTime(from), parseTime(to))
+	case "sightings":
+		output, err = lib.RegionSightings(ctx, provider)
+	case "quarantine":
+		output, err = lib.QuarantinedResults(ctx)
+	}
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	historyJson, err := json.Marshal(output)
+	if err != nil {
+		log.Fatalf("Error marshalling JSON: %v", err)
+	}
+	fmt.Println(string(historyJson))
+}
+
+// runRefresh refreshes the providers whose cached regions are missing or expired.
+func runRefresh() {
+	if !lib.CacheConfigured() {
+		log.Fatalf("refresh needs a cache backend, set CACHE_BACKEND or TURSO_DATABASE_URL")
+	}
+	if err := lib.InitCache(); err != nil {
+		log.Fatalf("Failed to initialize cache: %v", err)
+	}
+	defer lib.CloseCache()
+
+	ctx, cancel := context.WithTimeout(context.Background(), lib.FetchDeadline(2*time.Minute))
+	defer cancel()
+
+	refreshed, err := lib.RefreshStale(ctx)
+	if err != nil {
+		log.Printf("Some providers could not be refreshed: %v", err)
+	}
+	log.Printf("Refreshed %d providers: %v", len(refreshed), refreshed)
+
+	// Retry the notifications that could not be delivered earlier
+	if _, err := lib.DeliverOutbox(ctx); err != nil {
+		log.Printf("Failed to deliver notifications: %v", err)
+	}
+}
+
+// runDigest sends a digest of the daily or weekly period ending now, or of the
+// range between from and to, to the configured notifiers and prints it.
+func runDigest(period, from, to string, dryRun bool) {
+	if !lib.CacheConfigured() {
+		log.Fatalf("digest needs a cache backend, set CACHE_BACKEND or TURSO_DATABASE_URL")
+	}
+	if err := lib.InitCache(); err != nil {
+		log.Fatalf("Failed to initialize cache: %v", err)
+	}
+	defer lib.CloseCache()
+
+	if period == "" {
+		period = lib.DigestDaily
+	}
+	end := time.Now().UTC()
+	if to != "" {
+		t, err := lib.ParseTime(to)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		end = t
+	}
+	start, err := lib.DigestRange(period, end)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if from != "" {
+		if start, err = lib.ParseTime(from); err != nil {
+			log.Fatalf("%v", err)
+		}
+		period = ""
+	}
+
+	ctx := context.Background()
+	digest, err := lib.BuildDigest(ctx, start, end)
+	if err != nil {
+		log.Fatalf("Failed to build digest: %v", err)
+	}
+	digest.Period = period
+	if !dryRun {
+		lib.Notify(ctx, digest)
+	}
+
+	digestJson, err := json.Marshal(digest)
+	if err != nil {
+		log.Fatalf("Error marshalling JSON: %v", err)
+	}
+	fmt.Println(string(digestJson))
+}
+
+// runOutbox lists the notifications of the outbox with the given status
+// (failed by default), delivers the ones that are due once or every
+// NOTIFY_WORKER_INTERVAL until interrupted, or replays failed ones.
+func runOutbox(command string, args []string) {
+	if !lib.CacheConfigured() {
+		log.Fatalf("outbox needs a cache backend, set CACHE_BACKEND or TURSO_DATABASE_URL")
+	}
+	if err := lib.InitCache(); err != nil {
+		log.Fatalf("Failed to initialize cache: %v", err)
+	}
+	defer lib.CloseCache()
+
+	ctx := context.Background()
+	var output interface{}
+	var err error
+	switch command {
+	case "", "list":
+		status := lib.OutboxFailed
+		if len(args) > 0 {
+			status = args[0]
+		}
+		if status == "all" {
+			status = ""
+		}
+		output, err = lib.OutboxNotifications(ctx, status)
+	case "deliver":
+		delivered, err := lib.DeliverOutbox(ctx)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		log.Printf("Delivered %d notifications", delivered)
+		return
+	case "worker":
+		runOutboxWorker()
+		return
+	case "replay":
+		var ids []int64
+		for _, arg := range args {
+			id, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				log.Fatalf("Invalid notification ID %q", arg)
+			}
+			ids = append(ids, id)
+		}
+		output, err = lib.ReplayNotifications(ctx, ids)
+		if err == nil {
+			_, err = lib.DeliverOutbox(ctx)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	outboxJson, err := json.Marshal(output)
+	if err != nil {
+		log.Fatalf("Error marshalling JSON: %v", err)
+	}
+	fmt.Println(string(outboxJson))
+}
+
+// runOutboxWorker delivers the notifications of the outbox as they become due
+// until interrupted.
+func runOutboxWorker() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	interval := 30 * time.Second
+	if value := os.Getenv("NOTIFY_WORKER_INTERVAL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid NOTIFY_WORKER_INTERVAL %q", value)
+		}
+		interval = d
+	}
+	log.Printf("Delivering notifications every %s", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if delivered, err := lib.DeliverOutbox(ctx); err != nil {
+			log.Printf("Failed to deliver notifications: %v", err)
+		} else if delivered > 0 {
+			log.Printf("Delivered %d notifications", delivered)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runMigrate applies the pending migrations of the cache schema, or only lists
+// every migration and whether it was applied when status is set.
+func runMigrate(status bool) {
+	c, err := lib.OpenCacheUnmigrated()
+	if err != nil {
+		log.Fatalf("Failed to open cache: %v", err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	var migrations []lib.MigrationStatus
+	if status {
+		migrations, err = lib.MigrationStatusOf(ctx, c)
+	} else {
+		migrations, err = lib.MigrateCache(ctx, c)
+	}
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	for _, m := range migrations {
+		applied := "pending"
+		if m.AppliedAt != nil {
+			applied = "applied " + m.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Printf("%4d  %-40s %s\n", m.Version, m.Name, applied)
+	}
+	if !status && len(migrations) == 0 {
+		fmt.Println("No pending migrations")
+	}
+}
+
+// runBundle exports the cache to a bundle file, or to stdout when path is
+// empty or "-", or imports a bundle file into the cache.
+func runBundle(command, path string, providers []string, overwrite bool) {
+	if !lib.CacheConfigured() {
+		log.Fatalf("%s needs a cache backend, set CACHE_BACKEND or TURSO_DATABASE_URL", command)
+	}
+	c, err := lib.OpenCache()
+	if err != nil {
+		log.Fatalf("Failed to open cache: %v", err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	if command == "export" {
+		bundle, err := lib.ExportBundle(ctx, c, providers)
+		if err != nil {
+			log.Fatalf("Failed to export cache: %v", err)
+		}
+		bundleJson, err := json.MarshalIndent(bundle, "", "  ")
+		if err != nil {
+			log.Fatalf("Error marshalling JSON: %v", err)
+		}
+		if path == "" || path == "-" {
+			fmt.Println(string(bundleJson))
+			return
+		}
+		if err := os.WriteFile(path, append(bundleJson, '\n'), 0o644); err != nil {
+			log.Fatalf("Failed to write bundle: %v", err)
+		}
+		log.Printf("Exported %d entries and the history of %d providers to %s", len(bundle.Entries), len(bundle.History), path)
+		return
+	}
+
+	if path == "" {
+		log.Fatalf("import needs the path of a bundle, or - to read it from stdin")
+	}
+	var data []byte
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		log.Fatalf("Failed to read bundle: %v", err)
+	}
+	var bundle lib.Bundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		log.Fatalf("Failed to parse bundle: %v", err)
+	}
+
+	summary, err := lib.ImportBundle(ctx, c, &bundle, lib.ImportOptions{Overwrite: overwrite, Providers: providers})
+	if err != nil {
+		log.Fatalf("Failed to import bundle: %v", err)
+	}
+	log.Printf("Imported %d entries (%d older than the cached ones skipped) and the history of %d providers",
+		summary.Entries, summary.Skipped, summary.History)
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func checkEnvironmentVariables() {
+	// Check for cache configuration
+	if backend := lib.CacheBackend(); backend != lib.CacheBackendNone {
+		log.Printf("Cache backend configured: %s", backend)
+	} else {
+		log.Printf("No cache backend configured, caching will be disabled")
+	}
+
 	// Check for Turso DB configuration
 	if tursoURL := os.Getenv("TURSO_DATABASE_URL"); tursoURL != "" {
 		log.Printf("Turso DB URL configured: %s", maskSensitiveURL(tursoURL))
@@ -59,14 +472,16 @@ func checkEnvironmentVariables() {
 			log.Printf("Warning: TURSO_AUTH_TOKEN not set, using database without authentication")
 		}
 	} else {
-		log.Printf("TURSO_DATABASE_URL not set, caching will be disabled")
+		log.Printf("TURSO_DATABASE_URL not set")
 	}
 
-	// Check for Slack webhook configuration
-	if slackURL := os.Getenv("SLACK_WEBHOOK_URL"); slackURL != "" {
-		log.Printf("Slack webhook URL configured: %s", maskSensitiveURL(slackURL))
-	} else {
-		log.Printf("SLACK_WEBHOOK_URL not set, notifications will be disabled")
+	// Check for notifier configuration
+	notifiers := lib.Notifiers()
+	for _, notifier := range notifiers {
+		log.Printf("Notifier configured: %s", notifier.Name())
+	}
+	if len(notifiers) == 0 {
+		log.Printf("No notifier configured, notifications will be disabled")
 	}
 }
 
@@ -1,20 +1,93 @@
 package service
 
 import (
-	"fmt"
+	"context"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
 )
 
-func getAmazonS3Regions() (map[string]string, error) {
-	url := "https://docs.aws.amazon.com/general/latest/gr/s3.html"
-	doc, err := get(url)
+// awsRegionMetros maps AWS region codes to the metro code of their location.
+// Lightsail uses the same region codes.
+var awsRegionMetros = map[string]string{
+	"af-south-1":     "cpt",
+	"ap-east-1":      "hkg",
+	"ap-east-2":      "tpe",
+	"ap-northeast-1": "nrt",
+	"ap-northeast-2": "icn",
+	"ap-northeast-3": "kix",
+	"ap-south-1":     "bom",
+	"ap-south-2":     "hyd",
+	"ap-southeast-1": "sin",
+	"ap-southeast-2": "syd",
+	"ap-southeast-3": "cgk",
+	"ap-southeast-4": "mel",
+	"ap-southeast-5": "kul",
+	"ap-southeast-6": "akl",
+	"ap-southeast-7": "bkk",
+	"ca-central-1":   "yul",
+	"ca-west-1":      "yyc",
+	"eu-central-1":   "fra",
+	"eu-central-2":   "zrh",
+	"eu-north-1":     "arn",
+	"eu-south-1":     "mxp",
+	"eu-south-2":     "zaz",
+	"eu-west-1":      "dub",
+	"eu-west-2":      "lhr",
+	"eu-west-3":      "cdg",
+	"il-central-1":   "tlv",
+	"me-central-1":   "dxb",
+	"me-south-1":     "bah",
+	"mx-central-1":   "qro",
+	"sa-east-1":      "gru",
+	"us-east-1":      "iad",
+	"us-east-2":      "cmh",
+	"us-gov-east-1":  "cmh",
+	"us-gov-west-1":  "pdx",
+	"us-west-1":      "sfo",
+	"us-west-2":      "pdx",
+}
+
+// awsZonePattern matches availability zone names such as "us-east-1a" and
+// captures the region they belong to.
+var awsZonePattern = regexp.MustCompile(`\b([a-z]{2}(?:-gov)?-[a-z]+-[0-9]+)([a-z])\b`)
+
+// addAWSZones scans text for availability zone names and adds each zone to
+// its region. Zones of regions that require opting in are marked as such.
+func addAWSZones(regionMap map[string]Region, text string) {
+	for _, match := range awsZonePattern.FindAllStringSubmatch(text, -1) {
+		region, ok := regionMap[match[1]]
+		if !ok {
+			continue
+		}
+
+		state := ZoneStateAvailable
+		if strings.HasPrefix(strings.ToLower(region.Tags["opt_in_status"]), "opt-in required") {
+			state = ZoneStateOptIn
+		}
+		regionMap[match[1]] = region.withZone(Zone{ID: match[0], State: state})
+	}
+	sortZones(regionMap)
+}
+
+// awsRegion builds an AWS region with its location filled in from the code.
+func awsRegion(code, name string) Region {
+	return newRegion(code, name, awsRegionMetros[code])
+}
+
+// awsS3DocsURL lists the S3 endpoints of every AWS region.
+const awsS3DocsURL = "https://docs.aws.amazon.com/general/latest/gr/s3.html"
+
+func getAmazonS3Regions(ctx context.Context) (map[string]Region, error) {
+	url := awsS3DocsURL
+	doc, err := get(ctx, url)
 	if err != nil {
 		return nil, err
 	}
 
-	var regionMap map[string]string = make(map[string]string)
+	var regionMap map[string]Region = make(map[string]Region)
 
 	doc.Find("#main-col-body div table").Each(func(i int, table *goquery.Selection) {
 		// CHeck if the thead first row's first th is "Region Name"
@@ -24,9 +97,13 @@ func getAmazonS3Regions() (map[string]string, error) {
 		table.Find("tbody tr").Each(func(i int, row *goquery.Selection) {
 			if row.Children().Length() == 5 {
 				regionCode := strings.Trim(row.Children().Eq(1).Text(), " \n")
-				regionName := strings.Trim(row.Children().Eq(0).Text(), " \n") + " - " + strings.Trim(row.Children().Eq(1).Text(), " \n")
+				regionName := strings.Trim(row.Children().Eq(0).Text(), " \n")
 
-				regionMap[regionCode] = regionName
+				region := awsRegion(regionCode, regionName)
+				for _, host := range awsEndpointHosts(row.Children().Eq(2)) {
+					region = withAWSS3Endpoint(region, host)
+				}
+				regionMap[regionCode] = region
 			}
 		})
 	})
@@ -34,47 +111,97 @@ func getAmazonS3Regions() (map[string]string, error) {
 	return regionMap, nil
 }
 
-func getAmazonEC2Regions() (map[string]string, error) {
+// awsEndpointHosts returns the hostnames listed in an Endpoint cell, which
+// holds one hostname per paragraph.
+func awsEndpointHosts(cell *goquery.Selection) []string {
+	var hosts []string
+	paragraphs := cell.Find("p")
+	if paragraphs.Length() == 0 {
+		return strings.Fields(cell.Text())
+	}
+	paragraphs.Each(func(i int, p *goquery.Selection) {
+		hosts = append(hosts, strings.Fields(p.Text())...)
+	})
+	return hosts
+}
+
+// withAWSS3Endpoint adds an S3 hostname to the region under the kind its
+// prefix denotes. Access point, control and website hostnames are not bucket
+// endpoints and are skipped.
+func withAWSS3Endpoint(region Region, host string) Region {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if !strings.HasSuffix(host, ".amazonaws.com") || strings.Contains(host, "control") ||
+		strings.Contains(host, "website") || strings.Contains(host, "accesspoint") {
+		return region
+	}
+
+	fips := strings.Contains(host, "fips")
+	dualstack := strings.Contains(host, "dualstack")
+	switch {
+	case fips && dualstack:
+		return region.withEndpoint(EndpointFIPSDualstack, "https://"+host)
+	case fips:
+		return region.withEndpoint(EndpointFIPS, "https://"+host)
+	case dualstack:
+		return region.withEndpoint(EndpointDualstack, "https://"+host)
+	}
+	return region.withS3Endpoints(host)
+}
+
+// awsEC2DocsURL lists the EC2 regions.
+const awsEC2DocsURL = "https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/using-regions-availability-zones.html#concepts-regions"
+
+func getAmazonEC2Regions(ctx context.Context) (map[string]Region, error) {
 
-	url := "https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/using-regions-availability-zones.html#concepts-regions"
-	doc, err := get(url)
+	url := awsEC2DocsURL
+	doc, err := get(ctx, url)
 	if err != nil {
 		return nil, err
 	}
 
-	var regionMap map[string]string = make(map[string]string)
+	var regionMap map[string]Region = make(map[string]Region)
 
 	doc.Find("table").Each(func(i int, table *goquery.Selection) {
 		if table.Find("thead th").Length() == 3 && table.Find("tbody tr").Length() > 5 {
 			table.Find("tbody tr").Each(func(i int, row *goquery.Selection) {
-				regionCode := row.Find("td").Eq(0).Text()
-				regionName := row.Find("td").Eq(1).Text()
-				regionMap[regionCode] = fmt.Sprintf("%s - %s", regionName, regionCode)
+				regionCode := strings.TrimSpace(row.Find("td").Eq(0).Text())
+				regionName := strings.TrimSpace(row.Find("td").Eq(1).Text())
+				optInStatus := strings.TrimSpace(row.Find("td").Eq(2).Text())
+				regionMap[regionCode] = awsRegion(regionCode, regionName).withTag("opt_in_status", optInStatus)
 			})
 			return
 		}
 	})
 
+	// The page lists the zones of each region outside of the regions table
+	addAWSZones(regionMap, doc.Text())
+
 	return regionMap, nil
 }
 
-func GetAmazonRegions() Regions {
+func GetAmazonRegions(ctx context.Context) FetchResult {
+	var result FetchResult
 
-	s3Regions, err := getAmazonS3Regions()
-	if err != nil {
-		// Throw error
-		fmt.Println(err)
-	}
-	ec2Regions, err := getAmazonEC2Regions()
-	if err != nil {
-		// Throw error
-		fmt.Println(err)
-	}
+	s3Regions, err := getAmazonS3Regions(ctx)
+	result.SetError(CategoryStorage, err)
+	ec2Regions, err := getAmazonEC2Regions(ctx)
+	result.SetError(CategoryCompute, err)
 
-	regions := Regions{
-		Storage: s3Regions,
-		Compute: ec2Regions,
+	result.Regions = Regions{
+		CategoryStorage: s3Regions,
+		CategoryCompute: ec2Regions,
 	}
 
-	return regions
+	return result
+}
+
+func init() {
+	Register(NewProvider("aws", "Amazon AWS", []Category{CategoryStorage, CategoryCompute}, GetAmazonRegions),
+		WithCachePolicy(CachePolicy{TTL: 72 * time.Hour}),
+		WithDocsURL(awsS3DocsURL, CategoryStorage),
+		WithDocsURL(awsEC2DocsURL, CategoryCompute),
+		WithSanityRules(SanityRules{Required: map[Category][]string{
+			CategoryStorage: {"us-east-1"},
+			CategoryCompute: {"us-east-1"},
+		}}))
 }
@@ -1,11 +1,12 @@
 package service
 
 import (
+	"context"
 	"fmt"
-	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 var knownPrefixes = []string{
@@ -20,17 +21,44 @@ var knownPrefixes = []string{
 	"sa-east-",
 }
 
+// backblazeRegionMetros maps the Backblaze regions with a published location
+// to their metro code.
+var backblazeRegionMetros = map[string]string{
+	"us-west-000":    "sac",
+	"us-west-001":    "sac",
+	"us-west-002":    "sac",
+	"us-west-004":    "phx",
+	"us-east-005":    "iad",
+	"eu-central-003": "ams",
+	"ca-east-006":    "yyz",
+}
+
 // operation in ['create-snapshot', 'delete-snapshot', 'get-snapshot', 'list-snapshots', 'list-instances', 'get-instance']
 func transformLabel(regionCode string) string {
 	parts := strings.Split(regionCode, "-")
 	thirdPart, _ := strconv.Atoi(parts[2])
-	return fmt.Sprintf("%s %s %1d - %s", strings.ToUpper(parts[0]), strings.Title(parts[1]), thirdPart, regionCode)
+	return fmt.Sprintf("%s %s %1d", strings.ToUpper(parts[0]), strings.Title(parts[1]), thirdPart)
+}
+
+// backblazeRegion builds a Backblaze region. Regions without a published
+// location still get their country from the code prefix.
+func backblazeRegion(regionCode string) Region {
+	region := newRegion(regionCode, transformLabel(regionCode), backblazeRegionMetros[regionCode])
+	if country, ok := regionPrefixCountries[strings.Split(regionCode, "-")[0]]; ok && region.Country == "" {
+		region = region.withCountry(country)
+	}
+	return region
+}
+
+// backblazeS3Host returns the hostname of the S3 endpoint of a region.
+func backblazeS3Host(regionCode string) string {
+	return "s3." + regionCode + ".backblazeb2.com"
 }
 
-func getBackblazeStorageRegions() map[string]string {
+func getBackblazeStorageRegions(ctx context.Context) (map[string]Region, error) {
 
 	var wg sync.WaitGroup
-	results := make(chan map[string]string)
+	results := make(chan Region)
 	iterations := 8
 	workerCount := len(knownPrefixes) * iterations // Set the number of concurrent workers
 
@@ -48,8 +76,8 @@ func getBackblazeStorageRegions() map[string]string {
 				}()
 
 				formatedRegionCode := region + fmt.Sprintf("%03d", i)
-				endpoint := "s3." + formatedRegionCode + ".backblazeb2.com"
-				addrs, err := net.LookupHost(endpoint)
+				endpoint := backblazeS3Host(formatedRegionCode)
+				addrs, err := resolveHost(ctx, endpoint)
 				if err != nil {
 					return
 				}
@@ -57,7 +85,7 @@ func getBackblazeStorageRegions() map[string]string {
 					return
 				}
 
-				results <- map[string]string{formatedRegionCode: transformLabel(formatedRegionCode)}
+				results <- backblazeRegion(formatedRegionCode)
 			}(region, i)
 		}
 	}
@@ -67,18 +95,34 @@ func getBackblazeStorageRegions() map[string]string {
 		close(results)
 	}()
 
-	regionMap := make(map[string]string)
+	regionMap := make(map[string]Region)
 	for result := range results {
-		for k, v := range result {
-			regionMap[k] = v
-		}
+		regionMap[result.Code] = result
 	}
 
-	return regionMap
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("DNS sweep of backblazeb2.com interrupted: %w", err)
+	}
+	if len(regionMap) == 0 {
+		return nil, fmt.Errorf("no regions resolved under backblazeb2.com")
+	}
+
+	return regionMap, nil
 }
 
-func GetBackblazeRegions() Regions {
-	return Regions{
-		Storage: getBackblazeStorageRegions(),
+func GetBackblazeRegions(ctx context.Context) FetchResult {
+	var result FetchResult
+
+	storageRegions, err := getBackblazeStorageRegions(ctx)
+	result.SetError(CategoryStorage, err)
+	result.Regions = Regions{
+		CategoryStorage: withStorageEndpoints(storageRegions, backblazeS3Host),
 	}
+
+	return result
+}
+
+func init() {
+	Register(NewProvider("backblaze", "Backblaze", []Category{CategoryStorage}, GetBackblazeRegions), WithTimeout(20*time.Second),
+		WithCachePolicy(CachePolicy{TTL: 6 * time.Hour}))
 }
@@ -1,19 +1,25 @@
 package service
 
 import (
-	"fmt"
+	"context"
 	"strings"
 
 	"github.com/PuerkitoBio/goquery"
 )
 
+// digitalOceanSpacesDocsURL lists the regions Spaces is available in.
+const digitalOceanSpacesDocsURL = "https://docs.digitalocean.com/products/spaces/details/availability/"
+
 // getDigitalOceanSpacesRegions retrieves the regions for DigitalOcean Spaces.
 // It makes a GET request to the DigitalOcean Spaces availability URL and parses the HTML response to extract the regions.
 // The regions are then translated using the translateRegions function.
 // Returns a map of region names and their corresponding values.
-func getDigitalOceanSpacesRegions() map[string]string {
-	url := "https://docs.digitalocean.com/products/spaces/details/availability/"
-	doc, _ := get(url)
+func getDigitalOceanSpacesRegions(ctx context.Context) (map[string]Region, error) {
+	url := digitalOceanSpacesDocsURL
+	doc, err := get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
 
 	var regions []string
 
@@ -39,31 +45,122 @@ func getDigitalOceanSpacesRegions() map[string]string {
 		}
 	})
 
-	return translateRegions(regions)
+	return translateRegions(regions), nil
 }
 
-func getDigitalOceanDropletRegions() map[string]string {
-	url := "https://docs.digitalocean.com/platform/regional-availability/"
-	doc, _ := get(url)
+// digitalOceanProductCategories maps the product names of the regional
+// availability table to categories, matched by prefix.
+var digitalOceanProductCategories = []struct {
+	product  string
+	category Category
+}{
+	{"Kubernetes", CategoryKubernetes},
+	{"Volumes", CategoryBlockStorage},
+	{"GPU Droplets", CategoryGPU},
+	{"Managed Databases", CategoryManagedDB},
+	{"Load Balancers", CategoryLoadBalancer},
+}
 
-	var regionMap = make(map[string]string)
+var digitalOceanCategories = []Category{
+	CategoryStorage,
+	CategoryCompute,
+	CategoryKubernetes,
+	CategoryBlockStorage,
+	CategoryGPU,
+	CategoryManagedDB,
+	CategoryLoadBalancer,
+}
+
+// digitalOceanAvailabilityDocsURL lists the products available in every region.
+const digitalOceanAvailabilityDocsURL = "https://docs.digitalocean.com/platform/regional-availability/"
+
+// getDigitalOceanAvailability reads the regional availability page, which
+// lists the datacenters (used for Droplets) and a product by datacenter table
+// for everything else.
+func getDigitalOceanAvailability(ctx context.Context) (Regions, error) {
+	url := digitalOceanAvailabilityDocsURL
+	doc, err := get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	var regionMap = make(map[string]Region)
 	doc.Find("table").Each(func(index int, table *goquery.Selection) {
 		if table.Find("thead th").First().Text() == "Datacenter" {
 			table.Find("tbody tr").Each(func(index int, tr *goquery.Selection) {
-				regionCode := strings.ToLower(tr.Children().Eq(2).Text())
-				regionName := fmt.Sprintf("%s - %s", tr.Children().Eq(1).Text(), regionCode)
+				regionCode := strings.ToLower(strings.TrimSpace(tr.Children().Eq(2).Text()))
+				regionName := strings.TrimSpace(tr.Children().Eq(1).Text())
 				if len(regionCode) > 0 {
-					regionMap[regionCode] = regionName
+					regionMap[regionCode] = newRegion(regionCode, regionName, cleanRegionCode(regionCode))
 				}
 			})
 		}
 	})
-	return regionMap
+
+	regions := Regions{CategoryCompute: regionMap}
+	doc.Find("table").Each(func(index int, table *goquery.Selection) {
+		if strings.TrimSpace(table.Find("thead th").First().Text()) != "Product" {
+			return
+		}
+
+		// Region codes are the column headers after "Product"
+		headers := []string{}
+		table.Find("thead th").Each(func(i int, th *goquery.Selection) {
+			if i > 0 {
+				headers = append(headers, strings.ToLower(strings.TrimSpace(th.Text())))
+			}
+		})
+
+		table.Find("tbody tr").Each(func(index int, tr *goquery.Selection) {
+			product := strings.TrimSpace(tr.Find("td").First().Text())
+			for _, productCategory := range digitalOceanProductCategories {
+				if !strings.HasPrefix(product, productCategory.product) {
+					continue
+				}
+				tr.Find("td").Each(func(i int, td *goquery.Selection) {
+					if i == 0 || i-1 >= len(headers) || td.Find("i.fa-solid.fa-circle").Length() == 0 {
+						return
+					}
+					regionCode := headers[i-1]
+					region, known := regionMap[regionCode]
+					if !known {
+						region = translateRegions([]string{regionCode})[regionCode]
+					}
+					regions.Add(productCategory.category, region)
+				})
+			}
+		})
+	})
+
+	return regions, nil
+}
+
+// digitalOceanS3Host returns the hostname of the Spaces endpoint of a region.
+func digitalOceanS3Host(regionCode string) string {
+	return strings.ToLower(regionCode) + ".digitaloceanspaces.com"
 }
 
-func GetDigitalOceanRegions() Regions {
-	return Regions{
-		Storage: getDigitalOceanSpacesRegions(),
-		Compute: getDigitalOceanDropletRegions(),
+func GetDigitalOceanRegions(ctx context.Context) FetchResult {
+	var result FetchResult
+
+	storageRegions, err := getDigitalOceanSpacesRegions(ctx)
+	result.SetError(CategoryStorage, err)
+
+	regions, err := getDigitalOceanAvailability(ctx)
+	if err != nil {
+		for _, category := range digitalOceanCategories[1:] {
+			result.SetError(category, err)
+		}
+		regions = Regions{}
 	}
+	regions.SetCategory(CategoryStorage, withStorageEndpoints(storageRegions, digitalOceanS3Host))
+	result.Regions = regions
+
+	return result
+}
+
+func init() {
+	Register(NewProvider("digitalocean", "DigitalOcean", digitalOceanCategories, GetDigitalOceanRegions),
+		WithDocsURL(digitalOceanAvailabilityDocsURL),
+		WithDocsURL(digitalOceanSpacesDocsURL, CategoryStorage))
 }
@@ -1,21 +1,51 @@
 package service
 
 import (
-	"fmt"
+	"context"
 	"strings"
 
 	"github.com/PuerkitoBio/goquery"
 )
 
-func getExoscaleStorageRegions() map[string]string {
-	url := "https://www.exoscale.com/datacenters/"
-	doc, err := get(url)
-	if err != nil || doc == nil {
-		// fmt.Printf("[Exoscale] Error fetching or parsing regions: %v\n", err)
-		return map[string]string{}
+// exoscaleMetroAliases maps Exoscale zone city codes that are not metro codes.
+var exoscaleMetroAliases = map[string]string{
+	"dk": "zrh",
+}
+
+// exoscaleRegion builds an Exoscale region from a zone code such as "ch-gva-2".
+func exoscaleRegion(regionCode, locality string) Region {
+	parts := strings.Split(regionCode, "-")
+	metro := ""
+	if len(parts) >= 2 {
+		metro = parts[1]
+		if alias, ok := exoscaleMetroAliases[metro]; ok {
+			metro = alias
+		}
+	}
+
+	region := newRegion(regionCode, locality, metro)
+	if region.Country == "" {
+		region = region.withCountry(parts[0])
 	}
+	return region
+}
+
+// exoscaleS3Host returns the hostname of the SOS endpoint of a zone.
+func exoscaleS3Host(regionCode string) string {
+	return "sos-" + regionCode + ".exo.io"
+}
 
-	var regionMap map[string]string = make(map[string]string)
+// exoscaleDatacentersURL lists the Exoscale zones.
+const exoscaleDatacentersURL = "https://www.exoscale.com/datacenters/"
+
+func getExoscaleStorageRegions(ctx context.Context) (map[string]Region, error) {
+	url := exoscaleDatacentersURL
+	doc, err := get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	var regionMap map[string]Region = make(map[string]Region)
 
 	// Find the datacenters div and parse article elements
 	doc.Find("div.datacenters article").Each(func(i int, article *goquery.Selection) {
@@ -24,17 +54,28 @@ func getExoscaleStorageRegions() map[string]string {
 		regionCode := strings.TrimSpace(article.Find("span.datacenters-name").Text())
 
 		if locality != "" && regionCode != "" {
-			regionMap[regionCode] = fmt.Sprintf("%s - %s", locality, regionCode)
+			regionMap[regionCode] = exoscaleRegion(regionCode, locality)
 		}
 	})
 
-	return regionMap
+	return regionMap, nil
 }
 
-func GetExoscaleRegions() Regions {
-	regions := getExoscaleStorageRegions()
-	return Regions{
-		Storage: regions,
-		Compute: regions,
+func GetExoscaleRegions(ctx context.Context) FetchResult {
+	regions, err := getExoscaleStorageRegions(ctx)
+	if err != nil {
+		return failedResult(err, CategoryStorage, CategoryCompute)
 	}
+
+	return FetchResult{
+		Regions: Regions{
+			CategoryStorage: withStorageEndpoints(regions, exoscaleS3Host),
+			CategoryCompute: regions,
+		},
+	}
+}
+
+func init() {
+	Register(NewProvider("exoscale", "Exoscale", []Category{CategoryStorage, CategoryCompute}, GetExoscaleRegions),
+		WithDocsURL(exoscaleDatacentersURL))
 }
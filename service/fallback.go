@@ -0,0 +1,87 @@
+package service
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+//go:generate go run ../cmd/update_fallbacks -dir fallback
+
+// fallbackFiles holds a snapshot of every provider's regions, taken from a
+// successful live run, in fallback/<provider id>.json.
+//
+//go:embed fallback/*.json
+var fallbackFiles embed.FS
+
+// Snapshot is the content of a fallback file.
+type Snapshot struct {
+	Provider    string    `json:"provider"`
+	GeneratedAt time.Time `json:"generated_at"`
+	Regions     Regions   `json:"regions"`
+}
+
+// FallbackFile returns the path of a provider's fallback file relative to
+// the fallback directory.
+func FallbackFile(id string) string {
+	return id + ".json"
+}
+
+// LoadFallback returns the embedded snapshot of a provider.
+func LoadFallback(id string) (Snapshot, error) {
+	data, err := fallbackFiles.ReadFile("fallback/" + FallbackFile(id))
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("no fallback snapshot for %s: %w", id, err)
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return Snapshot{}, fmt.Errorf("fallback snapshot for %s unusable: %w", id, err)
+	}
+	return snapshot, nil
+}
+
+// ApplyFallback fills the categories that failed without returning any region
+// from the provider's embedded snapshot. The category errors are kept, so the
+// failure is still reported, a warning notes which categories come from the
+// snapshot, and the provenance of the result becomes SourceFallback.
+func ApplyFallback(p Provider, result FetchResult) FetchResult {
+	var failed []Category
+	for category, err := range result.Errors {
+		if err != nil && len(result.Regions[category]) == 0 {
+			failed = append(failed, category)
+		}
+	}
+	if len(failed) == 0 {
+		return result
+	}
+	sort.Slice(failed, func(i, j int) bool {
+		return failed[i] < failed[j]
+	})
+
+	snapshot, err := LoadFallback(p.ID())
+	if err != nil {
+		result.Warn("%v", err)
+		return result
+	}
+
+	var filled []string
+	for _, category := range failed {
+		if regions := snapshot.Regions[category]; len(regions) > 0 {
+			result.Regions.SetCategory(category, regions)
+			filled = append(filled, string(category))
+		}
+	}
+	if len(filled) > 0 {
+		result.Warn("using fallback snapshot from %s for %s", snapshot.GeneratedAt.Format(time.DateOnly), strings.Join(filled, ", "))
+		result.Provenance.Source = SourceFallback
+		result.Provenance.Warnings = append([]string(nil), result.Warnings...)
+		for _, category := range filled {
+			result.Provenance.FallbackCategories = append(result.Provenance.FallbackCategories, Category(category))
+		}
+	}
+	return result
+}
@@ -1,17 +1,87 @@
 package service
 
 import (
-	"fmt"
+	"context"
+	"regexp"
 	"strings"
 
 	"github.com/PuerkitoBio/goquery"
 )
 
-func getGoogleCloudStorageRegions() map[string]string {
-	url := "https://cloud.google.com/storage/docs/locations/"
-	doc, _ := get(url)
+// gcpRegionMetros maps Google Cloud region codes to the metro code of their
+// location.
+var gcpRegionMetros = map[string]string{
+	"africa-south1":           "jnb",
+	"asia-east1":              "rmq",
+	"asia-east2":              "hkg",
+	"asia-northeast1":         "nrt",
+	"asia-northeast2":         "kix",
+	"asia-northeast3":         "icn",
+	"asia-south1":             "bom",
+	"asia-south2":             "del",
+	"asia-southeast1":         "sin",
+	"asia-southeast2":         "cgk",
+	"australia-southeast1":    "syd",
+	"australia-southeast2":    "mel",
+	"europe-central2":         "waw",
+	"europe-north1":           "hmn",
+	"europe-north2":           "arn",
+	"europe-southwest1":       "mad",
+	"europe-west1":            "ghl",
+	"europe-west2":            "lhr",
+	"europe-west3":            "fra",
+	"europe-west4":            "eem",
+	"europe-west6":            "zrh",
+	"europe-west8":            "mxp",
+	"europe-west9":            "cdg",
+	"europe-west10":           "ber",
+	"europe-west12":           "trn",
+	"me-central1":             "doh",
+	"me-central2":             "dmm",
+	"me-west1":                "tlv",
+	"northamerica-northeast1": "yul",
+	"northamerica-northeast2": "yyz",
+	"northamerica-south1":     "qro",
+	"southamerica-east1":      "gru",
+	"southamerica-west1":      "scl",
+	"us-central1":             "cbf",
+	"us-east1":                "mck",
+	"us-east4":                "iad",
+	"us-east5":                "cmh",
+	"us-south1":               "dfw",
+	"us-west1":                "dls",
+	"us-west2":                "lax",
+	"us-west3":                "slc",
+	"us-west4":                "las",
+}
+
+// gcpZoneSuffix matches the zone letter at the end of a zone code such as
+// "us-central1-a".
+var gcpZoneSuffix = regexp.MustCompile(`-[a-z]$`)
+
+// gcpRegionOf returns the region a zone code belongs to, or the code itself if
+// it is already a region.
+func gcpRegionOf(code string) string {
+	return gcpZoneSuffix.ReplaceAllString(code, "")
+}
+
+// gcpRegion builds a Google Cloud region with its location filled in from the
+// code.
+func gcpRegion(code, name string) Region {
+	return newRegion(code, name, gcpRegionMetros[gcpRegionOf(code)])
+}
+
+// gcpStorageDocsURL lists the Cloud Storage locations.
+const gcpStorageDocsURL = "https://cloud.google.com/storage/docs/locations/"
+
+func getGoogleCloudStorageRegions(ctx context.Context) (map[string]Region, error) {
+	url := gcpStorageDocsURL
+	doc, err := get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
 
-	var regionMap map[string]string = make(map[string]string)
+	var regionMap map[string]Region = make(map[string]Region)
 	doc.Find("table").Each(func(i int, table *goquery.Selection) {
 		// if table doesn't have more than 2 rows, return
 		if table.Find("tbody tr").Length() < 2 {
@@ -25,41 +95,82 @@ func getGoogleCloudStorageRegions() map[string]string {
 		table.Find("tbody tr").Each(func(i int, row *goquery.Selection) {
 			// check if td:nth-child(1) is not empty
 			if row.Find("td").Eq(1).Text() != "" {
-				regionCode := strings.ToLower(row.Find("td").Eq(1).Text())
-				// regionName := row.Find("td").Eq(2).Text()
-				key := currentRegion + " - " + regionCode
-				regionMap[regionCode] = key
+				regionCode := strings.ToLower(strings.TrimSpace(row.Find("td").Eq(1).Text()))
+				regionName := strings.TrimSpace(row.Find("td").Eq(2).Text())
+				if regionName == "" {
+					regionName = currentRegion
+				}
+				regionMap[regionCode] = gcpRegion(regionCode, regionName).withTag("area", currentRegion)
 			} else {
-				currentRegion = row.Find("td").Eq(0).Text()
+				currentRegion = strings.TrimSpace(row.Find("td").Eq(0).Text())
 			}
 		})
 
 	})
 
-	return regionMap
+	return regionMap, nil
 }
-func getGoogleCloudComputeRegions() map[string]string {
-	url := "https://cloud.google.com/compute/docs/regions-zones"
-	doc, _ := get(url)
 
-	var regionMap map[string]string = make(map[string]string)
+// gcpComputeDocsURL lists the Compute Engine regions and zones.
+const gcpComputeDocsURL = "https://cloud.google.com/compute/docs/regions-zones"
+
+func getGoogleCloudComputeRegions(ctx context.Context) (map[string]Region, error) {
+	url := gcpComputeDocsURL
+	doc, err := get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	var regionMap map[string]Region = make(map[string]Region)
 	doc.Find("table").Each(func(i int, table *goquery.Selection) {
 		if table.Find("thead th").Length() == 6 {
+			// Each row is a zone; group them under their region
 			table.Find("tbody tr").Each(func(i int, row *goquery.Selection) {
-				regionCode := strings.ToLower(row.Find("td").Eq(0).Text())
-				regionName := row.Find("td").Eq(1).Text()
-				regionMap[regionCode] = fmt.Sprintf("%s - %s", regionName, regionCode)
+				zoneCode := strings.ToLower(strings.TrimSpace(row.Find("td").Eq(0).Text()))
+				regionName := strings.TrimSpace(row.Find("td").Eq(1).Text())
+				regionCode := gcpRegionOf(zoneCode)
+
+				region, exists := regionMap[regionCode]
+				if !exists {
+					region = gcpRegion(regionCode, regionName)
+				}
+				if zoneCode != regionCode {
+					region = region.withZone(Zone{ID: zoneCode, State: ZoneStateAvailable})
+				}
+				regionMap[regionCode] = region
 			})
 		}
 
 	})
+	sortZones(regionMap)
 
-	return regionMap
+	return regionMap, nil
 }
 
-func GetGoogleCloudRegions() Regions {
-	return Regions{
-		Storage: getGoogleCloudStorageRegions(),
-		Compute: getGoogleCloudComputeRegions(),
+func GetGoogleCloudRegions(ctx context.Context) FetchResult {
+	var result FetchResult
+
+	storageRegions, err := getGoogleCloudStorageRegions(ctx)
+	result.SetError(CategoryStorage, err)
+	computeRegions, err := getGoogleCloudComputeRegions(ctx)
+	result.SetError(CategoryCompute, err)
+
+	result.Regions = Regions{
+		CategoryStorage: storageRegions,
+		CategoryCompute: computeRegions,
 	}
+
+	return result
+}
+
+func init() {
+	Register(NewProvider("gcp", "Google Cloud", []Category{CategoryStorage, CategoryCompute}, GetGoogleCloudRegions),
+		WithDocsURL(gcpStorageDocsURL, CategoryStorage),
+		WithDocsURL(gcpComputeDocsURL, CategoryCompute),
+		// Compute was keyed by zone, one entry per row of the page
+		WithLegacyZones(CategoryCompute),
+		WithSanityRules(SanityRules{Required: map[Category][]string{
+			CategoryStorage: {"us-central1"},
+			CategoryCompute: {"us-central1"},
+		}}))
 }
@@ -1,17 +1,53 @@
 package service
 
 import (
-	"fmt"
+	"context"
 	"strings"
 
 	"github.com/PuerkitoBio/goquery"
 )
 
-func getHetznerRegions() map[string]string {
-	url := "https://docs.hetzner.com/cloud/general/locations/"
-	doc, _ := get(url)
+// hetznerMetroAliases maps Hetzner location codes that are not metro codes.
+var hetznerMetroAliases = map[string]string{
+	"ash": "iad",
+}
+
+// hetznerRegion builds a Hetzner region from a location code such as "fsn1".
+func hetznerRegion(regionCode, locationName string) Region {
+	metro := cleanRegionCode(regionCode)
+	if alias, ok := hetznerMetroAliases[metro]; ok {
+		metro = alias
+	}
+	return newRegion(regionCode, locationName, metro)
+}
+
+// hetznerObjectStorageLocations lists the locations that offer Object Storage.
+var hetznerObjectStorageLocations = map[string]bool{
+	"fsn1": true,
+	"nbg1": true,
+	"hel1": true,
+}
+
+// hetznerS3Host returns the hostname of the Object Storage endpoint of a
+// location, or an empty string if the location has no Object Storage.
+func hetznerS3Host(regionCode string) string {
+	if !hetznerObjectStorageLocations[regionCode] {
+		return ""
+	}
+	return regionCode + ".your-objectstorage.com"
+}
+
+// hetznerLocationsDocsURL lists the Hetzner Cloud locations.
+const hetznerLocationsDocsURL = "https://docs.hetzner.com/cloud/general/locations/"
+
+func getHetznerRegions(ctx context.Context) (map[string]Region, error) {
+	url := hetznerLocationsDocsURL
+	doc, err := get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
 
-	regionMap := make(map[string]string)
+	regionMap := make(map[string]Region)
 
 	// Select the first table in the document
 	table := doc.Find("table").First()
@@ -31,13 +67,13 @@ func getHetznerRegions() map[string]string {
 
 				// Clean up the location name
 				if locationName != "" {
-					regionMap[regionCode] = fmt.Sprintf("%s - %s", locationName, regionCode)
+					regionMap[regionCode] = hetznerRegion(regionCode, locationName)
 				}
 			}
 		})
 	})
 
-	return regionMap
+	return regionMap, nil
 }
 
 // Helper to strip HTML tags from a string
@@ -60,10 +96,25 @@ func stripTags(html string) string {
 	return result.String()
 }
 
-func GetHetznerRegions() Regions {
-	regions := getHetznerRegions()
-	return Regions{
-		Compute: regions,
-		Storage: regions,
+func GetHetznerRegions(ctx context.Context) FetchResult {
+	regions, err := getHetznerRegions(ctx)
+	if err != nil {
+		return failedResult(err, CategoryStorage, CategoryCompute)
 	}
+
+	return FetchResult{
+		Regions: Regions{
+			CategoryCompute: regions,
+			CategoryStorage: withStorageEndpoints(regions, hetznerS3Host),
+		},
+	}
+}
+
+func init() {
+	Register(NewProvider("hetzner", "Hetzner", []Category{CategoryStorage, CategoryCompute}, GetHetznerRegions),
+		WithDocsURL(hetznerLocationsDocsURL),
+		WithSanityRules(SanityRules{Required: map[Category][]string{
+			CategoryStorage: {"fsn1"},
+			CategoryCompute: {"fsn1"},
+		}}))
 }
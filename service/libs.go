@@ -1,8 +1,8 @@
 package service
 
 import (
-	"fmt"
 	"regexp"
+	"strings"
 )
 
 // regionMapping is a map that stores the translation of region codes to their corresponding names.
@@ -25,30 +25,36 @@ var regionMapping = map[string]string{
 	"ATL": "Atlanta",
 }
 
+// regionCodeDigits matches the numeric suffix of codes such as "NYC3".
+var regionCodeDigits = regexp.MustCompile("[0-9]+")
+
+// cleanRegionCode removes any numbers from a region code, leaving the metro code.
+func cleanRegionCode(code string) string {
+	return regionCodeDigits.ReplaceAllString(code, "")
+}
+
 // translateRegionCode translates a region code into a city name.
 // It removes any numbers from the code and looks up the city name using the cleaned code.
 // If the city name is found, it is returned. Otherwise, "Region code not found" is returned.
 func translateRegionCode(code string) string {
-	// Use regular expression to remove numbers
-	re := regexp.MustCompile("[0-9]+")
-	cleanCode := re.ReplaceAllString(code, "")
+	cleanCode := cleanRegionCode(code)
 
 	// Lookup the city name using the cleaned code
-	city, exists := regionMapping[cleanCode]
+	city, exists := regionMapping[strings.ToUpper(cleanCode)]
 	if exists {
 		return city
 	}
 	return "Region code not found"
 }
 
-// translateRegions translates a slice of region codes into a key-value pair of region codes and city names.
+// translateRegions translates a slice of region codes into regions named after their city.
 // It iterates over the regions and calls translateRegionCode to get the city name for each region.
-func translateRegions(regions []string) map[string]string {
-	translatedRegions := make(map[string]string)
+func translateRegions(regions []string) map[string]Region {
+	translatedRegions := make(map[string]Region)
 
 	for _, region := range regions {
 		city := translateRegionCode(region)
-		translatedRegions[region] = fmt.Sprintf("%s - %s", city, region)
+		translatedRegions[region] = newRegion(region, city, strings.ToLower(cleanRegionCode(region)))
 	}
 
 	return translatedRegions
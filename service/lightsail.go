@@ -1,32 +1,63 @@
 package service
 
 import (
+	"context"
+	"fmt"
 	"strings"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
 )
 
-func getLightsailComputeRegions() map[string]string {
-	url := "https://docs.aws.amazon.com/lightsail/latest/userguide/understanding-regions-and-availability-zones-in-amazon-lightsail.html"
-	doc, _ := get(url)
+// lightsailDocsURL lists the Lightsail regions.
+const lightsailDocsURL = "https://docs.aws.amazon.com/lightsail/latest/userguide/understanding-regions-and-availability-zones-in-amazon-lightsail.html"
 
-	var regionMap map[string]string = make(map[string]string)
+func getLightsailComputeRegions(ctx context.Context) (map[string]Region, error) {
+	url := lightsailDocsURL
+	doc, err := get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	var regionMap map[string]Region = make(map[string]Region)
 
 	doc.Find(".listitem").Each(func(i int, listItem *goquery.Selection) {
 		value := listItem.Find("p").Text()
 
 		// there are two pairs of parentheses in the value, extract the regionCode from the second pair
-		regionCode := value[strings.LastIndex(value, "(")+1 : strings.LastIndex(value, ")")]
-		regionName := value
-
-		regionMap[regionCode] = regionName
+		open, close := strings.LastIndex(value, "("), strings.LastIndex(value, ")")
+		if open < 0 || close < open {
+			return
+		}
+		regionCode := value[open+1 : close]
+		regionName := strings.TrimSpace(value[:open])
+
+		regionMap[regionCode] = awsRegion(regionCode, regionName)
 	})
 
-	return regionMap
+	if len(regionMap) == 0 {
+		return nil, fmt.Errorf("no regions found on %s", url)
+	}
+
+	addAWSZones(regionMap, doc.Text())
+
+	return regionMap, nil
 }
 
-func GetLightsailRegions() Regions {
-	return Regions{
-		Compute: getLightsailComputeRegions(),
+func GetLightsailRegions(ctx context.Context) FetchResult {
+	var result FetchResult
+
+	computeRegions, err := getLightsailComputeRegions(ctx)
+	result.SetError(CategoryCompute, err)
+	result.Regions = Regions{
+		CategoryCompute: computeRegions,
 	}
+
+	return result
+}
+
+func init() {
+	Register(NewProvider("lightsail", "Amazon Lightsail", []Category{CategoryCompute}, GetLightsailRegions),
+		WithCachePolicy(CachePolicy{TTL: 72 * time.Hour}),
+		WithDocsURL(lightsailDocsURL))
 }
@@ -1,10 +1,8 @@
 package service
 
 import (
-	"encoding/json"
-	"fmt"
-	"io"
-	"net/http"
+	"context"
+	"regexp"
 	"strings"
 
 	"github.com/PuerkitoBio/goquery"
@@ -14,6 +12,7 @@ type LinodeRegion struct {
 	ID      string   `json:"id"`
 	Label   string   `json:"label"`
 	Country string   `json:"country"`
+	Status  string   `json:"status"`
 	Options []string `json:"capabilities"`
 }
 
@@ -21,14 +20,56 @@ type LinodeResponse struct {
 	Regions []LinodeRegion `json:"data"`
 }
 
-func getLinodeStorageRegions() (map[string]string, error) {
-	url := "https://www.linode.com/docs/products/storage/object-storage/"
-	doc, err := get(url)
+// linodeLegacyMetros maps the Linode region IDs that predate the
+// "<country>-<metro>" naming scheme to their metro code.
+var linodeLegacyMetros = map[string]string{
+	"ap-northeast": "nrt",
+	"ap-south":     "sin",
+	"ap-southeast": "syd",
+	"ap-west":      "bom",
+	"ca-central":   "yyz",
+	"eu-central":   "fra",
+	"eu-west":      "lhr",
+	"us-central":   "dfw",
+	"us-east":      "ewr",
+	"us-southeast": "atl",
+	"us-west":      "fmt",
+}
+
+// linodeDigitSuffix matches the numeric suffix of IDs such as "us-east-1" or
+// "jp-tyo-3".
+var linodeDigitSuffix = regexp.MustCompile(`-[0-9]+$`)
+
+// linodeRegion builds a Linode region, locating it from the region or object
+// storage cluster ID.
+func linodeRegion(regionCode, regionName string) Region {
+	id := linodeDigitSuffix.ReplaceAllString(regionCode, "")
+	metro, ok := linodeLegacyMetros[id]
+	if !ok {
+		if parts := strings.Split(id, "-"); len(parts) == 2 {
+			metro = parts[1]
+		}
+	}
+	return newRegion(regionCode, regionName, metro)
+}
+
+// linodeS3Host returns the hostname of the S3 endpoint of an object storage
+// cluster.
+func linodeS3Host(clusterID string) string {
+	return clusterID + ".linodeobjects.com"
+}
+
+// linodeObjectStorageDocsURL lists the Object Storage regions.
+const linodeObjectStorageDocsURL = "https://www.linode.com/docs/products/storage/object-storage/"
+
+func getLinodeStorageRegions(ctx context.Context) (map[string]Region, error) {
+	url := linodeObjectStorageDocsURL
+	doc, err := get(ctx, url)
 	if err != nil {
 		return nil, err
 	}
 
-	var regionMap map[string]string = make(map[string]string)
+	var regionMap map[string]Region = make(map[string]Region)
 	doc.Find("table").Each(func(i int, table *goquery.Selection) {
 		// if table doesn't have more than 2 rows, return
 		if table.Find("tbody tr").Length() < 5 {
@@ -38,9 +79,9 @@ func getLinodeStorageRegions() (map[string]string, error) {
 		if table.Find("thead th").Length() == 2 && table.Find("thead th").Eq(0).Text() == "Data Center" {
 
 			table.Find("tbody tr").Each(func(i int, row *goquery.Selection) {
-				regionCode := row.Find("td").Eq(1).Text()
-				regionName := strings.ReplaceAll(row.Find("td").Eq(0).Text(), "*", "")
-				regionMap[regionCode] = fmt.Sprintf("%s - %s", regionName, regionCode)
+				regionCode := strings.TrimSpace(row.Find("td").Eq(1).Text())
+				regionName := strings.TrimSpace(strings.ReplaceAll(row.Find("td").Eq(0).Text(), "*", ""))
+				regionMap[regionCode] = linodeRegion(regionCode, regionName)
 			})
 		}
 	})
@@ -48,31 +89,45 @@ func getLinodeStorageRegions() (map[string]string, error) {
 	return regionMap, nil
 }
 
-func getLinodeData() LinodeResponse {
+func getLinodeData(ctx context.Context) (LinodeResponse, error) {
 	url := "https://api.linode.com/v4/regions"
-	resp, err := http.Get(url)
-	if err != nil {
-		panic(err)
-	}
 
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		panic(err)
+	var data LinodeResponse
+	if err := getJSON(ctx, url, &data); err != nil {
+		return LinodeResponse{}, err
 	}
 
-	var data LinodeResponse
-	json.Unmarshal(body, &data)
+	return data, nil
+}
+
+// linodeCapabilityCategories maps the capabilities reported by the API to
+// the categories they indicate.
+var linodeCapabilityCategories = map[string]Category{
+	"Block Storage":     CategoryBlockStorage,
+	"GPU Linodes":       CategoryGPU,
+	"Kubernetes":        CategoryKubernetes,
+	"Managed Databases": CategoryManagedDB,
+	"NodeBalancers":     CategoryLoadBalancer,
+}
 
-	return data
+// addLinodeCapabilityRegions adds every region to the categories its
+// capabilities indicate.
+func addLinodeCapabilityRegions(regions Regions, data LinodeResponse) {
+	for _, region := range data.Regions {
+		for _, capability := range region.Options {
+			if category, ok := linodeCapabilityCategories[capability]; ok {
+				regions.Add(category, linodeAPIRegion(region))
+			}
+		}
+	}
 }
 
-func getLinodeComputeRegions(data LinodeResponse) map[string]string {
-	var regionMap map[string]string = make(map[string]string)
+func getLinodeComputeRegions(data LinodeResponse) map[string]Region {
+	var regionMap map[string]Region = make(map[string]Region)
 	for _, region := range data.Regions {
 		for _, option := range region.Options {
 			if option == "Linodes" {
-				regionMap[region.ID] = fmt.Sprintf("%s - %s", region.Label, region.ID)
+				regionMap[region.ID] = linodeAPIRegion(region)
 			}
 		}
 	}
@@ -80,72 +135,55 @@ func getLinodeComputeRegions(data LinodeResponse) map[string]string {
 	return regionMap
 }
 
-func GetLinodeRegions() Regions {
-	storageRegions, err := getLinodeStorageRegions()
-	if err != nil {
-		// fmt.Printf("Error: %v", err)
-		// Load the regions from the local file ./linode_fallback.json
-		jsonContent := `{
-			"storage": {
-				"ap-south-1": "Singapore - ap-south-1",
-				"br-gru-1": "São Paulo (Brazil) - br-gru-1",
-				"es-mad-1": "Madrid (Spain) - es-mad-1",
-				"eu-central-1": "Frankfurt (Germany) - eu-central-1",
-				"fr-par-1": "Paris (France) - fr-par-1",
-				"id-cgk-1": "Jakarta (Indonesia) - id-cgk-1",
-				"in-maa-1": "Chennai (India) - in-maa-1",
-				"it-mil-1": "Milan (Italy) - it-mil-1",
-				"jp-osa-1": "Osaka (Japan) - jp-osa-1",
-				"nl-ams-1": "Amsterdam (Netherlands) - nl-ams-1",
-				"se-sto-1": "Stockholm (Sweden) - se-sto-1",
-				"us-east-1": "Newark, NJ (USA) - us-east-1",
-				"us-iad-1": "Washington, DC (USA) - us-iad-1",
-				"us-lax-1": "Los Angeles, CA (USA) - us-lax-1",
-				"us-mia-1": "Miami, FL (USA) - us-mia-1",
-				"us-ord-1": "Chicago, IL (USA) - us-ord-1",
-				"us-sea-1": "Seattle, WA (USA) - us-sea-1",
-				"us-southeast-1": "Atlanta, GA (USA) - us-southeast-1"
-			},
-			"compute": {
-				"ap-northeast": "Tokyo, JP - ap-northeast",
-				"ap-south": "Singapore, SG - ap-south",
-				"ap-southeast": "Sydney, AU - ap-southeast",
-				"ap-west": "Mumbai, IN - ap-west",
-				"br-gru": "Sao Paulo, BR - br-gru",
-				"ca-central": "Toronto, CA - ca-central",
-				"es-mad": "Madrid, ES - es-mad",
-				"eu-central": "Frankfurt, DE - eu-central",
-				"eu-west": "London, UK - eu-west",
-				"fr-par": "Paris, FR - fr-par",
-				"id-cgk": "Jakarta, ID - id-cgk",
-				"in-maa": "Chennai, IN - in-maa",
-				"it-mil": "Milan, IT - it-mil",
-				"jp-osa": "Osaka, JP - jp-osa",
-				"nl-ams": "Amsterdam, NL - nl-ams",
-				"se-sto": "Stockholm, SE - se-sto",
-				"us-central": "Dallas, TX - us-central",
-				"us-east": "Newark, NJ - us-east",
-				"us-iad": "Washington, DC - us-iad",
-				"us-lax": "Los Angeles, CA - us-lax",
-				"us-mia": "Miami, FL - us-mia",
-				"us-ord": "Chicago, IL - us-ord",
-				"us-sea": "Seattle, WA - us-sea",
-				"us-southeast": "Atlanta, GA - us-southeast",
-				"us-west": "Fremont, CA - us-west"
-			}
-		}`
+// linodeAPIRegion builds a region from the API, which reports the country
+// directly and the city as the first part of the label ("Tokyo 2, JP").
+func linodeAPIRegion(data LinodeRegion) Region {
+	region := linodeRegion(data.ID, data.Label)
+	if region.City == "" {
+		region.City = strings.TrimSpace(regionCodeDigits.ReplaceAllString(strings.Split(data.Label, ",")[0], ""))
+	}
+	if data.Country != "" {
+		region = region.withCountry(countryCode(data.Country))
+	}
+	return region.withTag("status", data.Status)
+}
 
-		// json has "storage" and "compute" keys
-		var regions map[string]map[string]string
-		json.Unmarshal([]byte(jsonContent), &regions)
+func GetLinodeRegions(ctx context.Context) FetchResult {
+	var result FetchResult
 
-		return Regions{
-			Storage: regions["storage"],
-			Compute: regions["compute"],
-		}
+	storageRegions, err := getLinodeStorageRegions(ctx)
+	result.SetError(CategoryStorage, err)
+	result.Regions = Regions{
+		CategoryStorage: withStorageEndpoints(storageRegions, linodeS3Host),
 	}
-	return Regions{
-		Storage: storageRegions,
-		Compute: getLinodeComputeRegions(getLinodeData()),
+
+	data, err := getLinodeData(ctx)
+	if err != nil {
+		result.SetError(CategoryCompute, err)
+		for _, category := range linodeCapabilityCategories {
+			result.SetError(category, err)
+		}
+		return result
 	}
+
+	result.Regions.SetCategory(CategoryCompute, getLinodeComputeRegions(data))
+	addLinodeCapabilityRegions(result.Regions, data)
+
+	return result
+}
+
+func init() {
+	Register(NewProvider("linode", "Linode", []Category{
+		CategoryStorage,
+		CategoryCompute,
+		CategoryKubernetes,
+		CategoryBlockStorage,
+		CategoryGPU,
+		CategoryManagedDB,
+		CategoryLoadBalancer,
+	}, GetLinodeRegions),
+		WithDocsURL(linodeObjectStorageDocsURL, CategoryStorage),
+		WithSanityRules(SanityRules{Required: map[Category][]string{
+			CategoryCompute: {"us-east"},
+		}}))
 }
@@ -0,0 +1,239 @@
+package service
+
+import "strings"
+
+// Continent names used in Region.Continent.
+const (
+	ContinentAfrica       = "Africa"
+	ContinentAsia         = "Asia"
+	ContinentEurope       = "Europe"
+	ContinentNorthAmerica = "North America"
+	ContinentOceania      = "Oceania"
+	ContinentSouthAmerica = "South America"
+)
+
+// Location is the physical place a region is hosted in.
+type Location struct {
+	City      string
+	Country   string // ISO 3166-1 alpha-2 code
+	Latitude  float64
+	Longitude float64
+}
+
+// locations maps metro codes (mostly IATA codes of the nearest airport, as
+// many providers use them in their region codes) to their location.
+var locations = map[string]Location{
+	// North America
+	"atl": {"Atlanta", "US", 33.749, -84.388},
+	"chi": {"Chicago", "US", 41.878, -87.630},
+	"cmh": {"Columbus", "US", 39.961, -82.999},
+	"cbf": {"Council Bluffs", "US", 41.262, -95.861},
+	"dfw": {"Dallas", "US", 32.777, -96.797},
+	"dls": {"The Dalles", "US", 45.594, -121.179},
+	"ewr": {"Newark", "US", 40.736, -74.172},
+	"fmt": {"Fremont", "US", 37.548, -121.989},
+	"hil": {"Hillsboro", "US", 45.523, -122.990},
+	"hnl": {"Honolulu", "US", 21.307, -157.858},
+	"iad": {"Ashburn", "US", 39.044, -77.487},
+	"las": {"Las Vegas", "US", 36.170, -115.140},
+	"lax": {"Los Angeles", "US", 34.052, -118.244},
+	"mck": {"Moncks Corner", "US", 33.196, -80.013},
+	"mex": {"Mexico City", "MX", 19.433, -99.133},
+	"mia": {"Miami", "US", 25.762, -80.192},
+	"nyc": {"New York", "US", 40.713, -74.006},
+	"ord": {"Chicago", "US", 41.878, -87.630},
+	"pdx": {"Portland", "US", 45.515, -122.679},
+	"phx": {"Phoenix", "US", 33.448, -112.074},
+	"qro": {"Querétaro", "MX", 20.589, -100.390},
+	"sac": {"Sacramento", "US", 38.582, -121.494},
+	"sea": {"Seattle", "US", 47.606, -122.332},
+	"sfo": {"San Francisco", "US", 37.775, -122.419},
+	"sjc": {"San Jose", "US", 37.339, -121.895},
+	"slc": {"Salt Lake City", "US", 40.761, -111.891},
+	"was": {"Washington", "US", 38.907, -77.037},
+	"yul": {"Montréal", "CA", 45.502, -73.567},
+	"yyc": {"Calgary", "CA", 51.045, -114.072},
+	"yyz": {"Toronto", "CA", 43.653, -79.383},
+
+	// South America
+	"gru": {"São Paulo", "BR", -23.551, -46.633},
+	"scl": {"Santiago", "CL", -33.449, -70.669},
+
+	// Europe
+	"ams": {"Amsterdam", "NL", 52.368, 4.904},
+	"arn": {"Stockholm", "SE", 59.329, 18.069},
+	"ath": {"Athens", "GR", 37.984, 23.728},
+	"ber": {"Berlin", "DE", 52.520, 13.405},
+	"cdg": {"Paris", "FR", 48.857, 2.352},
+	"cph": {"Copenhagen", "DK", 55.676, 12.568},
+	"dub": {"Dublin", "IE", 53.350, -6.260},
+	"eem": {"Eemshaven", "NL", 53.438, 6.834},
+	"fra": {"Frankfurt", "DE", 50.110, 8.682},
+	"fsn": {"Falkenstein", "DE", 50.478, 12.371},
+	"ghl": {"St. Ghislain", "BE", 50.471, 3.819},
+	"gva": {"Geneva", "CH", 46.204, 6.143},
+	"hel": {"Helsinki", "FI", 60.170, 24.938},
+	"hmn": {"Hamina", "FI", 60.570, 27.198},
+	"lhr": {"London", "GB", 51.507, -0.128},
+	"mad": {"Madrid", "ES", 40.417, -3.704},
+	"man": {"Manchester", "GB", 53.481, -2.243},
+	"muc": {"Munich", "DE", 48.135, 11.582},
+	"mxp": {"Milan", "IT", 45.464, 9.190},
+	"nbg": {"Nuremberg", "DE", 49.452, 11.077},
+	"osl": {"Oslo", "NO", 59.914, 10.752},
+	"rom": {"Rome", "IT", 41.903, 12.496},
+	"sof": {"Sofia", "BG", 42.698, 23.322},
+	"svg": {"Stavanger", "NO", 58.970, 5.733},
+	"trn": {"Turin", "IT", 45.070, 7.687},
+	"vie": {"Vienna", "AT", 48.208, 16.374},
+	"waw": {"Warsaw", "PL", 52.230, 21.012},
+	"zag": {"Zagreb", "HR", 45.815, 15.982},
+	"zaz": {"Zaragoza", "ES", 41.649, -0.889},
+	"zrh": {"Zurich", "CH", 47.377, 8.541},
+
+	// Middle East and Africa
+	"bah": {"Manama", "BH", 26.229, 50.586},
+	"cpt": {"Cape Town", "ZA", -33.925, 18.424},
+	"dmm": {"Dammam", "SA", 26.420, 50.089},
+	"doh": {"Doha", "QA", 25.285, 51.531},
+	"dxb": {"Dubai", "AE", 25.205, 55.271},
+	"jnb": {"Johannesburg", "ZA", -26.204, 28.047},
+	"tlv": {"Tel Aviv", "IL", 32.085, 34.782},
+
+	// Asia
+	"blr": {"Bangalore", "IN", 12.972, 77.595},
+	"bkk": {"Bangkok", "TH", 13.756, 100.502},
+	"bom": {"Mumbai", "IN", 19.076, 72.878},
+	"cgk": {"Jakarta", "ID", -6.208, 106.846},
+	"del": {"Delhi", "IN", 28.614, 77.209},
+	"hkg": {"Hong Kong", "HK", 22.320, 114.169},
+	"hyd": {"Hyderabad", "IN", 17.385, 78.487},
+	"icn": {"Seoul", "KR", 37.567, 126.978},
+	"kix": {"Osaka", "JP", 34.694, 135.502},
+	"kul": {"Kuala Lumpur", "MY", 3.139, 101.687},
+	"maa": {"Chennai", "IN", 13.083, 80.271},
+	"nrt": {"Tokyo", "JP", 35.690, 139.692},
+	"rmq": {"Changhua County", "TW", 24.052, 120.516},
+	"sin": {"Singapore", "SG", 1.352, 103.820},
+	"tpe": {"Taipei", "TW", 25.033, 121.565},
+
+	// Oceania
+	"akl": {"Auckland", "NZ", -36.849, 174.763},
+	"mel": {"Melbourne", "AU", -37.814, 144.963},
+	"syd": {"Sydney", "AU", -33.869, 151.209},
+}
+
+// metroAliases maps alternative metro codes used by providers to the code
+// used in locations.
+var metroAliases = map[string]string{
+	"bne": "syd",
+	"gdl": "mex",
+	"itm": "kix",
+	"lon": "lhr",
+	"mil": "mxp",
+	"osa": "kix",
+	"par": "cdg",
+	"sao": "gru",
+	"sgp": "sin",
+	"sjo": "sjc",
+	"sto": "arn",
+	"tok": "nrt",
+	"tyo": "nrt",
+	"yto": "yyz",
+	"tor": "yyz",
+}
+
+// countryContinents maps ISO 3166-1 alpha-2 country codes to their continent.
+var countryContinents = map[string]string{
+	"AE": ContinentAsia, "AT": ContinentEurope, "AU": ContinentOceania,
+	"BE": ContinentEurope, "BG": ContinentEurope, "BH": ContinentAsia,
+	"BR": ContinentSouthAmerica, "CA": ContinentNorthAmerica, "CH": ContinentEurope,
+	"CL": ContinentSouthAmerica, "DE": ContinentEurope, "DK": ContinentEurope,
+	"ES": ContinentEurope, "FI": ContinentEurope, "FR": ContinentEurope,
+	"GB": ContinentEurope, "GR": ContinentEurope, "HK": ContinentAsia,
+	"HR": ContinentEurope, "ID": ContinentAsia, "IE": ContinentEurope,
+	"IL": ContinentAsia, "IN": ContinentAsia, "IT": ContinentEurope,
+	"JP": ContinentAsia, "KR": ContinentAsia, "MX": ContinentNorthAmerica,
+	"MY": ContinentAsia, "NL": ContinentEurope, "NO": ContinentEurope,
+	"NZ": ContinentOceania, "PL": ContinentEurope, "QA": ContinentAsia,
+	"SA": ContinentAsia, "SE": ContinentEurope, "SG": ContinentAsia,
+	"TH": ContinentAsia, "TW": ContinentAsia, "US": ContinentNorthAmerica,
+	"ZA": ContinentAfrica,
+}
+
+// countryNames maps the country names found in provider pages to their
+// ISO 3166-1 alpha-2 code.
+var countryNames = map[string]string{
+	"australia":      "AU",
+	"austria":        "AT",
+	"belgium":        "BE",
+	"brazil":         "BR",
+	"bulgaria":       "BG",
+	"canada":         "CA",
+	"chile":          "CL",
+	"croatia":        "HR",
+	"denmark":        "DK",
+	"finland":        "FI",
+	"france":         "FR",
+	"germany":        "DE",
+	"hong kong":      "HK",
+	"india":          "IN",
+	"indonesia":      "ID",
+	"ireland":        "IE",
+	"israel":         "IL",
+	"italy":          "IT",
+	"japan":          "JP",
+	"mexico":         "MX",
+	"netherlands":    "NL",
+	"norway":         "NO",
+	"poland":         "PL",
+	"qatar":          "QA",
+	"saudi arabia":   "SA",
+	"singapore":      "SG",
+	"south africa":   "ZA",
+	"south korea":    "KR",
+	"spain":          "ES",
+	"sweden":         "SE",
+	"switzerland":    "CH",
+	"taiwan":         "TW",
+	"uk":             "GB",
+	"united kingdom": "GB",
+	"usa":            "US",
+	"united states":  "US",
+}
+
+// regionPrefixCountries maps the country prefixes of AWS style region codes
+// such as "us-east-1" to their ISO code. Prefixes naming a wider area, like
+// "eu" or "ap", are deliberately absent.
+var regionPrefixCountries = map[string]string{
+	"ca": "CA",
+	"us": "US",
+}
+
+// lookupLocation returns the location of a metro code, following aliases.
+func lookupLocation(metro string) (Location, bool) {
+	metro = strings.ToLower(metro)
+	if alias, ok := metroAliases[metro]; ok {
+		metro = alias
+	}
+	location, ok := locations[metro]
+	return location, ok
+}
+
+// countryCode returns the ISO code for a country name, or the input itself
+// if it already is a two letter code.
+func countryCode(name string) string {
+	name = strings.TrimSpace(name)
+	if code, ok := countryNames[strings.ToLower(name)]; ok {
+		return code
+	}
+	if len(name) == 2 {
+		return strings.ToUpper(name)
+	}
+	return ""
+}
+
+// continentOf returns the continent of an ISO country code.
+func continentOf(country string) string {
+	return countryContinents[strings.ToUpper(country)]
+}
@@ -1,14 +1,36 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
 	"github.com/PuerkitoBio/goquery"
 )
 
-func getOutscaleStorageRegions(doc *goquery.Document) map[string]string {
-	regionMap := make(map[string]string)
+// outscaleRegionNames gives a display name and metro code for each Outscale
+// region, as the documentation table only lists codes.
+var outscaleRegionNames = map[string]struct {
+	name  string
+	metro string
+}{
+	"ap-northeast-1":      {"Asia Pacific Northeast (Japan)", "nrt"},
+	"cloudgouv-eu-west-1": {"SecNumCloud Europe West (France)", "cdg"},
+	"eu-west-2":           {"Europe West (France)", "cdg"},
+	"us-east-2":           {"US East (New Jersey)", "ewr"},
+	"us-west-1":           {"US West (California)", "sjc"},
+}
+
+// outscaleRegion builds an Outscale region from its code.
+func outscaleRegion(regionCode string) Region {
+	if known, ok := outscaleRegionNames[regionCode]; ok {
+		return newRegion(regionCode, known.name, known.metro)
+	}
+	return Region{Code: regionCode, Name: regionCode}
+}
+
+func getOutscaleStorageRegions(doc *goquery.Document) map[string]Region {
+	regionMap := make(map[string]Region)
 	var currentRegion string
 	doc.Find("h2#_mapping_between_subregions_and_physical_zones").NextAllFiltered("div.sectionbody").First().
 		Find("table.tableblock tbody tr").Each(func(i int, row *goquery.Selection) {
@@ -20,21 +42,58 @@ func getOutscaleStorageRegions(doc *goquery.Document) map[string]string {
 			}
 			subregions := strings.TrimSpace(cols.Eq(1).Find("p").Text())
 			physicalZone := strings.TrimSpace(cols.Eq(2).Find("p").Text())
-			regionMap[currentRegion] = fmt.Sprintf("Region: %s - Subregions: %s - Physical Zones: %s", currentRegion, subregions, physicalZone)
+
+			// A region spans several rows, one per subregion
+			region, exists := regionMap[currentRegion]
+			if !exists {
+				region = outscaleRegion(currentRegion)
+			}
+			if subregions != "" {
+				region = region.withZone(Zone{ID: subregions, Name: physicalZone, State: ZoneStateAvailable})
+			}
+			regionMap[currentRegion] = region
 		}
 	})
+	sortZones(regionMap)
 	return regionMap
 }
 
-func getOutscaleComputeRegions(doc *goquery.Document) map[string]string {
+func getOutscaleComputeRegions(doc *goquery.Document) map[string]Region {
 	// Same logic as storage, as the table now contains all region info
 	return getOutscaleStorageRegions(doc)
 }
 
-func GetOutscaleRegions() Regions {
-	doc, _ := get("https://docs.outscale.com/en/userguide/About-Regions-and-Subregions.html")
-	return Regions{
-		Storage: getOutscaleStorageRegions(doc),
-		Compute: getOutscaleComputeRegions(doc),
+// outscaleLegacyLabel labels a region as the original output did, with the
+// last of its subregions and that subregion's physical zone, as only the last
+// row of each region in the table was kept. Regions read back from that output
+// have no zones and already carry the label.
+func outscaleLegacyLabel(region Region) string {
+	n := len(region.Zones)
+	if n == 0 {
+		return region.Label()
 	}
+	return fmt.Sprintf("Region: %s - Subregions: %s - Physical Zones: %s", region.Code, region.Zones[n-1].ID, region.Zones[n-1].Name)
+}
+
+// outscaleRegionsDocsURL lists the Outscale regions and subregions.
+const outscaleRegionsDocsURL = "https://docs.outscale.com/en/userguide/About-Regions-and-Subregions.html"
+
+func GetOutscaleRegions(ctx context.Context) FetchResult {
+	doc, err := get(ctx, outscaleRegionsDocsURL)
+	if err != nil {
+		return failedResult(err, CategoryStorage, CategoryCompute)
+	}
+
+	return FetchResult{
+		Regions: Regions{
+			CategoryStorage: getOutscaleStorageRegions(doc),
+			CategoryCompute: getOutscaleComputeRegions(doc),
+		},
+	}
+}
+
+func init() {
+	Register(NewProvider("outscale", "Outscale", []Category{CategoryStorage, CategoryCompute}, GetOutscaleRegions),
+		WithDocsURL(outscaleRegionsDocsURL),
+		WithLegacyLabel(outscaleLegacyLabel))
 }
@@ -0,0 +1,77 @@
+package service
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// Sources of a provider's regions.
+const (
+	// SourceLive is a fetch from the provider's own pages, APIs or DNS.
+	SourceLive = "live"
+	// SourceFallback is a live fetch in which some categories failed and were
+	// filled from the embedded fallback snapshot.
+	SourceFallback = "fallback"
+	// SourceCache is regions served from the cache, as last fetched live.
+	SourceCache = "cache"
+)
+
+// DefaultParserVersion is the parser version of providers registered without
+// WithParserVersion.
+const DefaultParserVersion = "1"
+
+// Provenance describes where the regions of a provider came from.
+type Provenance struct {
+	Source string `json:"source"`
+	// SourceURLs lists the pages and APIs requested, and the hosts resolved
+	// by DNS sweeps as dns://<host>, sorted.
+	SourceURLs      []string `json:"source_urls,omitempty"`
+	FetchDurationMS int64    `json:"fetch_duration_ms"`
+	ParserVersion   string   `json:"parser_version,omitempty"`
+	Warnings        []string `json:"warnings,omitempty"`
+	// FallbackCategories are the categories filled from the embedded
+	// fallback snapshot, and CachedCategories those filled from the cache
+	// after the live fetch failed for them.
+	FallbackCategories []Category `json:"fallback_categories,omitempty"`
+	CachedCategories   []Category `json:"cached_categories,omitempty"`
+}
+
+// sourceRecorder collects the sources requested during a fetch.
+type sourceRecorder struct {
+	mu      sync.Mutex
+	sources map[string]bool
+}
+
+type sourceRecorderKey struct{}
+
+// withSourceRecorder returns a context in which every request and resolved
+// hostname is recorded by the returned recorder.
+func withSourceRecorder(ctx context.Context) (context.Context, *sourceRecorder) {
+	recorder := &sourceRecorder{sources: make(map[string]bool)}
+	return context.WithValue(ctx, sourceRecorderKey{}, recorder), recorder
+}
+
+// recordSource records a source requested with ctx, if ctx has a recorder.
+func recordSource(ctx context.Context, source string) {
+	recorder, ok := ctx.Value(sourceRecorderKey{}).(*sourceRecorder)
+	if !ok {
+		return
+	}
+	recorder.mu.Lock()
+	recorder.sources[source] = true
+	recorder.mu.Unlock()
+}
+
+// list returns the recorded sources, sorted.
+func (r *sourceRecorder) list() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sources := make([]string, 0, len(r.sources))
+	for source := range r.sources {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	return sources
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"time"
+)
+
+// Category identifies a class of service a provider offers in a region. The
+// set is open: providers report whatever categories their sources expose.
+type Category string
+
+const (
+	// CategoryStorage is S3-compatible object storage.
+	CategoryStorage Category = "storage"
+	// CategoryCompute is virtual machines.
+	CategoryCompute      Category = "compute"
+	CategoryKubernetes   Category = "kubernetes"
+	CategoryBlockStorage Category = "block-storage"
+	CategoryGPU          Category = "gpu"
+	CategoryManagedDB    Category = "managed-db"
+	CategoryLoadBalancer Category = "load-balancer"
+)
+
+// Provider is a cloud provider whose regions can be fetched.
+type Provider interface {
+	// ID is a stable, lowercase identifier such as "aws" or "digitalocean".
+	ID() string
+	// Name is the human readable name, also used as the key in the JSON output.
+	Name() string
+	// Categories lists the service categories the provider reports regions for.
+	Categories() []Category
+	// Fetch retrieves the provider's current regions. Implementations must
+	// stop and return as soon as ctx is done, and report failures through the
+	// result rather than by panicking.
+	Fetch(ctx context.Context) FetchResult
+}
+
+// funcProvider adapts a plain fetch function to the Provider interface.
+type funcProvider struct {
+	id         string
+	name       string
+	categories []Category
+	fetch      func(context.Context) FetchResult
+}
+
+// NewProvider builds a Provider from its metadata and a fetch function.
+func NewProvider(id, name string, categories []Category, fetch func(context.Context) FetchResult) Provider {
+	return &funcProvider{
+		id:         id,
+		name:       name,
+		categories: categories,
+		fetch:      fetch,
+	}
+}
+
+func (p *funcProvider) ID() string             { return p.id }
+func (p *funcProvider) Name() string           { return p.name }
+func (p *funcProvider) Categories() []Category { return p.categories }
+func (p *funcProvider) Fetch(ctx context.Context) FetchResult {
+	ctx, recorder := withSourceRecorder(ctx)
+	start := time.Now()
+	result := p.fetch(ctx)
+	result.Provenance = Provenance{
+		Source:          SourceLive,
+		SourceURLs:      recorder.list(),
+		FetchDurationMS: time.Since(start).Milliseconds(),
+		ParserVersion:   ProviderParserVersion(p.id),
+		Warnings:        append([]string(nil), result.Warnings...),
+	}
+	return result
+}
@@ -0,0 +1,178 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// TestProvidersGolden fetches every provider from its recorded fixtures and
+// compares the regions with testdata/golden/<id>.json. Run with -record to
+// refresh the fixtures from the live sources and with -update to accept the
+// new output.
+func TestProvidersGolden(t *testing.T) {
+	for _, provider := range AllProviders() {
+		provider := provider
+		t.Run(provider.ID(), func(t *testing.T) {
+			useFixtures(t, provider.ID())
+
+			result := provider.Fetch(context.Background())
+			if err := result.Err(); err != nil {
+				t.Fatalf("Fetch() error: %v", err)
+			}
+			if result.Regions.Empty() {
+				t.Fatal("Fetch() returned no regions")
+			}
+			for _, category := range provider.Categories() {
+				if len(result.Regions[category]) == 0 {
+					t.Errorf("no regions for category %s", category)
+				}
+			}
+			if p := result.Provenance; p.Source != SourceLive || len(p.SourceURLs) == 0 || p.ParserVersion == "" {
+				t.Errorf("provenance = %+v, want a live fetch with its sources", p)
+			}
+			// The documentation pages linked from notifications are the ones scraped
+			for category, url := range ProviderDocsURLs(provider.ID()) {
+				if !slices.Contains(result.Provenance.SourceURLs, url) {
+					t.Errorf("docs URL of %s %s was not fetched, sources are %v", category, url, result.Provenance.SourceURLs)
+				}
+			}
+
+			got, err := json.MarshalIndent(result.Regions, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			golden := filepath.Join("testdata", "golden", provider.ID()+".json")
+			if *update {
+				if err := os.MkdirAll(filepath.Dir(golden), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("reading golden file, run the tests with -update: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("regions differ from %s, run the tests with -update to accept them\ngot:\n%s", golden, got)
+			}
+		})
+	}
+}
+
+func TestFetchWithoutFixture(t *testing.T) {
+	if *record {
+		t.Skip("fixtures are being recorded")
+	}
+	useFixtures(t, "missing")
+
+	provider, ok := LookupProvider("aws")
+	if !ok {
+		t.Fatal("aws is not registered")
+	}
+	result := provider.Fetch(context.Background())
+	if !result.Failed() {
+		t.Errorf("Failed() = false with no fixtures, regions: %v", result.Regions)
+	}
+
+	result = ApplyFallback(provider, result)
+	if p := result.Provenance; p.Source != SourceFallback || len(p.FallbackCategories) != len(provider.Categories()) {
+		t.Errorf("provenance with fallback = %+v, want every category from the fallback", p)
+	}
+}
+
+// TestGoogleCloudLegacyGolden pins the legacy output of Google Cloud, whose
+// compute regions were keyed by zone before regions carried their zones, to
+// testdata/golden/gcp.legacy.json.
+func TestGoogleCloudLegacyGolden(t *testing.T) {
+	useFixtures(t, "gcp")
+
+	provider, ok := LookupProvider("gcp")
+	if !ok {
+		t.Fatal("gcp is not registered")
+	}
+	result := provider.Fetch(context.Background())
+	if err := result.Err(); err != nil {
+		t.Fatalf("Fetch() error: %v", err)
+	}
+
+	legacy := ProviderLegacy("gcp", result.Regions)
+	if label := legacy.Compute["us-central1-a"]; label != "Council Bluffs, Iowa, North America - us-central1-a" {
+		t.Errorf("compute us-central1-a = %q, want the zone labelled with its region", label)
+	}
+	if label, ok := legacy.Compute["us-central1"]; ok {
+		t.Errorf("compute has the region us-central1 = %q, want only its zones", label)
+	}
+
+	got, err := json.MarshalIndent(legacy, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+
+	golden := filepath.Join("testdata", "golden", "gcp.legacy.json")
+	if *update {
+		if err := os.WriteFile(golden, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("reading golden file, run the tests with -update: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("legacy output differs from %s, run the tests with -update to accept them\ngot:\n%s", golden, got)
+	}
+}
+
+func TestOutscaleLegacyGolden(t *testing.T) {
+	useFixtures(t, "outscale")
+
+	provider, ok := LookupProvider("outscale")
+	if !ok {
+		t.Fatal("outscale is not registered")
+	}
+	result := provider.Fetch(context.Background())
+	if err := result.Err(); err != nil {
+		t.Fatalf("Fetch() error: %v", err)
+	}
+
+	legacy := ProviderLegacy("outscale", result.Regions)
+	if label := legacy.Compute["eu-west-2"]; label != "Region: eu-west-2 - Subregions: eu-west-2c - Physical Zones: IN3" {
+		t.Errorf("compute eu-west-2 = %q, want the label of the original output", label)
+	}
+
+	got, err := json.MarshalIndent(legacy, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+
+	golden := filepath.Join("testdata", "golden", "outscale.legacy.json")
+	if *update {
+		if err := os.WriteFile(golden, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("reading golden file, run the tests with -update: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("legacy output differs from %s, run the tests with -update to accept them\ngot:\n%s", golden, got)
+	}
+}
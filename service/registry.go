@@ -0,0 +1,367 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultProviderTimeout is how long a single provider may take to fetch its
+// regions unless it was registered with WithTimeout.
+const DefaultProviderTimeout = 45 * time.Second
+
+// CachePolicy controls how long the cached regions of a provider are served
+// and how they are refreshed. Zero fields are filled from the configuration
+// of the cache.
+type CachePolicy struct {
+	// TTL is how long cached regions are fresh.
+	TTL time.Duration
+	// MaxStale is how old cached regions may get and still be served while
+	// they are refreshed.
+	MaxStale time.Duration
+	// Refresh is one of the Refresh policies.
+	Refresh string
+}
+
+// Refresh policies of a CachePolicy.
+const (
+	// RefreshOnExpiry fetches expired regions again before serving them.
+	RefreshOnExpiry = "on-expiry"
+	// RefreshSWR serves expired regions while they are refreshed.
+	RefreshSWR = "swr"
+	// RefreshScheduled serves expired regions and leaves refreshing them to
+	// the scheduled refresh step, for providers that rate limit us.
+	RefreshScheduled = "scheduled"
+)
+
+// cachePolicyJSON is the JSON form of a CachePolicy, with durations written
+// as strings such as "24h0m0s".
+type cachePolicyJSON struct {
+	TTL      string `json:"ttl,omitempty"`
+	MaxStale string `json:"max_stale,omitempty"`
+	Refresh  string `json:"refresh,omitempty"`
+}
+
+func (p CachePolicy) MarshalJSON() ([]byte, error) {
+	out := cachePolicyJSON{Refresh: p.Refresh}
+	if p.TTL > 0 {
+		out.TTL = p.TTL.String()
+	}
+	if p.MaxStale > 0 {
+		out.MaxStale = p.MaxStale.String()
+	}
+	return json.Marshal(out)
+}
+
+func (p *CachePolicy) UnmarshalJSON(data []byte) error {
+	var in cachePolicyJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	policy := CachePolicy{Refresh: in.Refresh}
+	for _, field := range []struct {
+		value string
+		dest  *time.Duration
+	}{{in.TTL, &policy.TTL}, {in.MaxStale, &policy.MaxStale}} {
+		if field.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(field.value)
+		if err != nil {
+			return err
+		}
+		*field.dest = d
+	}
+	*p = policy
+	return nil
+}
+
+// SanityRules are the checks fetched regions must pass before they replace the
+// cached ones, so that a scraper broken by a page redesign does not overwrite
+// good data. Zero fields are filled from the configuration of the cache.
+type SanityRules struct {
+	// MinRegions is the fewest regions each category may have.
+	MinRegions int `json:"min_regions,omitempty"`
+	// MaxDropPercent is the largest share of a category's cached regions, in
+	// percent, that may disappear in a single fetch.
+	MaxDropPercent int `json:"max_drop_percent,omitempty"`
+	// Required lists well-known region codes, by category, that must always
+	// be present.
+	Required map[Category][]string `json:"required,omitempty"`
+}
+
+// registration is a provider known to the registry together with its state.
+type registration struct {
+	provider      Provider
+	enabled       bool
+	timeout       time.Duration
+	cachePolicy   CachePolicy
+	parserVersion string
+	sanityRules   SanityRules
+	docsURLs      map[Category]string
+	legacyZones   []Category
+	legacyLabel   func(Region) string
+}
+
+// RegisterOption customises how a provider is registered.
+type RegisterOption func(*registration)
+
+// Disabled registers the provider without enabling it. Disabled providers are
+// skipped by Providers but can still be looked up and enabled with SetEnabled.
+func Disabled() RegisterOption {
+	return func(r *registration) {
+		r.enabled = false
+	}
+}
+
+// WithTimeout overrides DefaultProviderTimeout for the provider. Use it for
+// providers whose sources are known to be slow, such as DNS sweeps.
+func WithTimeout(timeout time.Duration) RegisterOption {
+	return func(r *registration) {
+		r.timeout = timeout
+	}
+}
+
+// WithCachePolicy sets the default cache policy of the provider, e.g. a
+// shorter TTL for cheap sources or a scheduled refresh for sources that rate
+// limit us.
+func WithCachePolicy(policy CachePolicy) RegisterOption {
+	return func(r *registration) {
+		r.cachePolicy = policy
+	}
+}
+
+// WithParserVersion sets the version of the provider's parser, recorded in
+// the provenance of its regions. Bump it whenever the parser changes how it
+// reads its sources.
+func WithParserVersion(version string) RegisterOption {
+	return func(r *registration) {
+		r.parserVersion = version
+	}
+}
+
+// WithSanityRules sets the sanity rules of the provider, typically the region
+// codes it is known to always have.
+func WithSanityRules(rules SanityRules) RegisterOption {
+	return func(r *registration) {
+		r.sanityRules = rules
+	}
+}
+
+// WithDocsURL sets the documentation page listing the provider's regions of
+// the given categories, or of all its categories if none are given. Later
+// options override earlier ones for the same category.
+func WithDocsURL(url string, categories ...Category) RegisterOption {
+	return func(r *registration) {
+		if len(categories) == 0 {
+			categories = r.provider.Categories()
+		}
+		if r.docsURLs == nil {
+			r.docsURLs = make(map[Category]string)
+		}
+		for _, category := range categories {
+			r.docsURLs[category] = url
+		}
+	}
+}
+
+// WithLegacyZones keys the legacy output of the given categories by zone
+// rather than by region, as the provider's output was before its regions
+// carried their zones.
+func WithLegacyZones(categories ...Category) RegisterOption {
+	return func(r *registration) {
+		r.legacyZones = categories
+	}
+}
+
+// WithLegacyLabel labels the regions of the provider in the legacy output
+// with label instead of Region.Label, for providers whose original output had
+// labels of its own.
+func WithLegacyLabel(label func(Region) string) RegisterOption {
+	return func(r *registration) {
+		r.legacyLabel = label
+	}
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]*registration)
+)
+
+// Register adds a provider to the registry. Providers call it from an init
+// function in their own file. It panics if a provider with the same ID is
+// already registered.
+func Register(p Provider, opts ...RegisterOption) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, exists := registry[p.ID()]; exists {
+		panic(fmt.Sprintf("service: provider %q registered twice", p.ID()))
+	}
+
+	r := &registration{provider: p, enabled: true, timeout: DefaultProviderTimeout, parserVersion: DefaultParserVersion}
+	for _, opt := range opts {
+		opt(r)
+	}
+	registry[p.ID()] = r
+}
+
+// Providers returns the enabled providers sorted by ID.
+func Providers() []Provider {
+	return providers(true)
+}
+
+// AllProviders returns every registered provider, enabled or not, sorted by ID.
+func AllProviders() []Provider {
+	return providers(false)
+}
+
+func providers(enabledOnly bool) []Provider {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	result := make([]Provider, 0, len(registry))
+	for _, r := range registry {
+		if enabledOnly && !r.enabled {
+			continue
+		}
+		result = append(result, r.provider)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID() < result[j].ID()
+	})
+
+	return result
+}
+
+// LookupProvider returns the provider registered under id.
+func LookupProvider(id string) (Provider, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	r, exists := registry[id]
+	if !exists {
+		return nil, false
+	}
+	return r.provider, true
+}
+
+// IsEnabled reports whether the provider registered under id is enabled.
+func IsEnabled(id string) bool {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	r, exists := registry[id]
+	return exists && r.enabled
+}
+
+// ProviderTimeout returns how long the provider registered under id may take
+// to fetch its regions.
+func ProviderTimeout(id string) time.Duration {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	if r, exists := registry[id]; exists {
+		return r.timeout
+	}
+	return DefaultProviderTimeout
+}
+
+// ProviderCachePolicy returns the cache policy the provider registered under
+// id was registered with.
+func ProviderCachePolicy(id string) CachePolicy {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	if r, exists := registry[id]; exists {
+		return r.cachePolicy
+	}
+	return CachePolicy{}
+}
+
+// ProviderParserVersion returns the parser version of the provider registered
+// under id.
+func ProviderParserVersion(id string) string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	if r, exists := registry[id]; exists {
+		return r.parserVersion
+	}
+	return DefaultParserVersion
+}
+
+// ProviderSanityRules returns the sanity rules the provider registered under
+// id was registered with.
+func ProviderSanityRules(id string) SanityRules {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	if r, exists := registry[id]; exists {
+		return r.sanityRules
+	}
+	return SanityRules{}
+}
+
+// SetEnabled enables or disables the provider registered under id.
+func SetEnabled(id string, enabled bool) error {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	r, exists := registry[id]
+	if !exists {
+		return fmt.Errorf("unknown provider: %s", id)
+	}
+	r.enabled = enabled
+	return nil
+}
+
+// ProviderDocsURLs returns the documentation pages of the provider registered
+// under id, by category.
+func ProviderDocsURLs(id string) map[Category]string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	r, exists := registry[id]
+	if !exists {
+		return nil
+	}
+	docsURLs := make(map[Category]string, len(r.docsURLs))
+	for category, url := range r.docsURLs {
+		docsURLs[category] = url
+	}
+	return docsURLs
+}
+
+// ProviderLegacy converts the regions of the provider registered under id into
+// the original display string format, keyed by zone in the categories it was
+// registered WithLegacyZones for and labelled by its WithLegacyLabel.
+func ProviderLegacy(id string, regions Regions) LegacyRegions {
+	registryMu.RLock()
+	var zoned []Category
+	label := Region.Label
+	if r, exists := registry[id]; exists {
+		zoned = r.legacyZones
+		if r.legacyLabel != nil {
+			label = r.legacyLabel
+		}
+	}
+	registryMu.RUnlock()
+
+	legacy := LegacyRegions{
+		Storage: legacyLabels(regions[CategoryStorage], label),
+		Compute: legacyLabels(regions[CategoryCompute], label),
+	}
+	for _, category := range zoned {
+		switch category {
+		case CategoryStorage:
+			legacy.Storage = legacyZoneLabels(regions[category], label)
+		case CategoryCompute:
+			legacy.Compute = legacyZoneLabels(regions[category], label)
+		}
+	}
+	return legacy
+}
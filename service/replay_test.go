@@ -0,0 +1,170 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var (
+	record = flag.Bool("record", false, "fetch the live sources and save the responses under testdata/http and testdata/dns")
+	update = flag.Bool("update", false, "rewrite the golden files under testdata/golden")
+)
+
+// fixtureUnsafe matches the characters of a URL that are replaced to build a
+// fixture file name.
+var fixtureUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// fixtureName returns the file name a response for u is stored under. The
+// fragment is ignored as it is never sent to the server.
+func fixtureName(u *url.URL) string {
+	name := u.Host + u.Path
+	if u.RawQuery != "" {
+		name += "?" + u.RawQuery
+	}
+	return strings.Trim(fixtureUnsafe.ReplaceAllString(name, "_"), "_")
+}
+
+// replayTransport serves responses from the fixture files in dir. With
+// -record it fetches them from the live source and saves them first.
+type replayTransport struct {
+	dir string
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := filepath.Join(t.dir, fixtureName(req.URL))
+
+	if *record {
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			if err := os.MkdirAll(t.dir, 0o755); err != nil {
+				return nil, err
+			}
+			if err := os.WriteFile(path, body, 0o644); err != nil {
+				return nil, err
+			}
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return resp, nil
+	}
+
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("no fixture for %s, run the tests with -record: %w", req.URL, err)
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// replayResolver answers DNS lookups from a file listing the hostnames that
+// resolve, one per line. With -record it resolves hostnames for real and
+// saves the ones that resolved when the test ends.
+type replayResolver struct {
+	path string
+
+	mu    sync.Mutex
+	hosts map[string]bool
+}
+
+func newReplayResolver(t *testing.T, path string) *replayResolver {
+	r := &replayResolver{path: path, hosts: make(map[string]bool)}
+
+	if *record {
+		t.Cleanup(func() {
+			if err := r.save(); err != nil {
+				t.Errorf("saving %s: %v", path, err)
+			}
+		})
+		return r
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+	for _, host := range strings.Fields(string(data)) {
+		r.hosts[host] = true
+	}
+	return r
+}
+
+func (r *replayResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if *record {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err == nil && len(addrs) > 0 {
+			r.mu.Lock()
+			r.hosts[host] = true
+			r.mu.Unlock()
+		}
+		return addrs, err
+	}
+
+	if r.hosts[host] {
+		return []string{"192.0.2.1"}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r *replayResolver) save() error {
+	if len(r.hosts) == 0 {
+		return nil
+	}
+	hosts := make([]string, 0, len(r.hosts))
+	for host := range r.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(r.path, []byte(strings.Join(hosts, "\n")+"\n"), 0o644)
+}
+
+// useFixtures routes the HTTP requests and DNS lookups of the provider with
+// the given ID to its fixtures for the rest of the test.
+func useFixtures(t *testing.T, id string) {
+	t.Helper()
+
+	previous, lookup := client, lookupHost
+	t.Cleanup(func() {
+		client, lookupHost = previous, lookup
+	})
+
+	client = NewClient(&http.Client{Transport: &replayTransport{dir: filepath.Join("testdata", "http", id)}})
+	if !*record {
+		// A missing fixture will not appear on a retry
+		client.MaxRetries = 0
+	}
+	lookupHost = newReplayResolver(t, filepath.Join("testdata", "dns", id+".txt")).LookupHost
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// FetchResult is the outcome of fetching a provider's regions. A provider can
+// succeed for some categories and fail for others, so errors are tracked per
+// category next to whatever regions were retrieved.
+type FetchResult struct {
+	Regions  Regions
+	Errors   map[Category]error
+	Warnings []string
+
+	// Stale is set when the regions were served from expired cached data
+	// fetched at FetchedAt, while fresh data is being fetched.
+	Stale     bool
+	FetchedAt time.Time
+
+	// Provenance records where the regions came from.
+	Provenance Provenance
+}
+
+// SetError records that fetching the given category failed.
+func (r *FetchResult) SetError(category Category, err error) {
+	if err == nil {
+		return
+	}
+	if r.Errors == nil {
+		r.Errors = make(map[Category]error)
+	}
+	r.Errors[category] = err
+}
+
+// Warn records a non-fatal problem encountered while fetching.
+func (r *FetchResult) Warn(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Err returns the category errors joined into a single error, or nil if every
+// category was fetched successfully.
+func (r FetchResult) Err() error {
+	if len(r.Errors) == 0 {
+		return nil
+	}
+
+	categories := make([]string, 0, len(r.Errors))
+	for category := range r.Errors {
+		categories = append(categories, string(category))
+	}
+	sort.Strings(categories)
+
+	errs := make([]error, 0, len(categories))
+	for _, category := range categories {
+		errs = append(errs, fmt.Errorf("%s: %w", category, r.Errors[Category(category)]))
+	}
+	return errors.Join(errs...)
+}
+
+// Failed reports whether no category could be fetched at all.
+func (r FetchResult) Failed() bool {
+	return len(r.Errors) > 0 && r.Regions.Empty()
+}
+
+// Partial reports whether some categories were fetched and others failed.
+func (r FetchResult) Partial() bool {
+	return len(r.Errors) > 0 && !r.Failed()
+}
+
+// failedResult builds a result in which every given category failed with err.
+func failedResult(err error, categories ...Category) FetchResult {
+	var result FetchResult
+	for _, category := range categories {
+		result.SetError(category, err)
+	}
+	return result
+}
@@ -1,40 +1,69 @@
 package service
 
 import (
-	"encoding/json"
-	"io/ioutil"
-	"net/http"
+	"context"
+	"strings"
 )
 
-func getStorjStorageRegions() map[string]string {
-	url := "https://us1.storj.io/api/v0/config"
-
-	resp, err := http.Get(url)
+// storjSatelliteAreas maps the prefix of a satellite name to the area it
+// serves. Storj stores data across its whole network, so satellites have no
+// city of their own.
+var storjSatelliteAreas = map[string]struct {
+	country   string
+	continent string
+}{
+	"us": {"US", ContinentNorthAmerica},
+	"eu": {"", ContinentEurope},
+	"ap": {"", ContinentAsia},
+}
 
-	if err != nil {
-		panic(err)
+// storjRegion builds a region from a satellite name such as "US1".
+func storjRegion(name string) Region {
+	region := Region{Code: name, Name: name}
+	if len(name) >= 2 {
+		if area, ok := storjSatelliteAreas[strings.ToLower(name[:2])]; ok {
+			region.Country = area.country
+			region.Continent = area.continent
+		}
 	}
+	return region
+}
 
-	defer resp.Body.Close()
+// storjS3Host returns the hostname of the regional S3 gateway serving a
+// satellite.
+func storjS3Host(name string) string {
+	return "gateway." + strings.ToLower(name) + ".storjshare.io"
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		panic(err)
-	}
+func getStorjStorageRegions(ctx context.Context) (map[string]Region, error) {
+	url := "https://us1.storj.io/api/v0/config"
 
-	regionMap := make(map[string]string)
 	var data map[string][]map[string]string
-	json.Unmarshal(body, &data)
+	if err := getJSON(ctx, url, &data); err != nil {
+		return nil, err
+	}
+
+	regionMap := make(map[string]Region)
 
 	for _, satellite := range data["partneredSatellites"] {
-		regionMap[satellite["name"]] = satellite["name"]
+		regionMap[satellite["name"]] = storjRegion(satellite["name"])
 	}
 
-	return regionMap
+	return regionMap, nil
 }
 
-func GetStorjRegions() Regions {
-	return Regions{
-		Storage: getStorjStorageRegions(),
+func GetStorjRegions(ctx context.Context) FetchResult {
+	var result FetchResult
+
+	storageRegions, err := getStorjStorageRegions(ctx)
+	result.SetError(CategoryStorage, err)
+	result.Regions = Regions{
+		CategoryStorage: withStorageEndpoints(storageRegions, storjS3Host),
 	}
+
+	return result
+}
+
+func init() {
+	Register(NewProvider("storj", "Storj", []Category{CategoryStorage}, GetStorjRegions))
 }
@@ -1,10 +1,11 @@
 package service
 
 import (
+	"context"
 	"fmt"
-	"net"
 	"strings"
 	"sync"
+	"time"
 )
 
 var synologyKnownPrefixes = []string{
@@ -15,16 +16,42 @@ var synologyKnownPrefixes = []string{
 	"sa-",
 }
 
+// synologyPrefixContinents maps the region code prefixes to their continent.
+var synologyPrefixContinents = map[string]string{
+	"us": ContinentNorthAmerica,
+	"ca": ContinentNorthAmerica,
+	"eu": ContinentEurope,
+	"ap": ContinentAsia,
+	"sa": ContinentSouthAmerica,
+}
+
 // operation in ['create-snapshot', 'delete-snapshot', 'get-snapshot', 'list-snapshots', 'list-instances', 'get-instance']
 func transformLabelSynology(regionCode string) string {
 	parts := strings.Split(regionCode, "-")
-	return fmt.Sprintf("%s %s - %s", strings.ToUpper(parts[0]), strings.Title(parts[1]), regionCode)
+	return fmt.Sprintf("%s %s", strings.ToUpper(parts[0]), strings.Title(parts[1]))
+}
+
+// synologyRegion builds a Synology C2 region. Synology only publishes the
+// broad area of each region, so the location comes from the code prefix.
+func synologyRegion(regionCode string) Region {
+	prefix := strings.Split(regionCode, "-")[0]
+	region := Region{Code: regionCode, Name: transformLabelSynology(regionCode)}
+	if country, ok := regionPrefixCountries[prefix]; ok {
+		return region.withCountry(country)
+	}
+	region.Continent = synologyPrefixContinents[prefix]
+	return region
+}
+
+// synologyS3Host returns the hostname of the S3 endpoint of a region.
+func synologyS3Host(regionCode string) string {
+	return regionCode + ".s3.synologyc2.net"
 }
 
-func getSynologyStorageRegions() map[string]string {
+func getSynologyStorageRegions(ctx context.Context) (map[string]Region, error) {
 
 	var wg sync.WaitGroup
-	results := make(chan map[string]string)
+	results := make(chan Region)
 	iterations := 8
 	workerCount := len(synologyKnownPrefixes) * iterations // Set the number of concurrent workers
 
@@ -43,8 +70,8 @@ func getSynologyStorageRegions() map[string]string {
 				}()
 
 				formatedRegionCode := region + fmt.Sprintf("%03d", i)
-				endpoint := formatedRegionCode + ".s3.synologyc2.net"
-				addrs, err := net.LookupHost(endpoint)
+				endpoint := synologyS3Host(formatedRegionCode)
+				addrs, err := resolveHost(ctx, endpoint)
 				if err != nil {
 					return
 				}
@@ -52,7 +79,7 @@ func getSynologyStorageRegions() map[string]string {
 					return
 				}
 
-				results <- map[string]string{formatedRegionCode: transformLabelSynology(formatedRegionCode)}
+				results <- synologyRegion(formatedRegionCode)
 			}(region, i)
 		}
 	}
@@ -62,18 +89,34 @@ func getSynologyStorageRegions() map[string]string {
 		close(results)
 	}()
 
-	regionMap := make(map[string]string)
+	regionMap := make(map[string]Region)
 	for result := range results {
-		for k, v := range result {
-			regionMap[k] = v
-		}
+		regionMap[result.Code] = result
 	}
 
-	return regionMap
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("DNS sweep of synologyc2.net interrupted: %w", err)
+	}
+	if len(regionMap) == 0 {
+		return nil, fmt.Errorf("no regions resolved under synologyc2.net")
+	}
+
+	return regionMap, nil
 }
 
-func GetSynologyRegions() Regions {
-	return Regions{
-		Storage: getSynologyStorageRegions(),
+func GetSynologyRegions(ctx context.Context) FetchResult {
+	var result FetchResult
+
+	storageRegions, err := getSynologyStorageRegions(ctx)
+	result.SetError(CategoryStorage, err)
+	result.Regions = Regions{
+		CategoryStorage: withStorageEndpoints(storageRegions, synologyS3Host),
 	}
+
+	return result
+}
+
+func init() {
+	Register(NewProvider("synology", "Synology", []Category{CategoryStorage}, GetSynologyRegions), WithTimeout(20*time.Second),
+		WithCachePolicy(CachePolicy{TTL: 6 * time.Hour}))
 }
@@ -1,11 +1,286 @@
 package service
 
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
 type ProviderRegions struct {
 	Provider string
 	Regions  Regions
 }
 
-type Regions struct {
+// Region is a single region of a provider, with its location broken out into
+// structured fields.
+type Region struct {
+	Code      string            `json:"code"`
+	Name      string            `json:"name"`
+	City      string            `json:"city,omitempty"`
+	Country   string            `json:"country,omitempty"` // ISO 3166-1 alpha-2 code
+	Continent string            `json:"continent,omitempty"`
+	Latitude  float64           `json:"latitude,omitempty"`
+	Longitude float64           `json:"longitude,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Zones     []Zone            `json:"zones,omitempty"`
+	Endpoints []Endpoint        `json:"endpoints,omitempty"`
+}
+
+// Zone is an availability zone within a region.
+type Zone struct {
+	ID    string `json:"id"`
+	Name  string `json:"name,omitempty"`
+	State string `json:"state,omitempty"`
+}
+
+// Zone states reported by providers that publish them.
+const (
+	ZoneStateAvailable = "available"
+	ZoneStateOptIn     = "opt-in-required"
+)
+
+// Endpoint is a URL that clients connect to for a service in the region.
+// URLs of kind EndpointVirtualHosted contain a "{bucket}" placeholder, and
+// some providers use further placeholders such as "{instance}" for parts of
+// the hostname that depend on the customer's account.
+type Endpoint struct {
+	Kind string `json:"kind"`
+	URL  string `json:"url"`
+}
+
+// Endpoint kinds of S3 compatible object storage.
+const (
+	EndpointPath          = "path"
+	EndpointVirtualHosted = "virtual-hosted"
+	EndpointDualstack     = "dualstack"
+	EndpointFIPS          = "fips"
+	EndpointFIPSDualstack = "fips-dualstack"
+)
+
+// Label returns the legacy display string of the region, "<name> - <code>",
+// or just the code for regions that have no name of their own.
+func (r Region) Label() string {
+	if r.Name == "" || r.Name == r.Code {
+		return r.Code
+	}
+	return r.Name + " - " + r.Code
+}
+
+// UnmarshalJSON accepts both the structured form and the legacy display
+// string, so that caches and snapshots written before Region existed can still
+// be read.
+func (r *Region) UnmarshalJSON(data []byte) error {
+	var label string
+	if err := json.Unmarshal(data, &label); err == nil {
+		*r = Region{Code: label, Name: label}
+		if i := strings.LastIndex(label, " - "); i >= 0 {
+			r.Name, r.Code = label[:i], label[i+3:]
+		}
+		return nil
+	}
+
+	type plain Region
+	return json.Unmarshal(data, (*plain)(r))
+}
+
+// Regions holds a provider's regions grouped by service category, keyed by
+// region code within each category. Categories a provider does not offer are
+// simply absent.
+type Regions map[Category]map[string]Region
+
+// LegacyRegions is the original output format, mapping region codes to
+// display strings. It is kept for existing consumers of the JSON output.
+type LegacyRegions struct {
 	Storage map[string]string `json:"storage"`
 	Compute map[string]string `json:"compute"`
 }
+
+// Legacy converts the regions into the original display string format.
+func (r Regions) Legacy() LegacyRegions {
+	return LegacyRegions{
+		Storage: legacyLabels(r[CategoryStorage], Region.Label),
+		Compute: legacyLabels(r[CategoryCompute], Region.Label),
+	}
+}
+
+// legacyLabels labels every region with label.
+func legacyLabels(regions map[string]Region, label func(Region) string) map[string]string {
+	if regions == nil {
+		return nil
+	}
+	labels := make(map[string]string, len(regions))
+	for code, region := range regions {
+		labels[code] = label(region)
+	}
+	return labels
+}
+
+// legacyZoneLabels labels every zone of the regions with label, as a region
+// of the zone's code and the name of its region, keeping the regions without
+// zones under their own code.
+func legacyZoneLabels(regions map[string]Region, label func(Region) string) map[string]string {
+	if regions == nil {
+		return nil
+	}
+	labels := make(map[string]string, len(regions))
+	for code, region := range regions {
+		if len(region.Zones) == 0 {
+			labels[code] = label(region)
+			continue
+		}
+		for _, zone := range region.Zones {
+			labels[zone.ID] = label(Region{Code: zone.ID, Name: region.Name})
+		}
+	}
+	return labels
+}
+
+// Category returns the regions of the given category, or nil if the provider
+// has none.
+func (r Regions) Category(category Category) map[string]Region {
+	return r[category]
+}
+
+// SetCategory replaces the regions of the given category. A nil map removes
+// the category.
+func (r *Regions) SetCategory(category Category, regions map[string]Region) {
+	if regions == nil {
+		delete(*r, category)
+		return
+	}
+	if *r == nil {
+		*r = make(Regions)
+	}
+	(*r)[category] = regions
+}
+
+// Add adds a single region to the given category.
+func (r *Regions) Add(category Category, region Region) {
+	if *r == nil {
+		*r = make(Regions)
+	}
+	if (*r)[category] == nil {
+		(*r)[category] = make(map[string]Region)
+	}
+	(*r)[category][region.Code] = region
+}
+
+// Categories returns the categories that have at least one region, sorted.
+func (r Regions) Categories() []Category {
+	categories := make([]Category, 0, len(r))
+	for category, regions := range r {
+		if len(regions) > 0 {
+			categories = append(categories, category)
+		}
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		return categories[i] < categories[j]
+	})
+	return categories
+}
+
+// Empty reports whether no category has any region.
+func (r Regions) Empty() bool {
+	return len(r.Categories()) == 0
+}
+
+// newRegion builds a region and fills in its location from a metro code. An
+// unknown or empty metro code leaves the location fields blank.
+func newRegion(code, name, metro string) Region {
+	region := Region{Code: code, Name: name}
+	if location, ok := lookupLocation(metro); ok {
+		region = region.withLocation(location)
+	}
+	return region
+}
+
+// withLocation fills in the location fields of the region.
+func (r Region) withLocation(location Location) Region {
+	r.City = location.City
+	r.Latitude = location.Latitude
+	r.Longitude = location.Longitude
+	return r.withCountry(location.Country)
+}
+
+// withCountry sets the country of the region and derives its continent.
+func (r Region) withCountry(country string) Region {
+	r.Country = strings.ToUpper(country)
+	if continent := continentOf(r.Country); continent != "" {
+		r.Continent = continent
+	}
+	return r
+}
+
+// withZone adds a zone to the region unless a zone with the same ID is
+// already listed.
+func (r Region) withZone(zone Zone) Region {
+	for _, existing := range r.Zones {
+		if existing.ID == zone.ID {
+			return r
+		}
+	}
+	zones := make([]Zone, len(r.Zones), len(r.Zones)+1)
+	copy(zones, r.Zones)
+	r.Zones = append(zones, zone)
+	return r
+}
+
+// withEndpoint adds an endpoint to the region unless it is already listed.
+func (r Region) withEndpoint(kind, url string) Region {
+	for _, existing := range r.Endpoints {
+		if existing.Kind == kind && existing.URL == url {
+			return r
+		}
+	}
+	endpoints := make([]Endpoint, len(r.Endpoints), len(r.Endpoints)+1)
+	copy(endpoints, r.Endpoints)
+	r.Endpoints = append(endpoints, Endpoint{Kind: kind, URL: url})
+	return r
+}
+
+// withS3Endpoints adds the path-style and virtual-hosted style endpoints of an
+// S3 compatible service served from host.
+func (r Region) withS3Endpoints(host string) Region {
+	return r.withEndpoint(EndpointPath, "https://"+host).
+		withEndpoint(EndpointVirtualHosted, "https://{bucket}."+host)
+}
+
+// withStorageEndpoints returns a copy of regions in which every region has the
+// S3 endpoints served from the host returned by hostOf. Regions for which
+// hostOf returns an empty string are copied unchanged.
+func withStorageEndpoints(regions map[string]Region, hostOf func(code string) string) map[string]Region {
+	if regions == nil {
+		return nil
+	}
+	withEndpoints := make(map[string]Region, len(regions))
+	for code, region := range regions {
+		if host := hostOf(code); host != "" {
+			region = region.withS3Endpoints(host)
+		}
+		withEndpoints[code] = region
+	}
+	return withEndpoints
+}
+
+// sortZones orders the zones of every region by ID.
+func sortZones(regions map[string]Region) {
+	for _, region := range regions {
+		sort.Slice(region.Zones, func(i, j int) bool {
+			return region.Zones[i].ID < region.Zones[j].ID
+		})
+	}
+}
+
+// withTag adds a free-form tag to the region.
+func (r Region) withTag(key, value string) Region {
+	if value == "" {
+		return r
+	}
+	tags := make(map[string]string, len(r.Tags)+1)
+	for k, v := range r.Tags {
+		tags[k] = v
+	}
+	tags[key] = value
+	r.Tags = tags
+	return r
+}
@@ -1,99 +1,94 @@
 package service
 
 import (
-	"encoding/json"
+	"context"
 	"strings"
 
 	"github.com/PuerkitoBio/goquery"
 )
 
-func getUpcloudStorageRegions(doc *goquery.Document) map[string]string {
-	var regionMap map[string]string = make(map[string]string)
+func getUpcloudStorageRegions(doc *goquery.Document) map[string]Region {
+	var regionMap map[string]Region = make(map[string]Region)
 
 	doc.Find(".accordion").First().Find(".accordion-item").Each(func(i int, item *goquery.Selection) {
 		// Check if item has an <li> tag with "Object Storage" text
 		if strings.Contains(item.Find("li").Text(), "Object Storage") {
 
 			regionCode := strings.ToLower(item.Find("button h3").First().Text())
-			regionSplit := strings.Split(item.Find("button .location").First().Text(), ", ")
-			regionName := regionSplit[1] + " - " + regionSplit[0] + " - " + regionCode
-
-			regionMap[regionCode] = regionName
+			regionMap[regionCode] = upcloudRegion(regionCode, item.Find("button .location").First().Text())
 		}
 	})
 
 	return regionMap
 }
-func getUpcloudComputeRegions(doc *goquery.Document) map[string]string {
+func getUpcloudComputeRegions(doc *goquery.Document) map[string]Region {
 
-	var regionMap map[string]string = make(map[string]string)
+	var regionMap map[string]Region = make(map[string]Region)
 
 	doc.Find(".accordion").First().Find(".accordion-item").Each(func(i int, item *goquery.Selection) {
 		// Check if item has an <li> tag with "Object Storage" text
 		if strings.Contains(item.Find("li").Text(), "Cloud Servers") {
 
 			regionCode := strings.ToLower(item.Find("button h3").First().Text())
-			regionSplit := strings.Split(item.Find("button .location").First().Text(), ", ")
-			regionName := regionSplit[1] + " - " + regionSplit[0] + " - " + regionCode
-
-			regionMap[regionCode] = regionName
+			regionMap[regionCode] = upcloudRegion(regionCode, item.Find("button .location").First().Text())
 		}
 	})
 
 	return regionMap
 }
 
-func GetUpcloudRegions() Regions {
-	doc, err := get("https://upcloud.com/data-centres")
-	if err != nil {
-		// fmt.Printf("Error: %v", err)
-		// Load the regions from the local file ./upcloud_fallback.json
-		jsonContent := []byte(`{
-  "storage": {
-    "au-syd1": "Sydney, Australia - AU SYD1",
-    "de-fra1": "Frankfurt, Germany - DE FRA1",
-    "fi-hel2": "Helsinki, Finland - FI HEL2",
-    "es-mad1": "Madrid, Spain - ES MAD1",
-    "nl-ams1": "Amsterdam, Netherlands - NL AMS1",
-    "pl-waw1": "Warsaw, Poland - PL WAW1",
-    "sg-sin1": "Singapore - SG SIN1",
-    "uk-lon1": "London, UK - UK LON1",
-    "us-chi1": "Chicago, USA - US CHI1",
-    "us-nyc1": "New York, USA - US NYC1",
-    "us-sjo1": "San Jose, USA - US SJO1"
-  },
-  "compute": {
-    "au-syd1": "Sydney, Australia - AU SYD1",
-    "de-fra1": "Frankfurt, Germany - DE FRA1",
-    "fi-hel1": "Helsinki, Finland - FI HEL1",
-    "fi-hel2": "Helsinki, Finland - FI HEL2",
-    "es-mad1": "Madrid, Spain - ES MAD1",
-    "nl-ams1": "Amsterdam, Netherlands - NL AMS1",
-    "pl-waw1": "Warsaw, Poland - PL WAW1",
-    "se-sto1": "Stockholm, Sweden - SE STO1",
-    "sg-sin1": "Singapore - SG SIN1",
-    "uk-lon1": "London, UK - UK LON1",
-    "us-chi1": "Chicago, USA - US CHI1",
-    "us-nyc1": "New York, USA - US NYC1",
-    "us-sjo1": "San Jose, USA - US SJO1"
-  }
+// upcloudS3Host returns the hostname template of the Object Storage endpoint
+// of a region. Each Object Storage instance has its own hostname within the
+// region, so the instance name is left as a placeholder.
+func upcloudS3Host(regionCode string) string {
+	return "{instance}." + regionCode + ".upcloudobjects.com"
 }
-`)
 
-		// json has "storage" and "compute" keys
-		var regions map[string]map[string]string
-		json.Unmarshal(jsonContent, &regions)
+// upcloudRegion builds a region from a zone code such as "de-fra1" and its
+// "City, Country" location. Locations without a country, like Singapore, take
+// the country from the code.
+func upcloudRegion(regionCode, location string) Region {
+	location = strings.TrimSpace(location)
+	parts := strings.SplitN(regionCode, "-", 2)
 
-		return Regions{
-			Storage: regions["storage"],
-			Compute: regions["compute"],
+	metro := ""
+	if len(parts) == 2 {
+		metro = cleanRegionCode(parts[1])
+	}
+	region := newRegion(regionCode, location, metro)
+
+	if region.Country == "" {
+		locationSplit := strings.Split(location, ", ")
+		country := countryCode(locationSplit[len(locationSplit)-1])
+		if country == "" {
+			country = countryCode(parts[0])
 		}
+		region.City = locationSplit[0]
+		region = region.withCountry(country)
+	}
+	return region
+}
+
+// upcloudDataCentresURL lists the UpCloud data centres.
+const upcloudDataCentresURL = "https://upcloud.com/data-centres"
+
+func GetUpcloudRegions(ctx context.Context) FetchResult {
+	doc, err := get(ctx, upcloudDataCentresURL)
+	if err != nil {
+		return failedResult(err, CategoryStorage, CategoryCompute)
 	}
 	storageRegions := getUpcloudStorageRegions(doc)
 	computeRegions := getUpcloudComputeRegions(doc)
 
-	return Regions{
-		Storage: storageRegions,
-		Compute: computeRegions,
+	return FetchResult{
+		Regions: Regions{
+			CategoryStorage: withStorageEndpoints(storageRegions, upcloudS3Host),
+			CategoryCompute: computeRegions,
+		},
 	}
 }
+
+func init() {
+	Register(NewProvider("upcloud", "UpCloud", []Category{CategoryStorage, CategoryCompute}, GetUpcloudRegions),
+		WithDocsURL(upcloudDataCentresURL))
+}
@@ -1,10 +1,9 @@
 package service
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
-	"net/http"
+	"strings"
 )
 
 type VultrRegion struct {
@@ -19,43 +18,47 @@ type VultrResponse struct {
 	Regions []VultrRegion `json:"regions"`
 }
 
-func getVultrData() VultrResponse {
+func getVultrData(ctx context.Context) (VultrResponse, error) {
 	url := "https://api.vultr.com/v2/regions"
-	resp, err := http.Get(url)
-	if err != nil {
-		panic(err)
-	}
 
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		panic(err)
+	var data VultrResponse
+	if err := getJSON(ctx, url, &data); err != nil {
+		return VultrResponse{}, err
 	}
 
-	var data VultrResponse
-	json.Unmarshal(body, &data)
+	return data, nil
+}
 
-	return data
+// vultrRegion builds a region from the API, which reports the city, country
+// and continent directly.
+func vultrRegion(data VultrRegion) Region {
+	region := newRegion(data.ID, fmt.Sprintf("%s, %s (%s)", data.Name, data.Country, data.Continent), data.ID)
+	region.City = data.Name
+	region = region.withCountry(data.Country)
+	if data.Continent != "" {
+		region.Continent = data.Continent
+	}
+	return region
 }
 
-func getVultrStorageRegions(data VultrResponse) map[string]string {
-	var regionMap map[string]string = make(map[string]string)
+func getVultrStorageRegions(data VultrResponse) map[string]Region {
+	var regionMap map[string]Region = make(map[string]Region)
 	for _, region := range data.Regions {
 		for _, option := range region.Options {
 			if option == "block_storage_storage_opt" {
-				regionMap[region.ID] = fmt.Sprintf("%s, %s (%s) - %s", region.Name, region.Country, region.Continent, region.ID)
+				regionMap[region.ID] = vultrRegion(region)
 			}
 		}
 	}
 
 	return regionMap
 }
-func getVultrComputeRegions(data VultrResponse) map[string]string {
-	var regionMap map[string]string = make(map[string]string)
+func getVultrComputeRegions(data VultrResponse) map[string]Region {
+	var regionMap map[string]Region = make(map[string]Region)
 	for _, region := range data.Regions {
 		for _, option := range region.Options {
 			if option == "kubernetes" {
-				regionMap[region.ID] = fmt.Sprintf("%s, %s (%s) - %s", region.Name, region.Country, region.Continent, region.ID)
+				regionMap[region.ID] = vultrRegion(region)
 			}
 		}
 	}
@@ -63,11 +66,53 @@ func getVultrComputeRegions(data VultrResponse) map[string]string {
 	return regionMap
 }
 
-func GetVultrRegions() Regions {
-	data := getVultrData()
+// vultrOptionCategories maps prefixes of the region options reported by the
+// API to the categories they indicate.
+var vultrOptionCategories = []struct {
+	prefix   string
+	category Category
+}{
+	{"kubernetes", CategoryKubernetes},
+	{"block_storage", CategoryBlockStorage},
+	{"load_balancers", CategoryLoadBalancer},
+}
 
-	return Regions{
-		Storage: getVultrStorageRegions(data),
-		Compute: getVultrComputeRegions(data),
+// addVultrOptionRegions adds every region to the categories its options indicate.
+func addVultrOptionRegions(regions Regions, data VultrResponse) {
+	for _, region := range data.Regions {
+		for _, option := range region.Options {
+			for _, optionCategory := range vultrOptionCategories {
+				if strings.HasPrefix(option, optionCategory.prefix) {
+					regions.Add(optionCategory.category, vultrRegion(region))
+				}
+			}
+		}
 	}
 }
+
+var vultrCategories = []Category{
+	CategoryStorage,
+	CategoryCompute,
+	CategoryKubernetes,
+	CategoryBlockStorage,
+	CategoryLoadBalancer,
+}
+
+func GetVultrRegions(ctx context.Context) FetchResult {
+	data, err := getVultrData(ctx)
+	if err != nil {
+		return failedResult(err, vultrCategories...)
+	}
+
+	regions := Regions{
+		CategoryStorage: getVultrStorageRegions(data),
+		CategoryCompute: getVultrComputeRegions(data),
+	}
+	addVultrOptionRegions(regions, data)
+
+	return FetchResult{Regions: regions}
+}
+
+func init() {
+	Register(NewProvider("vultr", "Vultr", vultrCategories, GetVultrRegions))
+}
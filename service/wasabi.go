@@ -1,13 +1,35 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
 	"github.com/PuerkitoBio/goquery"
 )
 
-// Transforms 'ap-northeast-1' => 'AP Northeast 1 (Tokyo) - ap-northeast-1'
+// wasabiRegionMetros maps Wasabi region codes to the metro code of their
+// location.
+var wasabiRegionMetros = map[string]string{
+	"ap-northeast-1": "nrt",
+	"ap-northeast-2": "kix",
+	"ap-southeast-1": "sin",
+	"ap-southeast-2": "syd",
+	"ca-central-1":   "yyz",
+	"eu-central-1":   "ams",
+	"eu-central-2":   "fra",
+	"eu-south-1":     "mxp",
+	"eu-west-1":      "lhr",
+	"eu-west-2":      "cdg",
+	"eu-west-3":      "lhr",
+	"us-central-1":   "dfw",
+	"us-east-1":      "iad",
+	"us-east-2":      "iad",
+	"us-west-1":      "hil",
+	"us-west-2":      "sjc",
+}
+
+// Transforms 'ap-northeast-1' => 'AP Northeast 1 (Tokyo)'
 // Tokyo is the region name and ap-northeast-1 is the region code
 func transformRegionName(regionName string, regionCode string) string {
 	// transform ap-northeast-1 to AP Northeast 1
@@ -21,23 +43,38 @@ func transformRegionName(regionName string, regionCode string) string {
 		}
 		finalSplitRegionName = append(finalSplitRegionName, strings.Title(region))
 	}
-	// append the region code to the region name
-	return fmt.Sprintf("%s (%s) - %s", strings.Join(finalSplitRegionName, " "), regionName, regionCode)
+	return fmt.Sprintf("%s (%s)", strings.Join(finalSplitRegionName, " "), regionName)
+}
+
+// wasabiRegion builds a Wasabi region with its location filled in from the code.
+func wasabiRegion(regionName string, regionCode string) Region {
+	return newRegion(regionCode, transformRegionName(regionName, regionCode), wasabiRegionMetros[regionCode])
+}
+
+// wasabiS3Host returns the hostname of the S3 endpoint of a region.
+func wasabiS3Host(regionCode string) string {
+	return "s3." + regionCode + ".wasabisys.com"
 }
 
-// getWasabiRegions retrieves the regions and their corresponding codes from the Wasabi website.
+// wasabiRegionsURL lists the Wasabi storage regions.
+const wasabiRegionsURL = "https://wasabi.com/company/storage-regions"
+
+// getWasabiStorageRegions retrieves the regions and their corresponding codes from the Wasabi website.
 // It makes a GET request to the Wasabi locations page and parses the HTML response to extract the region information.
-// The regions and their codes are stored in a map[string]string, where the region code is the key and the region name is the value.
-// If an error occurs during the HTTP request or HTML parsing, nil is returned.
-func getWasabiStorageRegions() map[string]string {
-	url := "https://wasabi.com/company/storage-regions"
-	doc, _ := get(url)
+// The regions are stored in a map[string]Region keyed by region code.
+// If an error occurs during the HTTP request or HTML parsing, it is returned.
+func getWasabiStorageRegions(ctx context.Context) (map[string]Region, error) {
+	url := wasabiRegionsURL
+	doc, err := get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
 
 	if debugging {
 		fmt.Println("Wasabi storage regions URL: ", url)
 	}
 
-	var regionMap map[string]string = make(map[string]string)
+	var regionMap map[string]Region = make(map[string]Region)
 
 	// Iterate over each row in the table body
 	doc.Find("tbody .c-table-row").Each(func(index int, row *goquery.Selection) {
@@ -56,21 +93,32 @@ func getWasabiStorageRegions() map[string]string {
 			if strings.Contains(regionCode, "&") {
 				regions := strings.Split(regionCode, " & ")
 				for _, region := range regions {
-					regionMap[region] = transformRegionName(regionName, region)
+					regionMap[region] = wasabiRegion(regionName, region)
 				}
 				return
 			}
 			// Assign the region code to the region name in the map
 			// Add the region code and name to the map
-			regionMap[regionCode] = transformRegionName(regionName, regionCode)
+			regionMap[regionCode] = wasabiRegion(regionName, regionCode)
 		})
 	})
 
-	return regionMap
+	return regionMap, nil
 }
 
-func GetWasabiRegions() Regions {
-	return Regions{
-		Storage: getWasabiStorageRegions(),
+func GetWasabiRegions(ctx context.Context) FetchResult {
+	var result FetchResult
+
+	storageRegions, err := getWasabiStorageRegions(ctx)
+	result.SetError(CategoryStorage, err)
+	result.Regions = Regions{
+		CategoryStorage: withStorageEndpoints(storageRegions, wasabiS3Host),
 	}
+
+	return result
+}
+
+func init() {
+	Register(NewProvider("wasabi", "Wasabi", []Category{CategoryStorage}, GetWasabiRegions), Disabled(),
+		WithDocsURL(wasabiRegionsURL))
 }
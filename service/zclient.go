@@ -1,9 +1,17 @@
 package service
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"math"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
@@ -11,14 +19,223 @@ import (
 
 var debugging = false
 
+// DefaultHTTPTimeout bounds a single HTTP request made by a provider, on top of
+// whatever deadline the caller's context carries.
+const DefaultHTTPTimeout = 30 * time.Second
+
+// Defaults of the retry and concurrency settings of NewClient.
+const (
+	DefaultMaxRetries  = 3
+	DefaultBaseBackoff = 250 * time.Millisecond
+	DefaultMaxBackoff  = 10 * time.Second
+	DefaultMaxPerHost  = 4
+)
+
+// Client is the HTTP client shared by every provider. It retries requests
+// that fail with a network error, 403, 429 or a 5xx status using jittered
+// exponential backoff, honours Retry-After up to MaxBackoff, and limits how
+// many requests run against the same host at once.
+type Client struct {
+	HTTP        *http.Client
+	MaxRetries  int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	MaxPerHost  int
+
+	mu    sync.Mutex
+	hosts map[string]chan struct{}
+}
+
+// NewClient returns a Client with the default settings sending requests
+// through httpClient, or through a client with DefaultHTTPTimeout if nil.
+func NewClient(httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: DefaultHTTPTimeout}
+	}
+	return &Client{
+		HTTP:        httpClient,
+		MaxRetries:  DefaultMaxRetries,
+		BaseBackoff: DefaultBaseBackoff,
+		MaxBackoff:  DefaultMaxBackoff,
+		MaxPerHost:  DefaultMaxPerHost,
+	}
+}
+
+var client = NewClient(nil)
+
+// SetClient replaces the client used by every provider, for instance to route
+// requests through a proxy or a recording transport.
+func SetClient(c *Client) {
+	client = c
+}
+
+// lookupHost resolves a hostname for the providers that discover regions by
+// DNS. Tests replace it to run without network access.
+var lookupHost = net.DefaultResolver.LookupHost
+
+// resolveHost resolves a hostname with lookupHost and records it as a source
+// of the fetch if it resolves.
+func resolveHost(ctx context.Context, host string) ([]string, error) {
+	addrs, err := lookupHost(ctx, host)
+	if err == nil && len(addrs) > 0 {
+		recordSource(ctx, "dns://"+host)
+	}
+	return addrs, err
+}
+
+// Do sends the request, retrying it as described on Client. The returned
+// response holds a slot of its host's concurrency limit until its body is
+// closed. Responses with a non-retryable status are returned as is.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	recordSource(req.Context(), req.URL.String())
+	release, err := c.acquire(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := c.HTTP.Do(req)
+		if !c.shouldRetry(req, resp, err) || attempt >= c.MaxRetries {
+			if err != nil {
+				release()
+				return nil, err
+			}
+			resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+			return resp, nil
+		}
+
+		delay := c.backoff(attempt)
+		if resp != nil {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				delay = min(retryAfter, c.MaxBackoff)
+			}
+			// Drain the body so the connection can be reused
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+			_log(fmt.Sprintf("Retry number %d for %s after %s: %s", attempt+1, req.URL, delay, resp.Status))
+		} else {
+			_log(fmt.Sprintf("Retry number %d for %s after %s: %v", attempt+1, req.URL, delay, err))
+		}
+
+		if deadline, ok := req.Context().Deadline(); ok && time.Until(deadline) < delay {
+			release()
+			if resp != nil {
+				return nil, fmt.Errorf("giving up on %s: %s, retry after %s exceeds the deadline", req.URL, resp.Status, delay)
+			}
+			return nil, err
+		}
+
+		// Leave the slot to other requests of the host while waiting
+		release()
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if release, err = c.acquire(req); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// shouldRetry reports whether a request that returned resp and err is worth
+// sending again.
+func (c *Client) shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		// Do not retry once the caller gave up
+		return req.Context().Err() == nil
+	}
+	switch {
+	case resp.StatusCode == http.StatusForbidden, resp.StatusCode == http.StatusTooManyRequests:
+		return true
+	case resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented:
+		return true
+	}
+	return false
+}
+
+// backoff returns a random delay of up to BaseBackoff * 2^attempt, capped at
+// MaxBackoff.
+func (c *Client) backoff(attempt int) time.Duration {
+	ceiling := float64(c.BaseBackoff) * math.Pow(2, float64(attempt))
+	if ceiling > float64(c.MaxBackoff) {
+		ceiling = float64(c.MaxBackoff)
+	}
+	if ceiling < 1 {
+		return 0
+	}
+	return time.Duration(rand.Int64N(int64(ceiling)) + 1)
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as
+// an HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(at); delay > 0 {
+			return delay, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// acquire waits for a free slot of the request's host and returns the
+// function that frees it again.
+func (c *Client) acquire(req *http.Request) (func(), error) {
+	if c.MaxPerHost <= 0 {
+		return func() {}, nil
+	}
+
+	c.mu.Lock()
+	if c.hosts == nil {
+		c.hosts = make(map[string]chan struct{})
+	}
+	slots, ok := c.hosts[req.URL.Host]
+	if !ok {
+		slots = make(chan struct{}, c.MaxPerHost)
+		c.hosts[req.URL.Host] = slots
+	}
+	c.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-slots })
+	}, nil
+}
+
+// releasingBody frees a host slot once the response body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
 func _log(msg string) {
 	if debugging {
 		fmt.Println(msg)
 	}
 }
 
-func _createRequest(url string) (*http.Request, error) {
-	req, err := http.NewRequest("GET", url, nil)
+func _createRequest(ctx context.Context, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("error making GET request: %w", err)
 	}
@@ -37,32 +254,13 @@ func _createRequest(url string) (*http.Request, error) {
 }
 
 func _getResponse(req *http.Request) (*http.Response, error) {
-	client := &http.Client{}
-
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("error making GET request: %w", err)
 	}
 
-	if resp.StatusCode == 403 {
-		for i := 0; i < 3; i++ {
-			backoff := time.Duration(math.Pow(2, float64(i))) * (time.Second / 10)
-			time.Sleep(backoff)
-
-			resp, err = client.Do(req)
-			if err != nil {
-				return nil, fmt.Errorf("error making GET request: %w f", err)
-			}
-
-			if resp.StatusCode != 403 {
-				break
-			}
-
-			_log(fmt.Sprintf("Retry number %d\n", i+1))
-		}
-	}
-
 	if resp.StatusCode != 200 {
+		resp.Body.Close()
 		return nil, fmt.Errorf("error loading HTML: %s for %s", resp.Status, req.URL.String())
 	}
 
@@ -86,8 +284,8 @@ func debugError(err error) {
 	}
 }
 
-func get(url string) (*goquery.Document, error) {
-	req, err := _createRequest(url)
+func get(ctx context.Context, url string) (*goquery.Document, error) {
+	req, err := _createRequest(ctx, url)
 	if err != nil {
 		debugError(err)
 		return nil, err
@@ -107,3 +305,33 @@ func get(url string) (*goquery.Document, error) {
 
 	return doc, nil
 }
+
+// getJSON fetches url and decodes the JSON response body into v.
+func getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("error making GET request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making GET request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("error loading JSON: %s for %s", resp.Status, url)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response body: %w", err)
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("error decoding JSON from %s: %w", url, err)
+	}
+
+	return nil
+}
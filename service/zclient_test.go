@@ -0,0 +1,229 @@
+package service
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testClient returns a client with short backoffs for use against server.
+func testClient(server *httptest.Server) *Client {
+	c := NewClient(server.Client())
+	c.BaseBackoff = time.Millisecond
+	c.MaxBackoff = 5 * time.Millisecond
+	return c
+}
+
+func doGet(t *testing.T, c *Client, url string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequestWithContext(context.Background(), "GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("Do() error: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestClientRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		want     int
+		requests int32
+	}{
+		{"success", []int{200}, 200, 1},
+		{"server error", []int{503, 502, 200}, 200, 3},
+		{"rate limited", []int{429, 200}, 200, 2},
+		{"forbidden", []int{403, 200}, 200, 2},
+		{"not found", []int{404, 200}, 404, 1},
+		{"gives up", []int{500, 500, 500, 500, 500}, 500, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&requests, 1)
+				w.WriteHeader(tt.statuses[n-1])
+			}))
+			defer server.Close()
+
+			resp := doGet(t, testClient(server), server.URL)
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+			if requests != tt.requests {
+				t.Errorf("requests = %d, want %d", requests, tt.requests)
+			}
+		})
+	}
+}
+
+func TestClientRetryAfter(t *testing.T) {
+	var requests int32
+	var first time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			first = time.Now()
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		if waited := time.Since(first); waited < time.Second {
+			t.Errorf("retried after %s, want at least 1s", waited)
+		}
+	}))
+	defer server.Close()
+
+	c := testClient(server)
+	c.MaxBackoff = 2 * time.Second
+	resp := doGet(t, c, server.URL)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestClientRetryAfterBeyondMaxBackoff(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	resp := doGet(t, testClient(server), server.URL)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Do() took %s, want the wait capped at MaxBackoff", elapsed)
+	}
+}
+
+func TestClientRetryAfterBeyondDeadline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+
+	c := testClient(server)
+	c.MaxBackoff = time.Minute
+	start := time.Now()
+	if _, err := c.Do(req); err == nil {
+		t.Fatal("Do() succeeded, want an error")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Do() took %s, want it to give up at once", elapsed)
+	}
+}
+
+func TestClientPerHostLimit(t *testing.T) {
+	var running, peak int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+	}))
+	defer server.Close()
+
+	c := testClient(server)
+	c.MaxPerHost = 2
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", server.URL, nil)
+			resp, err := c.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	if peak > 2 {
+		t.Errorf("peak concurrent requests = %d, want at most 2", peak)
+	}
+}
+
+func TestClientRetryFreesSlot(t *testing.T) {
+	limited := make(chan struct{})
+	var once sync.Once
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/limited" {
+			first := false
+			once.Do(func() { first = true })
+			if first {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				close(limited)
+			}
+		}
+	}))
+	defer server.Close()
+
+	c := testClient(server)
+	c.MaxBackoff = 2 * time.Second
+	c.MaxPerHost = 1
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req, _ := http.NewRequest("GET", server.URL+"/limited", nil)
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+	}()
+	<-limited
+
+	start := time.Now()
+	resp := doGet(t, c, server.URL+"/other")
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("request took %s while another waited to retry, want the slot freed", elapsed)
+	}
+	<-done
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d, ok := parseRetryAfter("3"); !ok || d != 3*time.Second {
+		t.Errorf(`parseRetryAfter("3") = %s, %v`, d, ok)
+	}
+	at := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if d, ok := parseRetryAfter(at); !ok || d <= 55*time.Second || d > time.Minute {
+		t.Errorf("parseRetryAfter(%q) = %s, %v", at, d, ok)
+	}
+	if _, ok := parseRetryAfter("soon"); ok {
+		t.Error(`parseRetryAfter("soon") ok = true`)
+	}
+}